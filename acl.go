@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// AccessPolicyKey - ledger key holding the access policy table
+const AccessPolicyKey = "dataUploadcc-access-policy"
+
+// AccessPolicyObjectType - defines the access policy object type
+const AccessPolicyObjectType = "access-policy"
+
+// DefaultPolicyName - the policy used for functions that don't have their own
+const DefaultPolicyName = "*"
+
+// FunctionPolicy - who can invoke a function. The caller's MSP has to be one of MSPIDs when it is set,
+// and for every attribute the caller's certificate has to have one of the listed values
+type FunctionPolicy struct {
+	MSPIDs     []string            `json:"mspIds,omitempty"`
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+// AccessPolicy - the policy table stored on the ledger, function name to policy
+type AccessPolicy struct {
+	DocType   string                    `json:"docType"`
+	Functions map[string]FunctionPolicy `json:"functions"`
+}
+
+// ============================================================================================================================
+// Get Access Policy - reads the policy table from the ledger, an empty table is returned if none is stored
+// ============================================================================================================================
+func getAccessPolicy(stub shim.ChaincodeStubInterface) (AccessPolicy, error) {
+	policy := AccessPolicy{DocType: AccessPolicyObjectType, Functions: map[string]FunctionPolicy{}}
+
+	policyAsBytes, err := stub.GetState(AccessPolicyKey)
+	if err != nil {
+		return policy, errors.New("getAccessPolicy: Failed to read access policy - " + err.Error())
+	}
+	if len(policyAsBytes) == 0 {
+		return policy, nil
+	}
+	if err := json.Unmarshal(policyAsBytes, &policy); err != nil {
+		return policy, errors.New("getAccessPolicy: Error with stored JSON format - " + err.Error())
+	}
+	if policy.Functions == nil {
+		policy.Functions = map[string]FunctionPolicy{}
+	}
+	return policy, nil
+} // end of getAccessPolicy
+
+// ============================================================================================================================
+// Check Access - checks the caller against the policy of function, called by Invoke before dispatching.
+// Functions without a policy use the "*" policy, without either every channel member can invoke them
+// ============================================================================================================================
+func checkAccess(stub shim.ChaincodeStubInterface, function string) error {
+	if function == "setAccessPolicy" {
+		// only checked against the admin organizations so a policy can't lock the admins out
+		return nil
+	}
+	policy, err := getAccessPolicy(stub)
+	if err != nil {
+		return err
+	}
+	functionPolicy, ok := policy.Functions[function]
+	if !ok {
+		functionPolicy, ok = policy.Functions[DefaultPolicyName]
+	}
+	if !ok {
+		return nil
+	}
+
+	mspID, err := getCallerMSP(stub)
+	if err != nil {
+		return err
+	}
+	if len(functionPolicy.MSPIDs) > 0 && !containsString(functionPolicy.MSPIDs, mspID) {
+		return errors.New("checkAccess: " + function + " can only be invoked by " + strings.Join(functionPolicy.MSPIDs, ", ") + ", caller is " + mspID)
+	}
+
+	// sorted so the error names the same attribute on every peer
+	names := make([]string, 0, len(functionPolicy.Attributes))
+	for name := range functionPolicy.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := functionPolicy.Attributes[name]
+		value, found, err := cid.GetAttributeValue(stub, name)
+		if err != nil {
+			return errors.New("checkAccess: Failed to read attribute " + name + " - " + err.Error())
+		}
+		if !found {
+			return errors.New("checkAccess: " + function + " requires attribute " + name + "=" + strings.Join(values, "|") + ", caller doesn't have " + name)
+		}
+		if !containsString(values, value) {
+			return errors.New("checkAccess: " + function + " requires attribute " + name + "=" + strings.Join(values, "|") + ", caller has " + name + "=" + value)
+		}
+	}
+	return nil
+} // end of checkAccess
+
+// checkAdmin - the caller has to be in the adminMspIds of the config, used by the functions that change data
+// of every organization. Without adminMspIds in the config nobody can call them
+func checkAdmin(stub shim.ChaincodeStubInterface, function string, action string) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	mspID, err := getCallerMSP(stub)
+	if err != nil {
+		return err
+	}
+	if !containsString(config.AdminMSPIDs, mspID) {
+		return errors.New(function + ": only the admin organizations in the config can " + action + ", caller is " + mspID)
+	}
+	return nil
+}
+
+// containsString - true when value is one of values
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// Set Access Policy - passes the function name and the JSON policy, e.g. {"mspIds":["Org1MSP"],"attributes":{"role":["manufacturer"]}},
+// an empty policy argument removes the function's policy. Only callers from the adminMspIds in the config can change
+// policies, use "*" as the function name for the policy of every function without its own
+// ============================================================================================================================
+func (t *DataChainCode) setAccessPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("setAccessPolicy: enter")
+	defer fmt.Println("setAccessPolicy: exit")
+
+	if len(args) != 2 || len(args[0]) == 0 {
+		errorString := "setAccessPolicy: Incorrect number of arguments. Expecting 2, the function name and the JSON policy or \"\" to remove it"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	if err := checkAdmin(stub, "setAccessPolicy", "change access policies"); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+
+	policy, err := getAccessPolicy(stub)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	function := args[0]
+	if len(args[1]) == 0 {
+		delete(policy.Functions, function)
+	} else {
+		var functionPolicy FunctionPolicy
+		if err := json.Unmarshal([]byte(args[1]), &functionPolicy); err != nil {
+			errorString := "setAccessPolicy: policy must be a JSON object with mspIds and attributes - " + err.Error()
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		if len(functionPolicy.MSPIDs) == 0 && len(functionPolicy.Attributes) == 0 {
+			errorString := "setAccessPolicy: policy needs mspIds or attributes, pass \"\" to remove the policy"
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		for name, values := range functionPolicy.Attributes {
+			if len(values) == 0 {
+				errorString := "setAccessPolicy: attribute " + name + " needs at least one value"
+				fmt.Println(errorString)
+				return shim.Error(errorString)
+			}
+		}
+		policy.Functions[function] = functionPolicy
+	}
+
+	policyAsBytes, err := json.Marshal(policy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("setAccessPolicy: call putState, key = ", AccessPolicyKey)
+	if err := stub.PutState(AccessPolicyKey, policyAsBytes); err != nil {
+		fmt.Println("setAccessPolicy: Error invoking on chaincode:", err)
+		return shim.Error(err.Error())
+	}
+	return shim.Success(policyAsBytes)
+} // end of setAccessPolicy
+
+// ============================================================================================================================
+// Query Access Policy - returns the policy table
+// ============================================================================================================================
+func (t *DataChainCode) queryAccessPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("queryAccessPolicy: enter")
+	defer fmt.Println("queryAccessPolicy: exit")
+
+	policy, err := getAccessPolicy(stub)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	policyAsBytes, err := json.Marshal(policy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(policyAsBytes)
+} // end of queryAccessPolicy
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	fmt.Println("TestAccessPolicy: enter")
+	defer fmt.Println("TestAccessPolicy: exit")
+
+	stub := newTestStub(t)
+	results := stub.MockInit("initTx", [][]byte{[]byte("init"), []byte(`{"adminMspIds":["RegulatorMSP"]}`)})
+	assert.Equal(t, 200, int(results.Status), "Init admins")
+
+	// without a policy every member can invoke
+	setCreator(t, stub, "DistributorMSP", "user1")
+	results = stub.MockInvoke("readTx1", [][]byte{[]byte("queryAccessPolicy")})
+	assert.Equal(t, 200, int(results.Status), "queryAccessPolicy")
+
+	results = stub.MockInvoke("policyTx1", [][]byte{[]byte("setAccessPolicy"), []byte("createProduct"), []byte(`{"mspIds":["ManufacturerMSP"]}`)})
+	assert.Equal(t, 500, int(results.Status), "setAccessPolicy by a member")
+	assert.Contains(t, results.Message, "only the admin organizations")
+
+	setCreator(t, stub, "RegulatorMSP", "admin")
+	results = stub.MockInvoke("policyTx2", [][]byte{[]byte("setAccessPolicy"), []byte("createProduct"), []byte(`{"mspIds":["ManufacturerMSP"],"attributes":{"role":["manufacturer","packager"]}}`)})
+	assert.Equal(t, 200, int(results.Status), "setAccessPolicy")
+	results = stub.MockInvoke("policyTx3", [][]byte{[]byte("setAccessPolicy"), []byte("*"), []byte(`{"mspIds":["ManufacturerMSP","DistributorMSP"]}`)})
+	assert.Equal(t, 200, int(results.Status), "setAccessPolicy default")
+	results = stub.MockInvoke("policyTx4", [][]byte{[]byte("setAccessPolicy"), []byte("readProduct"), []byte(`{}`)})
+	assert.Equal(t, 500, int(results.Status), "setAccessPolicy empty policy")
+	results = stub.MockInvoke("policyTx5", [][]byte{[]byte("setAccessPolicy"), []byte("readProduct"), []byte(`{"attributes":{"role":[]}}`)})
+	assert.Equal(t, 500, int(results.Status), "setAccessPolicy attribute without values")
+
+	// the default policy leaves the admins out of other functions but not out of setAccessPolicy
+	results = stub.MockInvoke("readTx2", [][]byte{[]byte("queryAccessPolicy")})
+	assert.Equal(t, 500, int(results.Status), "queryAccessPolicy by an admin outside the default policy")
+
+	setCreator(t, stub, "DistributorMSP", "user1")
+	results = stub.MockInvoke("createTx1", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 500, int(results.Status), "createProduct from another MSP")
+	assert.Contains(t, results.Message, "createProduct can only be invoked by ManufacturerMSP")
+	results = stub.MockInvoke("readTx3", [][]byte{[]byte("queryAccessPolicy")})
+	assert.Equal(t, 200, int(results.Status), "queryAccessPolicy by the default policy")
+
+	setCreator(t, stub, "ManufacturerMSP", "user1")
+	results = stub.MockInvoke("createTx2", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 500, int(results.Status), "createProduct without the role attribute")
+	assert.Contains(t, results.Message, "caller doesn't have role")
+
+	setCreatorWithAttributes(t, stub, "ManufacturerMSP", "user1", map[string]string{"role": "dispenser"})
+	results = stub.MockInvoke("createTx3", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 500, int(results.Status), "createProduct with the wrong role")
+	assert.Contains(t, results.Message, "caller has role=dispenser")
+
+	setCreatorWithAttributes(t, stub, "ManufacturerMSP", "user1", map[string]string{"role": "packager"})
+	results = stub.MockInvoke("createTx4", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 200, int(results.Status), "createProduct with the role")
+
+	// removing the policy opens the function again
+	setCreator(t, stub, "RegulatorMSP", "admin")
+	results = stub.MockInvoke("policyTx6", [][]byte{[]byte("setAccessPolicy"), []byte("*"), []byte("")})
+	assert.Equal(t, 200, int(results.Status), "setAccessPolicy remove")
+	results = stub.MockInvoke("readTx4", [][]byte{[]byte("queryAccessPolicy")})
+	assert.Equal(t, 200, int(results.Status), "queryAccessPolicy after removing the default")
+	assert.Equal(t, `{"docType":"access-policy","functions":{"createProduct":{"mspIds":["ManufacturerMSP"],"attributes":{"role":["manufacturer","packager"]}}}}`, string(results.Payload))
+} // end of TestAccessPolicy
@@ -0,0 +1,800 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// ContainerObjectType - defines the container object type, also the composite key object type
+const ContainerObjectType = "container-data"
+
+// lifecycle events written by the aggregation functions
+const (
+	CommissionEvent = "commission"
+	PackEvent       = "pack"
+	UnpackEvent     = "unpack"
+)
+
+// chaincode events emitted by aggregate and disaggregate, the payload is a ContainerEvent
+const (
+	ProductsAggregatedEvent    = "ProductsAggregated"
+	ProductsDisaggregatedEvent = "ProductsDisaggregated"
+)
+
+// containerEventNames - the chaincode event emitted when the custody functions are called with an SSCC
+var containerEventNames = map[string]string{
+	ShipEvent:    "ContainerShipped",
+	ReceiveEvent: "ContainerReceived",
+	RejectEvent:  "ContainerShipmentRejected",
+}
+
+// MaxContainerItems - the most products and containers a container can hold including nested containers,
+// shipping a container writes every one of them in the same transaction
+const MaxContainerItems = 1000
+
+// Container - a case or pallet identified by its SSCC. Children are the keys of the products and the SSCCs of
+// the containers packed in it, a container packed in another container has the SSCC of that one as its parent
+type Container struct {
+	DocType          string    `json:"docType"`
+	Sscc             string    `json:"sscc"`
+	Event            string    `json:"event"`
+	Status           string    `json:"status"`
+	Gln              string    `json:"gln"`
+	Location         string    `json:"location"`
+	ToGln            string    `json:"toGln,omitempty"`
+	ToLocation       string    `json:"toLocation,omitempty"`
+	Parent           string    `json:"parent,omitempty"`
+	Children         []string  `json:"children"`
+	Shipment         *Shipment `json:"shipment,omitempty"`
+	EventDate        string    `json:"event_dt"`
+	Version          int       `json:"version"`
+	TxID             string    `json:"txId"`
+	SubmitterMSPID   string    `json:"submitterMspId"`
+	SubmitterSubject string    `json:"submitterSubject"`
+}
+
+// ContainerEvent - payload of the container chaincode events, Keys are the products and containers
+// that were packed, unpacked or moved with the container
+type ContainerEvent struct {
+	Sscc    string   `json:"sscc"`
+	Event   string   `json:"event"`
+	Status  string   `json:"status"`
+	Gln     string   `json:"gln"`
+	Keys    []string `json:"keys"`
+	Version int      `json:"version"`
+	TxID    string   `json:"txId"`
+}
+
+// isSscc - true for an 18 digit serial shipping container code, the check digit is only enforced in strict gs1Mode
+func isSscc(value string) bool {
+	return len(value) == 18 && isDigits(value)
+}
+
+// getContainerKey - the ledger key of the container with sscc
+func getContainerKey(stub shim.ChaincodeStubInterface, sscc string) (string, error) {
+	return stub.CreateCompositeKey(ContainerObjectType, []string{sscc})
+}
+
+// getContainer - the container with sscc, nil when there is none
+func getContainer(stub shim.ChaincodeStubInterface, sscc string) (*Container, error) {
+	key, err := getContainerKey(stub, sscc)
+	if err != nil {
+		return nil, err
+	}
+	containerAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("getContainer: Failed to read container " + sscc + " - " + err.Error())
+	}
+	if len(containerAsBytes) == 0 {
+		return nil, nil
+	}
+	var container Container
+	if err := json.Unmarshal(containerAsBytes, &container); err != nil {
+		return nil, errors.New("getContainer: Error with stored JSON format - " + err.Error())
+	}
+	return &container, nil
+}
+
+// asProduct - the custody state of the container, so containers go through the same lifecycle and custody
+// rules as products
+func (container Container) asProduct() Product {
+	return Product{
+		Event:            container.Event,
+		Status:           container.Status,
+		Gln:              container.Gln,
+		Location:         container.Location,
+		ToGln:            container.ToGln,
+		ToLocation:       container.ToLocation,
+		Parent:           container.Parent,
+		Shipment:         container.Shipment,
+		EventDate:        container.EventDate,
+		Version:          container.Version,
+		TxID:             container.TxID,
+		SubmitterMSPID:   container.SubmitterMSPID,
+		SubmitterSubject: container.SubmitterSubject,
+	}
+}
+
+// setState - copies the custody state set by asProduct back to the container
+func (container *Container) setState(product Product) {
+	container.Event = product.Event
+	container.Status = product.Status
+	container.Gln = product.Gln
+	container.Location = product.Location
+	container.ToGln = product.ToGln
+	container.ToLocation = product.ToLocation
+	container.Parent = product.Parent
+	container.Shipment = product.Shipment
+	container.EventDate = product.EventDate
+	container.Version = product.Version
+	container.TxID = product.TxID
+	container.SubmitterMSPID = product.SubmitterMSPID
+	container.SubmitterSubject = product.SubmitterSubject
+}
+
+// aggregationMember - a product or container in a container, id is the product key or the SSCC.
+// state is the product, or the container's custody state when container is set
+type aggregationMember struct {
+	id        string
+	state     Product
+	container *Container
+}
+
+// getAggregationMember - reads the product key or SSCC id
+func getAggregationMember(stub shim.ChaincodeStubInterface, id string) (aggregationMember, error) {
+	if !isSscc(id) {
+		product, err := getProduct(stub, id)
+		return aggregationMember{id: id, state: product}, err
+	}
+	container, err := getContainer(stub, id)
+	if err != nil {
+		return aggregationMember{id: id}, err
+	}
+	if container == nil {
+		return aggregationMember{id: id}, errors.New("getAggregationMember: container " + id + " does not exist")
+	}
+	return aggregationMember{id: id, state: container.asProduct(), container: container}, nil
+}
+
+// putAggregationMember - sets the version and txId and writes the member, the caller emits the event, see emitProductEvent
+func putAggregationMember(stub shim.ChaincodeStubInterface, member *aggregationMember) error {
+	member.state.Version++
+	member.state.TxID = stub.GetTxID()
+	key := member.id
+	var memberAsBytes []byte
+	var err error
+	if member.container != nil {
+		member.container.setState(member.state)
+		if key, err = getContainerKey(stub, member.id); err != nil {
+			return err
+		}
+		memberAsBytes, err = json.Marshal(member.container)
+	} else {
+		memberAsBytes, err = member.state.toBytes()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("putAggregationMember: call putState, key = ", displayKey(stub, key))
+	return stub.PutState(key, memberAsBytes)
+}
+
+// getContainerContents - every product and container in container, including the contents of nested containers
+func getContainerContents(stub shim.ChaincodeStubInterface, container *Container) ([]aggregationMember, error) {
+	contents := []aggregationMember{}
+	pending := append([]string{}, container.Children...)
+	for len(pending) > 0 {
+		if len(contents) == MaxContainerItems {
+			return nil, errors.New("getContainerContents: container " + container.Sscc + " holds more than " + strconv.Itoa(MaxContainerItems) + " products and containers")
+		}
+		member, err := getAggregationMember(stub, pending[0])
+		if err != nil {
+			return nil, err
+		}
+		pending = pending[1:]
+		if member.container != nil {
+			pending = append(pending, member.container.Children...)
+		}
+		contents = append(contents, member)
+	}
+	return contents, nil
+}
+
+// countContainerContents - the number of products and containers in container once members are added to it,
+// including the contents of nested containers
+func countContainerContents(stub shim.ChaincodeStubInterface, container *Container, members []aggregationMember) (int, error) {
+	contents, err := getContainerContents(stub, container)
+	if err != nil {
+		return 0, err
+	}
+	count := len(contents)
+	for _, member := range members {
+		count++
+		if member.container != nil {
+			nested, err := getContainerContents(stub, member.container)
+			if err != nil {
+				return 0, err
+			}
+			count += len(nested)
+		}
+	}
+	return count, nil
+}
+
+// emitContainerEvent - sets the chaincode event for a container function
+func emitContainerEvent(stub shim.ChaincodeStubInterface, name string, container *Container, keys []string) error {
+	payload, err := json.Marshal(ContainerEvent{
+		Sscc:    container.Sscc,
+		Event:   container.Event,
+		Status:  container.Status,
+		Gln:     container.Gln,
+		Keys:    keys,
+		Version: container.Version,
+		TxID:    container.TxID,
+	})
+	if err != nil {
+		return err
+	}
+	if err := stub.SetEvent(name, payload); err != nil {
+		return errors.New("emitContainerEvent: Failed to set event - " + err.Error())
+	}
+	return nil
+}
+
+// getContainerChildren - parses the JSON array of product keys and SSCCs passed to aggregate and disaggregate
+func getContainerChildren(stub shim.ChaincodeStubInterface, function string, childrenJSON string) ([]string, error) {
+	var children []string
+	if err := json.Unmarshal([]byte(childrenJSON), &children); err != nil {
+		return nil, errors.New(function + ": children must be a JSON array of product keys and SSCCs - " + err.Error())
+	}
+	if len(children) == 0 || len(children) > MaxProductItems {
+		return nil, errors.New(function + ": expecting 1 to " + strconv.Itoa(MaxProductItems) + " children, got " + strconv.Itoa(len(children)))
+	}
+	seen := map[string]bool{}
+	for _, child := range children {
+		if seen[child] {
+			return nil, errors.New(function + ": " + displayKey(stub, child) + " is listed twice")
+		}
+		seen[child] = true
+	}
+	return children, nil
+}
+
+// checkContainerHolder - the container can be packed or unpacked by the caller, it has to be at a GLN
+// registered to the caller and can't be in transit or packed in another container
+func checkContainerHolder(stub shim.ChaincodeStubInterface, function string, container *Container, submitter Submitter) error {
+	if len(container.Parent) > 0 {
+		return errors.New(function + ": container " + container.Sscc + " is packed in container " + container.Parent + ", disaggregate that first")
+	}
+	if container.Shipment.isPending() {
+		return errors.New(function + ": container " + container.Sscc + " has a pending shipment to " + container.Shipment.ToGln)
+	}
+	return checkPartyOwner(stub, submitter.MSPID, "gln", container.Gln)
+}
+
+// ============================================================================================================================
+// Aggregate - packs products and containers into a container, passes the SSCC and a JSON array of product keys and
+// SSCCs, e.g. cases into a pallet. The container is created at the GLN of the children if it doesn't exist
+// ============================================================================================================================
+// Children have to be at the container's GLN, registered to the caller, and not already in a container. They record
+// the pack event and move with the container until they are disaggregated.
+func (t *DataChainCode) aggregate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("aggregate: enter")
+	defer fmt.Println("aggregate: exit")
+
+	if len(args) != 2 {
+		errorString := "aggregate: Incorrect number of arguments. Expecting 2, the SSCC and a JSON array of product keys and SSCCs"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	sscc := args[0]
+	config, err := getConfig(stub)
+	if err != nil {
+		fmt.Println("aggregate: Error reading config:", err)
+		return shim.Error(err.Error())
+	}
+	if !isSscc(sscc) || (config.GS1Mode == GS1ModeStrict && !hasValidCheckDigit(sscc)) {
+		errorString := "aggregate: " + sscc + " is not an 18 digit SSCC with a valid check digit"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	children, err := getContainerChildren(stub, "aggregate", args[1])
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	submitter, err := getSubmitter(stub)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println("aggregate: Error getting transaction time:", err)
+		return shim.Error(err.Error())
+	}
+
+	container, err := getContainer(stub, sscc)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	members := []aggregationMember{}
+	for _, child := range children {
+		if child == sscc {
+			errorString := "aggregate: container " + sscc + " can't contain itself"
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		member, err := getAggregationMember(stub, child)
+		if err != nil {
+			fmt.Println(err)
+			return shim.Error(err.Error())
+		}
+		members = append(members, member)
+	}
+
+	if container == nil {
+		// created where the children are, with the event that creates products
+		state := Product{Event: CommissionEvent, Gln: members[0].state.Gln, Location: members[0].state.Location, EventDate: now.Format(EventDateFormat)}
+		if err := applyLifecycle(config.Lifecycle, nil, &state); err != nil {
+			fmt.Println("aggregate: Error checking lifecycle:", err)
+			return shim.Error(err.Error())
+		}
+		container = &Container{DocType: ContainerObjectType, Sscc: sscc, Children: []string{}}
+		container.setState(state)
+	}
+	if err := checkContainerHolder(stub, "aggregate", container, submitter); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	// the container and everything in it has to stay small enough to ship in one transaction
+	count, err := countContainerContents(stub, container, members)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if count > MaxContainerItems {
+		errorString := "aggregate: container " + sscc + " would hold " + strconv.Itoa(count) + " products and containers, at most " + strconv.Itoa(MaxContainerItems) + " are allowed"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	for idx := range members {
+		member := &members[idx]
+		existing := member.state
+		if len(existing.Parent) > 0 {
+			errorString := "aggregate: " + displayKey(stub, member.id) + " is already packed in container " + existing.Parent
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		if existing.Shipment.isPending() {
+			errorString := "aggregate: " + displayKey(stub, member.id) + " has a pending shipment to " + existing.Shipment.ToGln
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		if existing.Gln != container.Gln {
+			errorString := "aggregate: " + displayKey(stub, member.id) + " is at GLN " + existing.Gln + ", container " + sscc + " is at GLN " + container.Gln
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		member.state.Event = PackEvent
+		if err := applyLifecycle(config.Lifecycle, &existing, &member.state); err != nil {
+			errorString := "aggregate: Error checking lifecycle of " + displayKey(stub, member.id) + " - " + err.Error()
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		member.state.Parent = sscc
+		member.state.EventDate = now.Format(EventDateFormat)
+		member.state.SubmitterMSPID = submitter.MSPID
+		member.state.SubmitterSubject = submitter.Subject
+		if err := putAggregationMember(stub, member); err != nil {
+			fmt.Println("aggregate: Error writing "+displayKey(stub, member.id)+":", err)
+			return shim.Error(err.Error())
+		}
+		container.Children = append(container.Children, member.id)
+	}
+
+	state := container.asProduct()
+	state.SubmitterMSPID = submitter.MSPID
+	state.SubmitterSubject = submitter.Subject
+	containerMember := aggregationMember{id: sscc, state: state, container: container}
+	if err := putAggregationMember(stub, &containerMember); err != nil {
+		fmt.Println("aggregate: Error writing container:", err)
+		return shim.Error(err.Error())
+	}
+	if err := emitContainerEvent(stub, ProductsAggregatedEvent, container, children); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	containerAsBytes, err := json.Marshal(container)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(containerAsBytes)
+} // end of aggregate
+
+// ============================================================================================================================
+// Disaggregate - unpacks products and containers from a container, passes the SSCC and an optional JSON array of the
+// product keys and SSCCs to unpack, without it the container is emptied
+// ============================================================================================================================
+// The children record the unpack event and can move on their own again. Containers can only be unpacked by the
+// holder, while they aren't in transit or packed in another container.
+func (t *DataChainCode) disaggregate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("disaggregate: enter")
+	defer fmt.Println("disaggregate: exit")
+
+	if len(args) < 1 || len(args) > 2 {
+		errorString := "disaggregate: Incorrect number of arguments. Expecting 1 or 2, the SSCC and an optional JSON array of product keys and SSCCs"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	sscc := args[0]
+	container, err := getContainer(stub, sscc)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if container == nil {
+		errorString := "disaggregate: container " + sscc + " does not exist"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	children := container.Children
+	if len(args) > 1 {
+		if children, err = getContainerChildren(stub, "disaggregate", args[1]); err != nil {
+			fmt.Println(err)
+			return shim.Error(err.Error())
+		}
+	}
+	submitter, err := getSubmitter(stub)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if err := checkContainerHolder(stub, "disaggregate", container, submitter); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		fmt.Println("disaggregate: Error reading config:", err)
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println("disaggregate: Error getting transaction time:", err)
+		return shim.Error(err.Error())
+	}
+
+	unpacked := map[string]bool{}
+	for _, child := range children {
+		if !containsString(container.Children, child) {
+			errorString := "disaggregate: " + displayKey(stub, child) + " is not in container " + sscc
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		member, err := getAggregationMember(stub, child)
+		if err != nil {
+			fmt.Println(err)
+			return shim.Error(err.Error())
+		}
+		// a unit recalled or quarantined while packed is taken out of the container and keeps its event and status
+		if member.state.Status == StatusPacked {
+			existing := member.state
+			member.state.Event = UnpackEvent
+			if err := applyLifecycle(config.Lifecycle, &existing, &member.state); err != nil {
+				errorString := "disaggregate: Error checking lifecycle of " + displayKey(stub, member.id) + " - " + err.Error()
+				fmt.Println(errorString)
+				return shim.Error(errorString)
+			}
+			member.state.EventDate = now.Format(EventDateFormat)
+		}
+		member.state.Parent = ""
+		member.state.SubmitterMSPID = submitter.MSPID
+		member.state.SubmitterSubject = submitter.Subject
+		if err := putAggregationMember(stub, &member); err != nil {
+			fmt.Println("disaggregate: Error writing "+displayKey(stub, member.id)+":", err)
+			return shim.Error(err.Error())
+		}
+		unpacked[child] = true
+	}
+
+	remaining := []string{}
+	for _, child := range container.Children {
+		if !unpacked[child] {
+			remaining = append(remaining, child)
+		}
+	}
+	container.Children = remaining
+	state := container.asProduct()
+	state.SubmitterMSPID = submitter.MSPID
+	state.SubmitterSubject = submitter.Subject
+	containerMember := aggregationMember{id: sscc, state: state, container: container}
+	if err := putAggregationMember(stub, &containerMember); err != nil {
+		fmt.Println("disaggregate: Error writing container:", err)
+		return shim.Error(err.Error())
+	}
+	if err := emitContainerEvent(stub, ProductsDisaggregatedEvent, container, children); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	containerAsBytes, err := json.Marshal(container)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(containerAsBytes)
+} // end of disaggregate
+
+// ============================================================================================================================
+// Read Container - returns the container with the SSCC passed
+// ============================================================================================================================
+func (t *DataChainCode) readContainer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("readContainer: enter")
+	defer fmt.Println("readContainer: exit")
+
+	if len(args) != 1 {
+		errorString := "readContainer: Incorrect number of arguments. Expecting 1, the SSCC"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	container, err := getContainer(stub, args[0])
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if container == nil {
+		errorString := "readContainer: container " + args[0] + " does not exist"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	containerAsBytes, err := json.Marshal(container)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(containerAsBytes)
+} // end of readContainer
+
+// ============================================================================================================================
+// Ship Container - shipProduct called with an SSCC, passes the SSCC, the receiver's GLN and optionally the receiver's
+// location and name. Every product and container in it is shipped with it
+// ============================================================================================================================
+func shipContainer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("shipContainer: enter")
+	defer fmt.Println("shipContainer: exit")
+
+	sscc, toGln := args[0], args[1]
+	container, err := getContainer(stub, sscc)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if container == nil {
+		errorString := "shipContainer: container " + sscc + " does not exist"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	submitter, err := getSubmitter(stub)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if err := checkContainerHolder(stub, "shipContainer", container, submitter); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	toMSPID, err := getGlnOwner(stub, toGln)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if len(toMSPID) == 0 {
+		errorString := "shipContainer: GLN " + toGln + " is not registered to an organization"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		fmt.Println("shipContainer: Error reading config:", err)
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println("shipContainer: Error getting transaction time:", err)
+		return shim.Error(err.Error())
+	}
+	contents, err := getContainerContents(stub, container)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+
+	members := append([]aggregationMember{{id: sscc, state: container.asProduct(), container: container}}, contents...)
+	for idx := range members {
+		member := &members[idx]
+		existing := member.state
+		if existing.Shipment.isPending() {
+			errorString := "shipContainer: " + displayKey(stub, member.id) + " has a pending shipment to " + existing.Shipment.ToGln
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		member.state.Event = ShipEvent
+		if member.container == nil {
+			if err := checkExpiryPolicy(member.state, now); err != nil {
+				errorString := "shipContainer: Error checking expiry of " + displayKey(stub, member.id) + " - " + err.Error()
+				fmt.Println(errorString)
+				return shim.Error(errorString)
+			}
+		}
+		if err := applyLifecycle(config.Lifecycle, &existing, &member.state); err != nil {
+			errorString := "shipContainer: Error checking lifecycle of " + displayKey(stub, member.id) + " - " + err.Error()
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		member.state.ToGln = toGln
+		member.state.ToLocation = ""
+		if len(args) > 2 {
+			member.state.ToLocation = args[2]
+		}
+		if member.container == nil {
+			member.state.Receiver = ""
+			if len(args) > 3 {
+				member.state.Receiver = args[3]
+			}
+		}
+		member.state.EventDate = now.Format(EventDateFormat)
+		member.state.Shipment = &Shipment{
+			State:       ShipmentPending,
+			FromGln:     existing.Gln,
+			ToGln:       toGln,
+			ToMSPID:     toMSPID,
+			PriorStatus: existing.Status,
+			ShipTxID:    stub.GetTxID(),
+		}
+		member.state.SubmitterMSPID = submitter.MSPID
+		member.state.SubmitterSubject = submitter.Subject
+		if err := putAggregationMember(stub, member); err != nil {
+			fmt.Println("shipContainer: Error writing "+displayKey(stub, member.id)+":", err)
+			return shim.Error(err.Error())
+		}
+	}
+
+	if err := emitContainerEvent(stub, containerEventNames[ShipEvent], container, getMemberIDs(contents)); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(stub.GetTxID()))
+} // end of shipContainer
+
+// ============================================================================================================================
+// Close Container Shipment - acceptShipment and rejectShipment called with an SSCC, only the organization the
+// receiving GLN is registered to can call them. The container and everything in it are accepted or rejected together
+// ============================================================================================================================
+// On accept the contents move to the receiver's GLN and go back to the status they were shipped with, they are still
+// packed in the container, which takes the receive event. Contents whose shipment was cancelled by a recall only
+// follow the container to the receiver's GLN.
+func closeContainerShipment(stub shim.ChaincodeStubInterface, function string, args []string, accept bool) pb.Response {
+	fmt.Println(function + ": enter")
+	defer fmt.Println(function + ": exit")
+
+	sscc := args[0]
+	container, err := getContainer(stub, sscc)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if container == nil || !container.Shipment.isPending() {
+		errorString := function + ": container " + sscc + " has no pending shipment"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	submitter, err := getSubmitter(stub)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if submitter.MSPID != container.Shipment.ToMSPID {
+		errorString := function + ": only " + container.Shipment.ToMSPID + ", the organization of GLN " + container.Shipment.ToGln + ", can accept or reject this shipment, caller is " + submitter.MSPID
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		fmt.Println(function+": Error reading config:", err)
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println(function+": Error getting transaction time:", err)
+		return shim.Error(err.Error())
+	}
+	contents, err := getContainerContents(stub, container)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+
+	// everything moves to where the container was shipped, read before the container itself is closed
+	shipment := *container.Shipment
+	toLocation := container.ToLocation
+	members := append([]aggregationMember{{id: sscc, state: container.asProduct(), container: container}}, contents...)
+	for idx := range members {
+		member := &members[idx]
+		if err := closeMemberShipment(config.Lifecycle, member, idx == 0, &shipment, toLocation, args, accept, stub.GetTxID(), now); err != nil {
+			errorString := function + ": Error closing the shipment of " + displayKey(stub, member.id) + " - " + err.Error()
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		member.state.SubmitterMSPID = submitter.MSPID
+		member.state.SubmitterSubject = submitter.Subject
+		if err := putAggregationMember(stub, member); err != nil {
+			fmt.Println(function+": Error writing "+displayKey(stub, member.id)+":", err)
+			return shim.Error(err.Error())
+		}
+	}
+
+	event := RejectEvent
+	if accept {
+		event = ReceiveEvent
+	}
+	if err := emitContainerEvent(stub, containerEventNames[event], container, getMemberIDs(contents)); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(stub.GetTxID()))
+} // end of closeContainerShipment
+
+// closeMemberShipment - accepts or rejects the shipment of the container, outer is true, or of something in it.
+// Accepted members move to the GLN and toLocation of the container's shipment
+func closeMemberShipment(lifecycle []LifecycleTransition, member *aggregationMember, outer bool, containerShipment *Shipment, toLocation string, args []string, accept bool, txID string, now time.Time) error {
+	existing := member.state
+	if !existing.Shipment.isPending() {
+		if accept {
+			member.state.Gln = containerShipment.ToGln
+			member.state.Location = toLocation
+		}
+		return nil
+	}
+
+	shipment := *existing.Shipment
+	shipment.ClosedTxID = txID
+	if accept {
+		member.state.Event = ReceiveEvent
+		if err := applyLifecycle(lifecycle, &existing, &member.state); err != nil {
+			return err
+		}
+		if !outer {
+			member.state.Status = shipment.PriorStatus
+		}
+		member.state.Gln = shipment.ToGln
+		member.state.Location = toLocation
+		shipment.State = ShipmentAccepted
+	} else {
+		member.state.Event = RejectEvent
+		member.state.Status = shipment.PriorStatus
+		member.state.ToGln = shipment.FromGln
+		member.state.ToLocation = existing.Location
+		shipment.State = ShipmentRejected
+		if len(args) > 1 {
+			shipment.Reason = args[1]
+		}
+	}
+	member.state.EventDate = now.Format(EventDateFormat)
+	member.state.Shipment = &shipment
+	return nil
+}
+
+// getMemberIDs - the product keys and SSCCs of members
+func getMemberIDs(members []aggregationMember) []string {
+	ids := []string{}
+	for _, member := range members {
+		ids = append(ids, member.id)
+	}
+	return ids
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// test SSCCs with valid check digits
+const (
+	testSsccCase1  = "106141410000000019"
+	testSsccCase2  = "106141410000000026"
+	testSsccPallet = "106141410000000033"
+)
+
+// newAggregationStub - the custody stub with 3 more products, two for each case
+func newAggregationStub(t *testing.T) (*shimtest.MockStub, []string) {
+	stub, key := newCustodyStub(t)
+	keys := []string{key}
+	for _, serial := range []string{"1936801", "1936802", "1936803"} {
+		productJSON := strings.Replace(mockDevJson, `"expirationDate":"10/10/2026"`, `"expirationDate":"2099-12-31"`, 1)
+		productJSON = strings.Replace(productJSON, `"serialNo":1936800`, `"serialNo":"`+serial+`"`, 1)
+		results := stub.MockInvoke("create"+serial, [][]byte{[]byte("createProduct"), []byte(productJSON)})
+		assert.Equal(t, 200, int(results.Status), "createProduct "+serial)
+		keys = append(keys, testProductKey("08806555018611", serial, "m036191", "2099-12-31"))
+	}
+	return stub, keys
+}
+
+// readTestContainer - reads a container through readContainer
+func readTestContainer(t *testing.T, stub *shimtest.MockStub, sscc string) Container {
+	var container Container
+	results := stub.MockInvoke("readContainerTx", [][]byte{[]byte("readContainer"), []byte(sscc)})
+	assert.Equal(t, 200, int(results.Status), "readContainer "+sscc)
+	json.Unmarshal(results.Payload, &container)
+	return container
+}
+
+// childrenJSON - the JSON array argument of aggregate and disaggregate
+func childrenJSON(children ...string) []byte {
+	childrenAsBytes, _ := json.Marshal(children)
+	return childrenAsBytes
+}
+
+func TestAggregateAndShipPallet(t *testing.T) {
+	fmt.Println("TestAggregateAndShipPallet: enter")
+	defer fmt.Println("TestAggregateAndShipPallet: exit")
+
+	stub, keys := newAggregationStub(t)
+
+	results := stub.MockInvoke("aggTx1", [][]byte{[]byte("aggregate"), []byte(testSsccCase1), childrenJSON(keys[0], keys[1])})
+	assert.Equal(t, 200, int(results.Status), "aggregate case 1")
+	results = stub.MockInvoke("aggTx2", [][]byte{[]byte("aggregate"), []byte(testSsccCase2), childrenJSON(keys[2], keys[3])})
+	assert.Equal(t, 200, int(results.Status), "aggregate case 2")
+	events := takeEvents(stub)
+	assert.Equal(t, ProductsAggregatedEvent, events[len(events)-1].EventName)
+
+	container := readTestContainer(t, stub, testSsccCase1)
+	assert.Equal(t, ContainerObjectType, container.DocType)
+	assert.Equal(t, StatusActive, container.Status)
+	assert.Equal(t, "0300060000037", container.Gln)
+	assert.Equal(t, []string{keys[0], keys[1]}, container.Children)
+	product, _ := getProduct(stub, keys[0])
+	assert.Equal(t, StatusPacked, product.Status)
+	assert.Equal(t, PackEvent, product.Event)
+	assert.Equal(t, testSsccCase1, product.Parent)
+
+	results = stub.MockInvoke("aggTx3", [][]byte{[]byte("aggregate"), []byte(testSsccCase2), childrenJSON(keys[0])})
+	assert.Equal(t, 500, int(results.Status), "a product in two containers")
+	assert.Contains(t, results.Message, "already packed in container "+testSsccCase1)
+	results = stub.MockInvoke("aggTx4", [][]byte{[]byte("aggregate"), []byte("12345"), childrenJSON(keys[0])})
+	assert.Equal(t, 500, int(results.Status), "not an SSCC")
+	results = stub.MockInvoke("aggTx5", [][]byte{[]byte("aggregate"), []byte(testSsccPallet), childrenJSON(testSsccCase1, testSsccCase1)})
+	assert.Equal(t, 500, int(results.Status), "child listed twice")
+
+	// packed products don't move on their own
+	results = stub.MockInvoke("updateTx1", [][]byte{[]byte("updateProduct"), []byte(keys[0]), []byte("2"), []byte(`{"event":"unpack"}`)})
+	assert.Equal(t, 500, int(results.Status), "unpack a packed product with updateProduct")
+	assert.Contains(t, results.Message, "packed in container")
+	results = stub.MockInvoke("updateTx2", [][]byte{[]byte("updateProduct"), []byte(keys[0]), []byte("2"), []byte(`{"parent":""}`)})
+	assert.Equal(t, 500, int(results.Status), "parent is managed")
+	results = stub.MockInvoke("updateTx3", [][]byte{[]byte("updateProduct"), []byte(keys[0]), []byte("2"), []byte(`{"tradeItemDesc":"relabelled"}`)})
+	assert.Equal(t, 200, int(results.Status), "other fields can change")
+	results = stub.MockInvoke("shipTx1", [][]byte{[]byte("shipProduct"), []byte(keys[0]), []byte(testGlnDistributor)})
+	assert.Equal(t, 500, int(results.Status), "ship a packed product")
+
+	results = stub.MockInvoke("aggTx6", [][]byte{[]byte("aggregate"), []byte(testSsccPallet), childrenJSON(testSsccCase1, testSsccCase2)})
+	assert.Equal(t, 200, int(results.Status), "aggregate the cases on a pallet")
+	container = readTestContainer(t, stub, testSsccCase1)
+	assert.Equal(t, StatusPacked, container.Status)
+	assert.Equal(t, testSsccPallet, container.Parent)
+	results = stub.MockInvoke("shipTx2", [][]byte{[]byte("shipProduct"), []byte(testSsccCase1), []byte(testGlnDistributor)})
+	assert.Equal(t, 500, int(results.Status), "ship a case on a pallet")
+	results = stub.MockInvoke("aggTx7", [][]byte{[]byte("aggregate"), []byte(testSsccCase1), childrenJSON(testSsccPallet)})
+	assert.Equal(t, 500, int(results.Status), "pallet into a case on it")
+
+	takeEvents(stub)
+	results = stub.MockInvoke("shipTx3", [][]byte{[]byte("shipProduct"), []byte(testSsccPallet), []byte(testGlnDistributor), []byte("Raleigh, NC")})
+	assert.Equal(t, 200, int(results.Status), "ship the pallet")
+	events = takeEvents(stub)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "ContainerShipped", events[0].EventName)
+	var payload ContainerEvent
+	json.Unmarshal(events[0].Payload, &payload)
+	assert.Equal(t, []string{testSsccCase1, testSsccCase2, keys[0], keys[1], keys[2], keys[3]}, payload.Keys)
+	container = readTestContainer(t, stub, testSsccPallet)
+	assert.Equal(t, StatusInTransit, container.Status)
+	assert.Equal(t, ShipmentPending, container.Shipment.State)
+	for _, key := range keys {
+		product, _ = getProduct(stub, key)
+		assert.Equal(t, StatusInTransit, product.Status, key)
+		assert.Equal(t, ShipEvent, product.Event, key)
+		assert.Equal(t, testGlnDistributor, product.ToGln, key)
+		assert.Equal(t, StatusPacked, product.Shipment.PriorStatus, key)
+	}
+
+	setCreator(t, stub, "DistributorMSP", "user1")
+	results = stub.MockInvoke("acceptTx1", [][]byte{[]byte("acceptShipment"), []byte(keys[0])})
+	assert.Equal(t, 500, int(results.Status), "accept a product on the pallet")
+	assert.Contains(t, results.Message, "accept or reject the container")
+	results = stub.MockInvoke("acceptTx2", [][]byte{[]byte("acceptShipment"), []byte(testSsccPallet)})
+	assert.Equal(t, 200, int(results.Status), "accept the pallet")
+	container = readTestContainer(t, stub, testSsccPallet)
+	assert.Equal(t, StatusActive, container.Status)
+	assert.Equal(t, testGlnDistributor, container.Gln)
+	assert.Equal(t, "Raleigh, NC", container.Location)
+	container = readTestContainer(t, stub, testSsccCase2)
+	assert.Equal(t, StatusPacked, container.Status)
+	assert.Equal(t, ReceiveEvent, container.Event)
+	assert.Equal(t, testGlnDistributor, container.Gln)
+	for _, key := range keys {
+		product, _ = getProduct(stub, key)
+		assert.Equal(t, StatusPacked, product.Status, "still packed in the case")
+		assert.Equal(t, ReceiveEvent, product.Event, key)
+		assert.Equal(t, testGlnDistributor, product.Gln, key)
+		assert.Equal(t, "Raleigh, NC", product.Location, key)
+		assert.Equal(t, "", product.Receiver, "the pallet was shipped without a receiver")
+		assert.Equal(t, ShipmentAccepted, product.Shipment.State, key)
+	}
+
+	// the distributor breaks the pallet down and takes a unit out of a case
+	results = stub.MockInvoke("disaggTx1", [][]byte{[]byte("disaggregate"), []byte(testSsccCase1), childrenJSON(keys[0])})
+	assert.Equal(t, 500, int(results.Status), "disaggregate a case on the pallet")
+	results = stub.MockInvoke("disaggTx2", [][]byte{[]byte("disaggregate"), []byte(testSsccPallet)})
+	assert.Equal(t, 200, int(results.Status), "disaggregate the pallet")
+	container = readTestContainer(t, stub, testSsccCase1)
+	assert.Equal(t, StatusActive, container.Status)
+	assert.Equal(t, "", container.Parent)
+	assert.Equal(t, []string{}, readTestContainer(t, stub, testSsccPallet).Children)
+	results = stub.MockInvoke("disaggTx3", [][]byte{[]byte("disaggregate"), []byte(testSsccCase1), childrenJSON(keys[2])})
+	assert.Equal(t, 500, int(results.Status), "not in the case")
+	results = stub.MockInvoke("disaggTx4", [][]byte{[]byte("disaggregate"), []byte(testSsccCase1), childrenJSON(keys[0])})
+	assert.Equal(t, 200, int(results.Status), "disaggregate a unit")
+	assert.Equal(t, []string{keys[1]}, readTestContainer(t, stub, testSsccCase1).Children)
+	product, _ = getProduct(stub, keys[0])
+	assert.Equal(t, StatusActive, product.Status)
+	assert.Equal(t, "", product.Parent)
+
+	results = stub.MockInvoke("shipTx4", [][]byte{[]byte("shipProduct"), []byte(keys[0]), []byte(testGlnPharmacy)})
+	assert.Equal(t, 200, int(results.Status), "ship the unpacked unit")
+} // end of TestAggregateAndShipPallet
+
+func TestRejectContainerShipment(t *testing.T) {
+	fmt.Println("TestRejectContainerShipment: enter")
+	defer fmt.Println("TestRejectContainerShipment: exit")
+
+	stub, keys := newAggregationStub(t)
+	results := stub.MockInvoke("aggTx1", [][]byte{[]byte("aggregate"), []byte(testSsccCase1), childrenJSON(keys[0], keys[1])})
+	assert.Equal(t, 200, int(results.Status), "aggregate")
+
+	setCreator(t, stub, "DistributorMSP", "user1")
+	results = stub.MockInvoke("aggTx2", [][]byte{[]byte("aggregate"), []byte(testSsccCase2), childrenJSON(keys[2])})
+	assert.Equal(t, 500, int(results.Status), "aggregate another organization's products")
+	results = stub.MockInvoke("disaggTx1", [][]byte{[]byte("disaggregate"), []byte(testSsccCase1)})
+	assert.Equal(t, 500, int(results.Status), "disaggregate another organization's case")
+
+	setCreator(t, stub, "ManufacturerMSP", "user1")
+	results = stub.MockInvoke("shipTx1", [][]byte{[]byte("shipProduct"), []byte(testSsccCase1), []byte(testGlnDistributor)})
+	assert.Equal(t, 200, int(results.Status), "ship the case")
+	results = stub.MockInvoke("aggTx3", [][]byte{[]byte("aggregate"), []byte(testSsccCase1), childrenJSON(keys[2])})
+	assert.Equal(t, 500, int(results.Status), "aggregate into a case in transit")
+
+	setCreator(t, stub, "DistributorMSP", "user1")
+	takeEvents(stub)
+	results = stub.MockInvoke("rejectTx1", [][]byte{[]byte("rejectShipment"), []byte(testSsccCase1), []byte("damaged")})
+	assert.Equal(t, 200, int(results.Status), "reject the case")
+	events := takeEvents(stub)
+	assert.Equal(t, "ContainerShipmentRejected", events[0].EventName)
+	container := readTestContainer(t, stub, testSsccCase1)
+	assert.Equal(t, StatusActive, container.Status)
+	assert.Equal(t, RejectEvent, container.Event)
+	assert.Equal(t, "0300060000037", container.Gln)
+	assert.Equal(t, "damaged", container.Shipment.Reason)
+	for _, key := range keys[:2] {
+		product, _ := getProduct(stub, key)
+		assert.Equal(t, StatusPacked, product.Status, key)
+		assert.Equal(t, RejectEvent, product.Event, key)
+		assert.Equal(t, testSsccCase1, product.Parent, key)
+		assert.Equal(t, ShipmentRejected, product.Shipment.State, key)
+	}
+} // end of TestRejectContainerShipment
+
+func TestAggregateContainerLimit(t *testing.T) {
+	fmt.Println("TestAggregateContainerLimit: enter")
+	defer fmt.Println("TestAggregateContainerLimit: exit")
+
+	stub, keys := newAggregationStub(t)
+	results := stub.MockInvoke("aggTx1", [][]byte{[]byte("aggregate"), []byte(testSsccCase1), childrenJSON(keys[0])})
+	assert.Equal(t, 200, int(results.Status), "aggregate")
+
+	// fill the case up to one below the limit, the contents are read but not checked for duplicates
+	container := readTestContainer(t, stub, testSsccCase1)
+	for len(container.Children) < MaxContainerItems-1 {
+		container.Children = append(container.Children, keys[0])
+	}
+	containerKey, _ := getContainerKey(stub, testSsccCase1)
+	containerAsBytes, _ := json.Marshal(container)
+	stub.MockTransactionStart("fillTx")
+	stub.PutState(containerKey, containerAsBytes)
+	stub.MockTransactionEnd("fillTx")
+
+	results = stub.MockInvoke("aggTx2", [][]byte{[]byte("aggregate"), []byte(testSsccCase1), childrenJSON(keys[1], keys[2])})
+	assert.Equal(t, 500, int(results.Status), "aggregate past the limit")
+	assert.Contains(t, results.Message, "would hold 1001 products and containers")
+	results = stub.MockInvoke("aggTx3", [][]byte{[]byte("aggregate"), []byte(testSsccCase1), childrenJSON(keys[1])})
+	assert.Equal(t, 200, int(results.Status), "aggregate up to the limit")
+
+	// a nested container counts with its contents
+	results = stub.MockInvoke("aggTx4", [][]byte{[]byte("aggregate"), []byte(testSsccPallet), childrenJSON(testSsccCase1)})
+	assert.Equal(t, 500, int(results.Status), "aggregate a full case into a pallet")
+} // end of TestAggregateContainerLimit
+
+func TestDisaggregateRecalledUnits(t *testing.T) {
+	fmt.Println("TestDisaggregateRecalledUnits: enter")
+	defer fmt.Println("TestDisaggregateRecalledUnits: exit")
+
+	stub, keys := newAggregationStub(t)
+	results := stub.MockInvoke("aggTx1", [][]byte{[]byte("aggregate"), []byte(testSsccCase1), childrenJSON(keys[0], keys[1])})
+	assert.Equal(t, 200, int(results.Status), "aggregate")
+	results = stub.MockInvoke("recallTx", [][]byte{[]byte("recallLot"), []byte("08806555018611"), []byte("M036191"), []byte("contamination"), []byte("I")})
+	assert.Equal(t, 200, int(results.Status), "recallLot")
+
+	// the recalled units leave the case without an unpack event
+	results = stub.MockInvoke("disaggTx1", [][]byte{[]byte("disaggregate"), []byte(testSsccCase1)})
+	assert.Equal(t, 200, int(results.Status), "disaggregate recalled units")
+	for _, key := range keys[:2] {
+		product, _ := getProduct(stub, key)
+		assert.Equal(t, StatusRecalled, product.Status, key)
+		assert.Equal(t, RecallEvent, product.Event, key)
+		assert.Equal(t, "", product.Parent, key)
+	}
+	assert.Equal(t, []string{}, readTestContainer(t, stub, testSsccCase1).Children)
+
+	results = stub.MockInvoke("updateTx1", [][]byte{[]byte("updateProduct"), []byte(keys[0]), []byte("4"), []byte(`{"event":"decommission"}`)})
+	assert.Equal(t, 200, int(results.Status), "decommission an unpacked recalled unit")
+} // end of TestDisaggregateRecalledUnits
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ConfigKey - ledger key holding the chaincode configuration
+const ConfigKey = "dataUploadcc-config"
+
+// ConfigObjectType - defines the config object type
+const ConfigObjectType = "config-data"
+
+// GS1ModeStrict - identifiers with a bad check digit are rejected
+const GS1ModeStrict = "strict"
+
+// GS1ModeLenient - identifiers with a bad check digit are stored and flagged on the product
+const GS1ModeLenient = "lenient"
+
+// ChaincodeConfig - settings stored on the ledger, passed as JSON to Init on instantiate or upgrade
+type ChaincodeConfig struct {
+	DocType string `json:"docType"`
+	GS1Mode string `json:"gs1Mode"`
+	// Lifecycle replaces the whole default lifecycle when set
+	Lifecycle []LifecycleTransition `json:"lifecycle"`
+	// AdminMSPIDs can change the access policies and register GLNs to organizations
+	AdminMSPIDs []string `json:"adminMspIds"`
+}
+
+// defaults used until Init stores a config, lenient so legacy uploads keep working
+func defaultConfig() ChaincodeConfig {
+	return ChaincodeConfig{DocType: ConfigObjectType, GS1Mode: GS1ModeLenient, Lifecycle: defaultLifecycle()}
+}
+
+// ============================================================================================================================
+// Get Config - reads the chaincode config from the ledger, the defaults are returned if none is stored
+// ============================================================================================================================
+func getConfig(stub shim.ChaincodeStubInterface) (ChaincodeConfig, error) {
+	config := defaultConfig()
+
+	configAsBytes, err := stub.GetState(ConfigKey)
+	if err != nil {
+		return config, errors.New("getConfig: Failed to read config - " + err.Error())
+	}
+	if len(configAsBytes) == 0 {
+		return config, nil
+	}
+	if err := json.Unmarshal(configAsBytes, &config); err != nil {
+		return config, errors.New("getConfig: Error with stored config JSON format - " + err.Error())
+	}
+	return config, nil
+} // end of getConfig
+
+// ============================================================================================================================
+// Put Config - merges the JSON changes into the stored config, validates and writes it back
+// ============================================================================================================================
+func putConfig(stub shim.ChaincodeStubInterface, changes []byte) (ChaincodeConfig, error) {
+	fmt.Println("putConfig: enter")
+	defer fmt.Println("putConfig: exit")
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(changes, &config); err != nil {
+		return config, errors.New("putConfig: config must be a JSON object - " + err.Error())
+	}
+	config.DocType = ConfigObjectType
+
+	if config.GS1Mode != GS1ModeStrict && config.GS1Mode != GS1ModeLenient {
+		return config, errors.New("putConfig: gs1Mode must be " + GS1ModeStrict + " or " + GS1ModeLenient + ", got " + config.GS1Mode)
+	}
+	if err := validateLifecycle(config.Lifecycle); err != nil {
+		return config, errors.New("putConfig: " + err.Error())
+	}
+
+	configAsBytes, err := json.Marshal(config)
+	if err != nil {
+		return config, err
+	}
+	fmt.Println("putConfig: call putState, key = ", ConfigKey)
+	if err := stub.PutState(ConfigKey, configAsBytes); err != nil {
+		return config, err
+	}
+	return config, nil
+} // end of putConfig
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// ReceiveEvent - the event recorded when a shipment is accepted
+const ReceiveEvent = "receive"
+
+// RejectEvent - the event recorded when a shipment is rejected
+const RejectEvent = "reject"
+
+// shipment states
+const (
+	ShipmentPending  = "pending"
+	ShipmentAccepted = "accepted"
+	ShipmentRejected = "rejected"
+)
+
+// Shipment - the last custody transfer of a product, managed by the chaincode
+type Shipment struct {
+	State       string `json:"state"`
+	FromGln     string `json:"fromGln"`
+	ToGln       string `json:"toGln"`
+	ToMSPID     string `json:"toMspId"`
+	PriorStatus string `json:"priorStatus"`
+	ShipTxID    string `json:"shipTxId"`
+	ClosedTxID  string `json:"closedTxId,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// isPending - true while the shipment waits to be accepted or rejected
+func (shipment *Shipment) isPending() bool {
+	return shipment != nil && shipment.State == ShipmentPending
+}
+
+// checkCustody - custody events can only be written by shipProduct, acceptShipment and rejectShipment, pack and
+// unpack by aggregate and disaggregate, and the event can't change while the product is packed in a container. While a shipment is pending only
+// the fields that aren't part of custody can change. existing is nil when the product is being created
+func checkCustody(existing *Product, product *Product) error {
+	if existing != nil && len(existing.Parent) > 0 && (product.Event != existing.Event || product.Gln != existing.Gln) {
+		return errors.New("checkCustody: product is packed in container " + existing.Parent + ", it moves with the container until it is disaggregated")
+	}
+	if existing != nil && existing.Shipment.isPending() && custodyChanged(existing, product) {
+		return errors.New("checkCustody: product has a pending shipment to " + existing.Shipment.ToGln + ", it has to be accepted or rejected before its event, GLNs, locations, sender or receiver change")
+	}
+	if existing != nil && product.Event == existing.Event {
+		return nil
+	}
+	switch product.Event {
+	case ShipEvent, ReceiveEvent, RejectEvent:
+		return errors.New("checkCustody: event " + product.Event + " can only be recorded with shipProduct, acceptShipment or rejectShipment")
+	case PackEvent, UnpackEvent:
+		return errors.New("checkCustody: event " + product.Event + " can only be recorded with aggregate or disaggregate, they set the container")
+	}
+	return nil
+}
+
+// custodyChanged - true when product has a different event, GLN, location or party than existing,
+// the fields the custody functions write
+func custodyChanged(existing *Product, product *Product) bool {
+	return product.Event != existing.Event || product.Gln != existing.Gln || product.Location != existing.Location ||
+		product.ToGln != existing.ToGln || product.ToLocation != existing.ToLocation ||
+		product.Sender != existing.Sender || product.Receiver != existing.Receiver
+}
+
+// ============================================================================================================================
+// Ship Product - puts a product in transit to another GLN, passes the key, the receiver's GLN and optionally the
+// receiver's location and name
+// ============================================================================================================================
+// The receiving GLN has to be registered with registerGln, only that organization can accept or reject the
+// shipment. The product stays with the sender's GLN until the shipment is accepted. Pass an SSCC instead of
+// the key to ship a container with everything in it.
+func (t *DataChainCode) shipProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("shipProduct: enter")
+	defer fmt.Println("shipProduct: exit")
+
+	if len(args) < 2 || len(args) > 4 {
+		errorString := "shipProduct: Incorrect number of arguments. Expecting 2 to 4, key, toGln, toLocation and receiver"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	if isSscc(args[0]) {
+		return shipContainer(stub, args)
+	}
+	key := args[0]
+	existing, err := getProduct(stub, key)
+	if err != nil {
+		fmt.Println("shipProduct: Error getting product:", err)
+		return shim.Error(err.Error())
+	}
+	if len(existing.Parent) > 0 {
+		errorString := "shipProduct: product is packed in container " + existing.Parent + ", ship the container or disaggregate it first"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	if existing.Shipment.isPending() {
+		errorString := "shipProduct: product already has a pending shipment to " + existing.Shipment.ToGln
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	toGln := args[1]
+	toMSPID, err := getGlnOwner(stub, toGln)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if len(toMSPID) == 0 {
+		errorString := "shipProduct: GLN " + toGln + " is not registered to an organization"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println("shipProduct: Error getting transaction time:", err)
+		return shim.Error(err.Error())
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		fmt.Println("shipProduct: Error reading config:", err)
+		return shim.Error(err.Error())
+	}
+
+	product := existing
+	product.Event = ShipEvent
+	if err := checkExpiryPolicy(product, now); err != nil {
+		fmt.Println("shipProduct: Error checking expiry:", err)
+		return shim.Error(err.Error())
+	}
+	if err := applyLifecycle(config.Lifecycle, &existing, &product); err != nil {
+		fmt.Println("shipProduct: Error checking lifecycle:", err)
+		return shim.Error(err.Error())
+	}
+	if err := authorizeProductWrite(stub, &existing, &product); err != nil {
+		fmt.Println("shipProduct: Error authorizing caller:", err)
+		return shim.Error(err.Error())
+	}
+	// cleared when not passed so accepting doesn't move the product to the location of an earlier shipment
+	product.ToGln = toGln
+	product.ToLocation = ""
+	product.Receiver = ""
+	if len(args) > 2 {
+		product.ToLocation = args[2]
+	}
+	if len(args) > 3 {
+		product.Receiver = args[3]
+	}
+	product.EventDate = now.Format(EventDateFormat)
+	product.Shipment = &Shipment{
+		State:       ShipmentPending,
+		FromGln:     existing.Gln,
+		ToGln:       toGln,
+		ToMSPID:     toMSPID,
+		PriorStatus: existing.Status,
+		ShipTxID:    stub.GetTxID(),
+	}
+
+	if err := putProduct(stub, key, &existing, &product); err != nil {
+		fmt.Println("shipProduct: Error writing product:", err)
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(stub.GetTxID()))
+} // end of shipProduct
+
+// ============================================================================================================================
+// Accept Shipment - completes a pending shipment, passes the key, only the organization the receiving GLN is
+// registered to can call it. The product moves to the receiver's GLN and location, pass an SSCC to accept a container
+// ============================================================================================================================
+func (t *DataChainCode) acceptShipment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("acceptShipment: enter")
+	defer fmt.Println("acceptShipment: exit")
+
+	if len(args) != 1 {
+		errorString := "acceptShipment: Incorrect number of arguments. Expecting 1, the key"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	if isSscc(args[0]) {
+		return closeContainerShipment(stub, "acceptShipment", args, true)
+	}
+	key := args[0]
+	existing, submitter, now, err := getPendingShipment(stub, "acceptShipment", key)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		fmt.Println("acceptShipment: Error reading config:", err)
+		return shim.Error(err.Error())
+	}
+
+	product := existing
+	product.Event = ReceiveEvent
+	if err := applyLifecycle(config.Lifecycle, &existing, &product); err != nil {
+		fmt.Println("acceptShipment: Error checking lifecycle:", err)
+		return shim.Error(err.Error())
+	}
+	product.Gln = existing.Shipment.ToGln
+	product.Location = existing.ToLocation
+	product.EventDate = now.Format(EventDateFormat)
+	shipment := *existing.Shipment
+	shipment.State = ShipmentAccepted
+	shipment.ClosedTxID = stub.GetTxID()
+	product.Shipment = &shipment
+	product.SubmitterMSPID = submitter.MSPID
+	product.SubmitterSubject = submitter.Subject
+
+	if err := putProduct(stub, key, &existing, &product); err != nil {
+		fmt.Println("acceptShipment: Error writing product:", err)
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(stub.GetTxID()))
+} // end of acceptShipment
+
+// ============================================================================================================================
+// Reject Shipment - reverses a pending shipment, passes the key and an optional reason, only the organization the
+// receiving GLN is registered to can call it. The product goes back to the status it had before it was shipped,
+// this undoes the ship transition so it is not a lifecycle event. Pass an SSCC to reject a container
+// ============================================================================================================================
+func (t *DataChainCode) rejectShipment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("rejectShipment: enter")
+	defer fmt.Println("rejectShipment: exit")
+
+	if len(args) < 1 || len(args) > 2 {
+		errorString := "rejectShipment: Incorrect number of arguments. Expecting 1 or 2, the key and an optional reason"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	if isSscc(args[0]) {
+		return closeContainerShipment(stub, "rejectShipment", args, false)
+	}
+	key := args[0]
+	existing, submitter, now, err := getPendingShipment(stub, "rejectShipment", key)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+
+	product := existing
+	product.Event = RejectEvent
+	product.Status = existing.Shipment.PriorStatus
+	product.ToGln = existing.Shipment.FromGln
+	product.ToLocation = existing.Location
+	product.EventDate = now.Format(EventDateFormat)
+	shipment := *existing.Shipment
+	shipment.State = ShipmentRejected
+	shipment.ClosedTxID = stub.GetTxID()
+	if len(args) > 1 {
+		shipment.Reason = args[1]
+	}
+	product.Shipment = &shipment
+	product.SubmitterMSPID = submitter.MSPID
+	product.SubmitterSubject = submitter.Subject
+
+	if err := putProduct(stub, key, &existing, &product); err != nil {
+		fmt.Println("rejectShipment: Error writing product:", err)
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(stub.GetTxID()))
+} // end of rejectShipment
+
+// getPendingShipment - reads the product and checks it has a pending shipment to the caller's organization
+func getPendingShipment(stub shim.ChaincodeStubInterface, function string, key string) (Product, Submitter, time.Time, error) {
+	product, err := getProduct(stub, key)
+	if err != nil {
+		return product, Submitter{}, time.Time{}, err
+	}
+	if !product.Shipment.isPending() {
+		return product, Submitter{}, time.Time{}, errors.New(function + ": product " + displayKey(stub, key) + " has no pending shipment")
+	}
+	if len(product.Parent) > 0 {
+		return product, Submitter{}, time.Time{}, errors.New(function + ": product " + displayKey(stub, key) + " is packed in container " + product.Parent + ", accept or reject the container")
+	}
+	submitter, err := getSubmitter(stub)
+	if err != nil {
+		return product, submitter, time.Time{}, err
+	}
+	if submitter.MSPID != product.Shipment.ToMSPID {
+		return product, submitter, time.Time{}, errors.New(function + ": only " + product.Shipment.ToMSPID + ", the organization of GLN " + product.Shipment.ToGln + ", can accept or reject this shipment, caller is " + submitter.MSPID)
+	}
+	now, err := getTxTime(stub)
+	return product, submitter, now, err
+}
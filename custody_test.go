@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// newCustodyStub - a stub with the distributor and pharmacy GLNs registered and one shippable product,
+// mockDevJson has expired so the product expires in 2099
+func newCustodyStub(t *testing.T) (*shimtest.MockStub, string) {
+	stub := newTestStub(t)
+	registerTestGln(t, stub, testGlnDistributor, "DistributorMSP")
+	registerTestGln(t, stub, testGlnPharmacy, "PharmacyMSP")
+
+	setCreator(t, stub, "ManufacturerMSP", "user1")
+	productJSON := strings.Replace(mockDevJson, `"expirationDate":"10/10/2026"`, `"expirationDate":"2099-12-31"`, 1)
+	results := stub.MockInvoke("createTx", [][]byte{[]byte("createProduct"), []byte(productJSON)})
+	assert.Equal(t, 200, int(results.Status), "createProduct")
+	return stub, testProductKey("08806555018611", "1936800", "m036191", "2099-12-31")
+}
+
+func TestShipAndAcceptShipment(t *testing.T) {
+	fmt.Println("TestShipAndAcceptShipment: enter")
+	defer fmt.Println("TestShipAndAcceptShipment: exit")
+
+	stub, key := newCustodyStub(t)
+
+	results := stub.MockInvoke("shipTx1", [][]byte{[]byte("shipProduct"), []byte(key), []byte(testGlnManufacturer)})
+	assert.Equal(t, 500, int(results.Status), "ship to unregistered GLN")
+	assert.Contains(t, results.Message, "is not registered")
+
+	results = stub.MockInvoke("shipTx2", [][]byte{[]byte("shipProduct"), []byte(key), []byte(testGlnDistributor), []byte("Raleigh, NC"), []byte("distributor")})
+	assert.Equal(t, 200, int(results.Status), "shipProduct")
+	product, _ := getProduct(stub, key)
+	assert.Equal(t, StatusInTransit, product.Status)
+	assert.Equal(t, ShipEvent, product.Event)
+	assert.Equal(t, "0300060000037", product.Gln, "the sender holds the product until it is accepted")
+	assert.Equal(t, testGlnDistributor, product.ToGln)
+	assert.Equal(t, &Shipment{State: ShipmentPending, FromGln: "0300060000037", ToGln: testGlnDistributor, ToMSPID: "DistributorMSP", PriorStatus: StatusActive, ShipTxID: "shipTx2"}, product.Shipment)
+
+	// nothing else can happen while in transit
+	results = stub.MockInvoke("shipTx3", [][]byte{[]byte("shipProduct"), []byte(key), []byte(testGlnPharmacy)})
+	assert.Equal(t, 500, int(results.Status), "ship a pending shipment again")
+	results = stub.MockInvoke("updateTx1", [][]byte{[]byte("updateProduct"), []byte(key), []byte("2"), []byte(`{"event":"dispense"}`)})
+	assert.Equal(t, 500, int(results.Status), "update a pending shipment")
+	assert.Contains(t, results.Message, "pending shipment")
+	results = stub.MockInvoke("updateTx2", [][]byte{[]byte("updateProduct"), []byte(key), []byte("2"), []byte(`{"shipment":null}`)})
+	assert.Equal(t, 500, int(results.Status), "update the shipment")
+	for _, changes := range []string{`{"gln":"` + testGlnPharmacy + `"}`, `{"location":"Durham, NC"}`, `{"toLocation":"Durham, NC"}`, `{"receiver":"pharmacy"}`} {
+		results = stub.MockInvoke("updateTx3", [][]byte{[]byte("updateProduct"), []byte(key), []byte("2"), []byte(changes)})
+		assert.Equal(t, 500, int(results.Status), "update a pending shipment "+changes)
+		assert.Contains(t, results.Message, "pending shipment")
+	}
+	results = stub.MockInvoke("updateTx4", [][]byte{[]byte("updateProduct"), []byte(key), []byte("2"), []byte(`{"tradeItemDesc":"relabelled"}`)})
+	assert.Equal(t, 200, int(results.Status), "fields that aren't part of custody can change in transit")
+
+	// only the receiving organization can accept
+	results = stub.MockInvoke("acceptTx1", [][]byte{[]byte("acceptShipment"), []byte(key)})
+	assert.Equal(t, 500, int(results.Status), "sender accepts")
+	setCreator(t, stub, "PharmacyMSP", "user1")
+	results = stub.MockInvoke("acceptTx2", [][]byte{[]byte("acceptShipment"), []byte(key)})
+	assert.Equal(t, 500, int(results.Status), "other organization accepts")
+	assert.Contains(t, results.Message, "only DistributorMSP")
+
+	setCreator(t, stub, "DistributorMSP", "user1")
+	results = stub.MockInvoke("acceptTx3", [][]byte{[]byte("acceptShipment"), []byte(key)})
+	assert.Equal(t, 200, int(results.Status), "acceptShipment")
+	product, _ = getProduct(stub, key)
+	assert.Equal(t, StatusActive, product.Status)
+	assert.Equal(t, ReceiveEvent, product.Event)
+	assert.Equal(t, testGlnDistributor, product.Gln)
+	assert.Equal(t, "Raleigh, NC", product.Location)
+	assert.Equal(t, ShipmentAccepted, product.Shipment.State)
+	assert.Equal(t, "acceptTx3", product.Shipment.ClosedTxID)
+	assert.Equal(t, 4, product.Version)
+
+	results = stub.MockInvoke("acceptTx4", [][]byte{[]byte("acceptShipment"), []byte(key)})
+	assert.Equal(t, 500, int(results.Status), "accept twice")
+
+	// without a location and receiver the ones of the last shipment aren't kept
+	results = stub.MockInvoke("shipTx4", [][]byte{[]byte("shipProduct"), []byte(key), []byte(testGlnPharmacy)})
+	assert.Equal(t, 200, int(results.Status), "shipProduct without location and receiver")
+	product, _ = getProduct(stub, key)
+	assert.Equal(t, "", product.ToLocation)
+	assert.Equal(t, "", product.Receiver)
+	setCreator(t, stub, "PharmacyMSP", "user1")
+	results = stub.MockInvoke("acceptTx5", [][]byte{[]byte("acceptShipment"), []byte(key)})
+	assert.Equal(t, 200, int(results.Status), "acceptShipment at the pharmacy")
+	product, _ = getProduct(stub, key)
+	assert.Equal(t, testGlnPharmacy, product.Gln)
+	assert.Equal(t, "", product.Location)
+} // end of TestShipAndAcceptShipment
+
+func TestShipAndRejectShipment(t *testing.T) {
+	stub, key := newCustodyStub(t)
+
+	results := stub.MockInvoke("shipTx", [][]byte{[]byte("shipProduct"), []byte(key), []byte(testGlnPharmacy), []byte("Durham, NC")})
+	assert.Equal(t, 200, int(results.Status), "shipProduct")
+
+	setCreator(t, stub, "PharmacyMSP", "user1")
+	results = stub.MockInvoke("rejectTx", [][]byte{[]byte("rejectShipment"), []byte(key), []byte("damaged")})
+	assert.Equal(t, 200, int(results.Status), "rejectShipment")
+	product, _ := getProduct(stub, key)
+	assert.Equal(t, StatusActive, product.Status, "back to the status before shipping")
+	assert.Equal(t, RejectEvent, product.Event)
+	assert.Equal(t, "0300060000037", product.Gln)
+	assert.Equal(t, ShipmentRejected, product.Shipment.State)
+	assert.Equal(t, "damaged", product.Shipment.Reason)
+} // end of TestShipAndRejectShipment
+
+func TestCustodyEventsNeedCustodyFunctions(t *testing.T) {
+	stub, key := newCustodyStub(t)
+
+	for _, event := range []string{ShipEvent, ReceiveEvent, RejectEvent, PackEvent, UnpackEvent} {
+		results := stub.MockInvoke("updateTx", [][]byte{[]byte("updateProduct"), []byte(key), []byte("1"), []byte(`{"event":"` + event + `"}`)})
+		assert.Equal(t, 500, int(results.Status), "updateProduct "+event)
+		assert.Contains(t, results.Message, "can only be recorded with")
+	}
+
+	shipped := strings.Replace(strings.Replace(mockDevJson, `"event":"commission"`, `"event":"ship"`, 1), `"serialNo":1936800`, `"serialNo":"S2"`, 1)
+	shipped = strings.Replace(shipped, `"expirationDate":"10/10/2026"`, `"expirationDate":"2099-12-31"`, 1)
+	results := stub.MockInvoke("createTx2", [][]byte{[]byte("createProduct"), []byte(shipped)})
+	assert.Equal(t, 500, int(results.Status), "createProduct with ship event")
+	assert.Contains(t, results.Message, "can only be recorded with shipProduct")
+} // end of TestCustodyEventsNeedCustodyFunctions
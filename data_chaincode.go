@@ -1,13 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
+	"reflect"
 	"strconv"
 	"strings"
 	"fmt"
-	"time"
 		
 	"github.com/hyperledger/fabric-chaincode-go/shim"
 	pb "github.com/hyperledger/fabric-protos-go/peer"
@@ -29,7 +28,7 @@ type Product struct {
 	ID           float64                `json:"id"`
 	Gtin         string                 `json:"gtin"`
 	Lot          string                 `json:"lot"`
-	SerialNumber float64                `json:"serialNo"`
+	SerialNumber string                 `json:"serialNo"`
 	ExpiryDate   string                 `json:"expirationDate"`
 	Event        string                 `json:"event"`
 	Gln          string                 `json:"gln"`
@@ -45,9 +44,25 @@ type Product struct {
 	Receiver     string                 `json:"receiver"`
 	LocationInfo LocationData           `json:"loc_cd"`
 	EventDate    string                 `json:"event_dt"`
+	Version      int                    `json:"version"`
+	TxID         string                 `json:"txId"`
+	Flags        []string               `json:"flags,omitempty"`
+	Shipment     *Shipment              `json:"shipment,omitempty"`
+	Parent       string                 `json:"parent,omitempty"`
+	OriginGln    string                 `json:"originGln,omitempty"` // the GLN the product was created at
+	SubmitterMSPID   string             `json:"submitterMspId"`
+	SubmitterSubject string             `json:"submitterSubject"`
 	Data         map[string]interface{} `json:"-"` // Unknown fields should go here.
 }
 
+// ProductRecord - a product with its ledger metadata as returned by readProduct, Record is the product JSON
+type ProductRecord struct {
+	Key     string          `json:"key"`
+	TxID    string          `json:"txId"`
+	Version int             `json:"version"`
+	Record  json.RawMessage `json:"record"`
+}
+
 // ProductKey - this struct represents the product key
 type ProductKey struct {
 	Key          string
@@ -64,15 +79,25 @@ const ProductObjectType = "product-data"
 // MaxProductJSONSizeAllowed - defines the max JSON size allowed for an input
 const MaxProductJSONSizeAllowed = 2048
 
-// MaxProductItems - defines the max product items that can be returned
+// MaxProductItems - defines the max product items that can be returned in a page
 const MaxProductItems = 100
 
 // Init is called with the chaincode is instantiated or updated.
 // It can be used to initialize data for the chaincode for real products or test
-// For this we don't need to pre-populate anything
+// An optional JSON argument updates the stored ChaincodeConfig, e.g. {"gs1Mode":"strict"} or a
+// "lifecycle" list of {"event","from","to"} transitions replacing the default product lifecycle and
+// the "adminMspIds" that can change the access policies and register GLNs
 func (t *DataChainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("Init: enter")
 	defer fmt.Println("Init: exit")
+
+	_, args := stub.GetFunctionAndParameters()
+	if len(args) > 0 && len(args[0]) > 0 {
+		if _, err := putConfig(stub, []byte(args[0])); err != nil {
+			fmt.Println("Init: Error storing config:", err)
+			return shim.Error(err.Error())
+		}
+	}
 	return shim.Success(nil)
 } // end of init
 
@@ -87,12 +112,83 @@ func (t *DataChainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("Invoke: Transaction ID: ", txID)
 	fmt.Println("Invoke: function: ", function)
 	fmt.Println("Invoke: args count: ", len(args))
-	fmt.Println("Invoke: args found: ", args)
+	displayArgs := make([]string, len(args))
+	for idx, arg := range args {
+		displayArgs[idx] = displayKey(stub, arg)
+	}
+	fmt.Println("Invoke: args found: ", displayArgs)
+
+	if err := checkAccess(stub, function); err != nil {
+		fmt.Println("Invoke: Access denied:", err)
+		return shim.Error(err.Error())
+	}
 
 	if function == "createProduct" {
 		return t.createProduct(stub, args)
+	} else if function == "upsertProduct" {
+		return t.upsertProduct(stub, args)
+	} else if function == "updateProduct" {
+		return t.updateProduct(stub, args)
+	} else if function == "readProduct" {
+		return t.readProduct(stub, args)
+	} else if function == "migrateProductKeys" {
+		return t.migrateProductKeys(stub, args)
+	} else if function == "indexProductLots" {
+		return t.indexProductLots(stub, args)
+	} else if function == "queryProductsByPartialKey" {
+		return t.queryProductsByPartialKey(stub, args)
 	} else if function == "queryProductsByEvent" {
 		return t.queryProductsByEvent(stub, args)
+	} else if function == "queryProductsByGtin" {
+		return t.queryProductsByGtin(stub, args)
+	} else if function == "queryProductsByLot" {
+		return t.queryProductsByLot(stub, args)
+	} else if function == "queryProductsByGln" {
+		return t.queryProductsByGln(stub, args)
+	} else if function == "queryProductsByStatus" {
+		return t.queryProductsByStatus(stub, args)
+	} else if function == "queryProductsByEventDate" {
+		return t.queryProductsByEventDate(stub, args)
+	} else if function == "queryProductsByExpirationDate" {
+		return t.queryProductsByExpirationDate(stub, args)
+	} else if function == "queryProductsExpiringWithin" {
+		return t.queryProductsExpiringWithin(stub, args)
+	} else if function == "queryProductsInBoundingBox" {
+		return t.queryProductsInBoundingBox(stub, args)
+	} else if function == "queryProductsWithinRadius" {
+		return t.queryProductsWithinRadius(stub, args)
+	} else if function == "registerGln" {
+		return t.registerGln(stub, args)
+	} else if function == "shipProduct" {
+		return t.shipProduct(stub, args)
+	} else if function == "acceptShipment" {
+		return t.acceptShipment(stub, args)
+	} else if function == "rejectShipment" {
+		return t.rejectShipment(stub, args)
+	} else if function == "aggregate" {
+		return t.aggregate(stub, args)
+	} else if function == "disaggregate" {
+		return t.disaggregate(stub, args)
+	} else if function == "readContainer" {
+		return t.readContainer(stub, args)
+	} else if function == "captureEPCIS" {
+		return t.captureEPCIS(stub, args)
+	} else if function == "traceProduct" {
+		return t.traceProduct(stub, args)
+	} else if function == "traceLot" {
+		return t.traceLot(stub, args)
+	} else if function == "recallLot" {
+		return t.recallLot(stub, args)
+	} else if function == "queryRecallHolders" {
+		return t.queryRecallHolders(stub, args)
+	} else if function == "setAccessPolicy" {
+		return t.setAccessPolicy(stub, args)
+	} else if function == "queryAccessPolicy" {
+		return t.queryAccessPolicy(stub, args)
+	} else if function == "queryProductChanges" {
+		return t.queryProductChanges(stub, args)
+	} else if function == "queryProductAsOf" {
+		return t.queryProductAsOf(stub, args)
 	} else if function == "queryProductHistory" {
 		return t.queryProductHistory(stub, args)
 	}
@@ -105,44 +201,376 @@ func (t *DataChainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 // ============================================================================================================================
 // Create Product - passes 2 arguments first is the key the second is JSON data mapping to the defined structure above
 // ============================================================================================================================
-// takes a single argument that is JSON of the product to create
+// takes a single argument that is JSON of the product to create, fails if the product already exists
+// or its lot was first commissioned at a GLN of another organization
 func (t *DataChainCode) createProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	fmt.Println("createProduct: enter")
-	defer fmt.Println("createProduct: exit")
+	return t.saveProduct(stub, "createProduct", args, false)
+} // end of createProduct
+
+// ============================================================================================================================
+// Upsert Product - same as create but overwrites the product when it already exists
+// ============================================================================================================================
+// takes a single argument that is JSON of the product to create or replace
+func (t *DataChainCode) upsertProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.saveProduct(stub, "upsertProduct", args, true)
+} // end of upsertProduct
+
+// writes the product JSON in args to the ledger, when upsert is false an existing product is never overwritten
+func (t *DataChainCode) saveProduct(stub shim.ChaincodeStubInterface, function string, args []string, upsert bool) pb.Response {
+	fmt.Println(function + ": enter")
+	defer fmt.Println(function + ": exit")
 
 	if len(args) != 1 {
-		errorString := "createProduct: Invalid number of args, must be exactly 1 argument containing JSON containing data"
+		errorString := function + ": Invalid number of args, must be exactly 1 argument containing JSON containing data"
 		fmt.Println(errorString)
 		return shim.Error(errorString)
 	}
 
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println(function+": Error getting transaction time:", err)
+		return shim.Error(err.Error())
+	}
+
 	var productInput = args[0]
-	product, err := getProductFromJSON([]byte(productInput))
+	product, err := validateProductInput([]byte(productInput), now)
 	if err != nil {
-		fmt.Println("createProduct: Error with JSON format:", err)
+		fmt.Println(function+": Error validating JSON:", err)
 		return shim.Error(err.Error())
 	}
 
-	key := getProductKey(product)
+	config, err := getConfig(stub)
+	if err != nil {
+		fmt.Println(function+": Error reading config:", err)
+		return shim.Error(err.Error())
+	}
+	product.Flags = nil
+	if err := applyGS1Rules(config.GS1Mode, &product, true); err != nil {
+		fmt.Println(function+": Error validating GS1 identifiers:", err)
+		return shim.Error(err.Error())
+	}
+	if err := checkExpiryPolicy(product, now); err != nil {
+		fmt.Println(function+": Error checking expiry:", err)
+		return shim.Error(err.Error())
+	}
+
+	key, err := getProductKey(stub, product)
+	if err != nil {
+		fmt.Println(function+": Error creating product key:", err)
+		return shim.Error(err.Error())
+	}
+	existingAsBytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println(function+": Error reading existing product:", err)
+		return shim.Error(err.Error())
+	}
+	product.Version = 1
+	var previous *Product
+	if len(existingAsBytes) > 0 {
+		if !upsert {
+			errorString := function + ": Product already exists - " + displayKey(stub, key)
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		existing, err := getProductFromJSON(existingAsBytes)
+		if err != nil {
+			fmt.Println(function+": Error with stored JSON format:", err)
+			return shim.Error(err.Error())
+		}
+		fmt.Println(function+": overwriting existing product, version = ", existing.Version)
+		previous = &existing
+		product.Version = existing.Version + 1
+		product.Shipment = existing.Shipment
+		product.Parent = existing.Parent
+		product.OriginGln = existing.OriginGln
+		if err := checkCustody(&existing, &product); err != nil {
+			fmt.Println(function+": Error checking custody:", err)
+			return shim.Error(err.Error())
+		}
+		if err := applyLifecycle(config.Lifecycle, &existing, &product); err != nil {
+			fmt.Println(function+": Error checking lifecycle:", err)
+			return shim.Error(err.Error())
+		}
+		if err := authorizeProductWrite(stub, &existing, &product); err != nil {
+			fmt.Println(function+": Error authorizing caller:", err)
+			return shim.Error(err.Error())
+		}
+	} else {
+		product.Shipment = nil
+		product.Parent = ""
+		product.OriginGln = product.Gln
+		if err := checkCustody(nil, &product); err != nil {
+			fmt.Println(function+": Error checking custody:", err)
+			return shim.Error(err.Error())
+		}
+		if err := applyLifecycle(config.Lifecycle, nil, &product); err != nil {
+			fmt.Println(function+": Error checking lifecycle:", err)
+			return shim.Error(err.Error())
+		}
+		if err := authorizeProductWrite(stub, nil, &product); err != nil {
+			fmt.Println(function+": Error authorizing caller:", err)
+			return shim.Error(err.Error())
+		}
+		if err := checkLotOwner(stub, &product); err != nil {
+			fmt.Println(function+": Error checking lot owner:", err)
+			return shim.Error(err.Error())
+		}
+	}
+	product.TxID = stub.GetTxID()
 	bytes, err := product.toBytes()
 	if err != nil {
-		fmt.Println("createProduct: Error converting input product to bytes:", err)
+		fmt.Println(function+": Error converting input product to bytes:", err)
 		return shim.Error(err.Error())
 	}
 	// write it to the ledger
-	fmt.Println("createProduct: call putState, key = ", key)
+	fmt.Println(function+": call putState, key = ", displayKey(stub, key))
 	err = stub.PutState(key, bytes)
 	if err != nil {
-		fmt.Println("createProduct: Error invoking on chaincode:", err)
+		fmt.Println(function+": Error invoking on chaincode:", err)
+		return shim.Error(err.Error())
+	}
+	if err := putLotIndex(stub, key); err != nil {
+		fmt.Println(function+": Error indexing lot:", err)
+		return shim.Error(err.Error())
+	}
+	if err := emitProductEvent(stub, key, previous, product); err != nil {
+		fmt.Println(function+": Error emitting event:", err)
 		return shim.Error(err.Error())
 	}
 	fmt.Println("transaction id", stub.GetTxID())
-	fmt.Println("createProduct: return successful write")
+	fmt.Println(function + ": return successful write")
 	//return shim.Success(bytes)
 	return shim.Success([]byte(stub.GetTxID()))
-} // end of createProduct
+} // end of saveProduct
+
+// ============================================================================================================================
+// Update Product - passes 3 arguments, the key, the expected version and a JSON document holding the fields to change
+// ============================================================================================================================
+// The expected version is either the version number or the txId the caller last read, if it does not match
+// what is stored the update is rejected so concurrent writers can't silently overwrite each other.
+// The JSON is merged into the stored record as a JSON merge patch (RFC 7386), fields set to null are removed.
+func (t *DataChainCode) updateProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("updateProduct: enter")
+	defer fmt.Println("updateProduct: exit")
+
+	if len(args) != 3 {
+		errorString := "updateProduct: Invalid number of args, must be exactly 3 arguments, key, expected version or txId and JSON containing the changes"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
 
+	key := args[0]
+	expected := args[1]
+	if len(expected) == 0 {
+		errorString := "updateProduct: expected version or txId must not be empty"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	existing, err := getProduct(stub, key)
+	if err != nil {
+		fmt.Println("updateProduct: Error getting product:", err)
+		return shim.Error(err.Error())
+	}
+
+	if expected != strconv.Itoa(existing.Version) && expected != existing.TxID {
+		errorString := "updateProduct: Version mismatch for " + displayKey(stub, key) + ", expected " + expected + " but stored version is " + strconv.Itoa(existing.Version) + " (txId " + existing.TxID + ")"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
 
+	if err := validateInputSize([]byte(args[2])); err != nil {
+		fmt.Println("updateProduct: Error validating JSON:", err)
+		return shim.Error(err.Error())
+	}
+
+	product, err := mergeProduct(existing, []byte(args[2]))
+	if err != nil {
+		fmt.Println("updateProduct: Error merging changes:", err)
+		return shim.Error(err.Error())
+	}
+
+	verr := newValidationError()
+	validateProductFields(&product, verr)
+	if verr.hasErrors() {
+		fmt.Println("updateProduct: Error validating JSON:", verr)
+		return shim.Error(verr.Error())
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		fmt.Println("updateProduct: Error reading config:", err)
+		return shim.Error(err.Error())
+	}
+	if err := applyGS1Rules(config.GS1Mode, &product, false); err != nil {
+		fmt.Println("updateProduct: Error validating GS1 identifiers:", err)
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println("updateProduct: Error getting transaction time:", err)
+		return shim.Error(err.Error())
+	}
+	if err := checkExpiryPolicy(product, now); err != nil {
+		fmt.Println("updateProduct: Error checking expiry:", err)
+		return shim.Error(err.Error())
+	}
+	if err := checkCustody(&existing, &product); err != nil {
+		fmt.Println("updateProduct: Error checking custody:", err)
+		return shim.Error(err.Error())
+	}
+	if err := applyLifecycle(config.Lifecycle, &existing, &product); err != nil {
+		fmt.Println("updateProduct: Error checking lifecycle:", err)
+		return shim.Error(err.Error())
+	}
+	if err := authorizeProductWrite(stub, &existing, &product); err != nil {
+		fmt.Println("updateProduct: Error authorizing caller:", err)
+		return shim.Error(err.Error())
+	}
+
+	product.Version = existing.Version + 1
+	product.TxID = stub.GetTxID()
+	bytes, err := product.toBytes()
+	if err != nil {
+		fmt.Println("updateProduct: Error converting product to bytes:", err)
+		return shim.Error(err.Error())
+	}
+	fmt.Println("updateProduct: call putState, key = ", displayKey(stub, key))
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("updateProduct: Error invoking on chaincode:", err)
+		return shim.Error(err.Error())
+	}
+	if err := emitProductEvent(stub, key, &existing, product); err != nil {
+		fmt.Println("updateProduct: Error emitting event:", err)
+		return shim.Error(err.Error())
+	}
+	fmt.Println("updateProduct: return successful write")
+	return shim.Success([]byte(stub.GetTxID()))
+} // end of updateProduct
+
+// Applies the changes JSON to the existing product, the identifying fields that make
+// up the key and the fields managed by the chaincode can not be changed this way
+func mergeProduct(existing Product, changes []byte) (Product, error) {
+
+	var patch map[string]interface{}
+	if err := json.Unmarshal(changes, &patch); err != nil {
+		return existing, errors.New("mergeProduct: changes must be a JSON object - " + err.Error())
+	}
+
+	existingBytes, err := existing.toBytes()
+	if err != nil {
+		return existing, err
+	}
+	var current map[string]interface{}
+	if err := json.Unmarshal(existingBytes, &current); err != nil {
+		return existing, err
+	}
+
+	for _, field := range []string{"docType", "version", "txId", "flags", "shipment", "parent", "originGln", "submitterMspId", "submitterSubject"} {
+		if _, ok := patch[field]; ok {
+			return existing, errors.New("mergeProduct: field " + field + " is managed by the chaincode and can not be updated")
+		}
+	}
+	for _, field := range []string{"gtin", "serialNo", "lot", "expirationDate"} {
+		val, ok := patch[field]
+		if !ok {
+			continue
+		}
+		if field == "serialNo" {
+			// older records and clients send numeric serials
+			val, _ = serialToString(val)
+		}
+		if !reflect.DeepEqual(val, current[field]) {
+			return existing, errors.New("mergeProduct: field " + field + " is part of the product key and can not be updated")
+		}
+	}
+
+	merged, err := json.Marshal(mergePatch(current, patch))
+	if err != nil {
+		return existing, err
+	}
+	return getProductFromJSON(merged)
+
+} // end of mergeProduct
+
+// mergePatch applies patch to target following RFC 7386, nested objects are merged
+// and null values remove the field
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{})
+	}
+	for field, val := range patch {
+		if val == nil {
+			delete(target, field)
+			continue
+		}
+		patchObj, isObj := val.(map[string]interface{})
+		targetObj, targetIsObj := target[field].(map[string]interface{})
+		if isObj && targetIsObj {
+			target[field] = mergePatch(targetObj, patchObj)
+		} else if isObj {
+			target[field] = mergePatch(nil, patchObj)
+		} else {
+			target[field] = val
+		}
+	}
+	return target
+} // end of mergePatch
+
+
+
+// ============================================================================================================================
+// Read Product - returns a single product, passes either 1 argument the ledger key or 4 arguments
+// the gtin, serial, lot and expirationDate the key is built from
+// ============================================================================================================================
+func (t *DataChainCode) readProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("readProduct: enter")
+	defer fmt.Println("readProduct: exit")
+
+	var key string
+	if len(args) == 1 {
+		key = args[0]
+	} else if len(args) == 4 {
+		// a valid GTIN and expiry are normalized the same way as on create
+		gtin := args[0]
+		if normalized, ok := normalizeGtin(gtin); ok {
+			gtin = normalized
+		}
+		expiry := args[3]
+		if now, err := getTxTime(stub); err == nil {
+			if normalized, err := normalizeExpiryDate(expiry, now); err == nil {
+				expiry = normalized
+			}
+		}
+		var err error
+		key, err = getProductKey(stub, Product{Gtin: gtin, SerialNumber: args[1], Lot: args[2], ExpiryDate: expiry})
+		if err != nil {
+			fmt.Println("readProduct: Error creating product key:", err)
+			return shim.Error(err.Error())
+		}
+	} else {
+		errorString := "readProduct: Invalid number of args, must be 1 argument, the key, or 4 arguments, gtin, serial, lot and expirationDate"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	product, err := getProduct(stub, key)
+	if err != nil {
+		fmt.Println("readProduct: Error getting product:", err)
+		return shim.Error(err.Error())
+	}
+	record, err := product.toBytes()
+	if err != nil {
+		fmt.Println("readProduct: Error converting product to bytes:", err)
+		return shim.Error(err.Error())
+	}
+
+	response, err := json.Marshal(ProductRecord{Key: key, TxID: product.TxID, Version: product.Version, Record: record})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(response)
+} // end of readProduct
 
 // ============================================================================================================================
 // Get Product - get a product asset from ledger
@@ -156,7 +584,7 @@ func getProduct(stub shim.ChaincodeStubInterface, key string) (Product, error) {
 
 	productAsBytes, err := stub.GetState(key)
 	if err != nil { //this seems to always succeed, even if key didn't exist
-		return prod, errors.New("getProduct: Failed to find product - " + key)
+		return prod, errors.New("getProduct: Failed to find product - " + displayKey(stub, key))
 	}
 
 	if len(productAsBytes) == 0 {
@@ -171,165 +599,97 @@ func getProduct(stub shim.ChaincodeStubInterface, key string) (Product, error) {
 
 	//test if product is actually here or just nil
 	if len(prod.Gtin) < 1 {
-		return prod, errors.New("getProduct:Product does not exist - " + key)
+		return prod, errors.New("getProduct:Product does not exist - " + displayKey(stub, key))
 	}
 
 	return prod, nil
 }
 
+// Put Product - sets the version and txId on the product, writes it under key, keeps it in the gtin~lot~key index
+// and emits the chaincode event, existing is the stored product the event is worked out from
+func putProduct(stub shim.ChaincodeStubInterface, key string, existing *Product, product *Product) error {
+	product.Version++
+	product.TxID = stub.GetTxID()
+	productAsBytes, err := product.toBytes()
+	if err != nil {
+		return err
+	}
+	fmt.Println("putProduct: call putState, key = ", displayKey(stub, key))
+	if err := stub.PutState(key, productAsBytes); err != nil {
+		return err
+	}
+	if err := putLotIndex(stub, key); err != nil {
+		return err
+	}
+	return emitProductEvent(stub, key, existing, *product)
+}
+
 // Since we have dynamic data we unmarshall into the Data field for everything
 // then manually set the know types from the Data then remove them from Data so
 // unmarshalling only occurs once
-// NOTE: this method just unmashalls and does not validate, so if missing field it return empty string
+// NOTE: this method checks the type of every known field and returns a *ValidationError
+// listing all of the wrongly typed fields, a missing field is left as the zero value
 func getProductFromJSON(incoming []byte) (Product, error) {
 	var product Product
 	fmt.Println("product in getProductFromJSON", product)
 
 	if err := json.Unmarshal([]byte(incoming), &product.Data); err != nil {
-		return product, err
+		verr := newValidationError()
+		verr.add("document", "JSON object", err.Error())
+		return product, verr
+	}
+	if product.Data == nil {
+		product.Data = make(map[string]interface{})
 	}
 
 	product.DocType = ProductObjectType
 	if _, ok := product.Data["docType"]; ok {
 		delete(product.Data, "docType")
 	}
-	
-	var temp map[string]interface{}
-	var lat float64
-	var lon float64
-	if val, ok := product.Data["loc_cd"]; ok {
-		temp = val.(map[string]interface{})
-		lat = temp["lat"].(float64)
-		lon = temp["lon"].(float64)
-		product.LocationInfo = LocationData{lat, lon}
-		delete(product.Data, "loc_cd")
-	} else {
-		product.LocationInfo = LocationData{lat, lon}
-	}
-	//fmt.Println("Got Location Data", product.LocationInfo)
-	if val, ok := product.Data["id"]; ok {
-		product.ID = val.(float64)
-		delete(product.Data, "id")
-	} else {
-		product.ID = 0
-	}
 
-	if val, ok := product.Data["gtin"]; ok {
-		product.Gtin = val.(string)
-		delete(product.Data, "gtin")
-	} else {
-		product.Gtin = ""
-	}
-	if val, ok := product.Data["serialNo"]; ok {
-		product.SerialNumber = val.(float64)
-		delete(product.Data, "serialNo")
-	} else {
-		product.SerialNumber = 0
-	}
-	if val, ok := product.Data["lot"]; ok {
-		product.Lot = val.(string)
-		delete(product.Data, "lot")
-	} else {
-		product.Lot = ""
-	}
-	if val, ok := product.Data["expirationDate"]; ok {
-		product.ExpiryDate = val.(string)
-		delete(product.Data, "expirationDate")
-	} else {
-		product.ExpiryDate = ""
-	}
-	if val, ok := product.Data["event"]; ok {
-		product.Event = val.(string)
-		delete(product.Data, "event")
-	} else {
-		product.Event = ""
-	}
-	if val, ok := product.Data["event_dt"]; ok {
-		product.EventDate = val.(string)
-		delete(product.Data, "event_dt")
-	} else {
-		product.EventDate = ""
-	}
-	if val, ok := product.Data["gln"]; ok {
-		product.Gln = val.(string)
-		delete(product.Data, "gln")
-	} else {
-		product.Gln = ""
-	}
-	if val, ok := product.Data["status"]; ok {
-		product.Status = val.(string)
-		delete(product.Data, "status")
-	} else {
-		product.Status = ""
-	}
-	if val, ok := product.Data["tradeItemDesc"]; ok {
-		product.TradeItemDesc = val.(string)
-		delete(product.Data, "tradeItemDesc")
-	} else {
-		product.TradeItemDesc = ""
-	}
-	if val, ok := product.Data["product"]; ok {
-		product.Product = val.(string)
-		delete(product.Data, "product")
-	} else {
-		product.Product = ""
-	}
-	if val, ok := product.Data["tradename"]; ok {
-		product.TradeName = val.(string)
-		delete(product.Data, "tradename")
-	} else {
-		product.TradeName = ""
-	}
-	if val, ok := product.Data["manufactureDate"]; ok {
-		product.ManufactureDate = val.(string)
-		delete(product.Data, "manufactureDate")
-	} else {
-		product.ManufactureDate = ""
-	}
-	if val, ok := product.Data["location"]; ok {
-		product.Location = val.(string)
-		delete(product.Data, "location")
-	} else {
-		product.Location = ""
-	}
-	if val, ok := product.Data["toGln"]; ok {
-		product.ToGln = val.(string)
-		delete(product.Data, "toGln")
-	} else {
-		product.ToGln = ""
-	}
-	if val, ok := product.Data["toLocation"]; ok {
-		product.ToLocation = val.(string)
-		delete(product.Data, "toLocation")
-	} else {
-		product.ToLocation = ""
-	}
-	if val, ok := product.Data["sender"]; ok {
-		product.Sender = val.(string)
-		delete(product.Data, "sender")
-	} else {
-		product.Sender = ""
-	}
-	if val, ok := product.Data["receiver"]; ok {
-		product.Receiver = val.(string)
-		delete(product.Data, "receiver")
-	} else {
-		product.Receiver = ""
+	verr := newValidationError()
+	product.LocationInfo = takeLocation(product.Data, "loc_cd", verr)
+	//fmt.Println("Got Location Data", product.LocationInfo)
+	product.ID = takeNumber(product.Data, "id", verr)
+	product.Gtin = takeString(product.Data, "gtin", verr)
+	product.SerialNumber = takeSerial(product.Data, "serialNo", verr)
+	product.Lot = takeString(product.Data, "lot", verr)
+	product.ExpiryDate = takeString(product.Data, "expirationDate", verr)
+	product.Event = takeString(product.Data, "event", verr)
+	product.EventDate = takeString(product.Data, "event_dt", verr)
+	product.Gln = takeString(product.Data, "gln", verr)
+	product.Status = takeString(product.Data, "status", verr)
+	product.TradeItemDesc = takeString(product.Data, "tradeItemDesc", verr)
+	product.Product = takeString(product.Data, "product", verr)
+	product.TradeName = takeString(product.Data, "tradename", verr)
+	product.ManufactureDate = takeString(product.Data, "manufactureDate", verr)
+	product.Location = takeString(product.Data, "location", verr)
+	product.ToGln = takeString(product.Data, "toGln", verr)
+	product.ToLocation = takeString(product.Data, "toLocation", verr)
+	product.Sender = takeString(product.Data, "sender", verr)
+	product.Receiver = takeString(product.Data, "receiver", verr)
+	product.Version = int(takeNumber(product.Data, "version", verr))
+	product.TxID = takeString(product.Data, "txId", verr)
+	product.Flags = takeStringList(product.Data, "flags", verr)
+	product.Shipment = takeShipment(product.Data, "shipment", verr)
+	product.Parent = takeString(product.Data, "parent", verr)
+	product.OriginGln = takeString(product.Data, "originGln", verr)
+	product.SubmitterMSPID = takeString(product.Data, "submitterMspId", verr)
+	product.SubmitterSubject = takeString(product.Data, "submitterSubject", verr)
+	if verr.hasErrors() {
+		return product, verr
 	}
 	fmt.Println("product in end of getProductFromJSON", product)
 	return product, nil
 
 } // end of getProductFromJSON
 
-// Gets the product key from the product
-func getProductKey(product Product) string {
+// Gets the product key from the product, a composite key over the gtin, serial, lot and expiry
+// so each identifier is kept separate and products can be looked up by a partial key
+func getProductKey(stub shim.ChaincodeStubInterface, product Product) (string, error) {
 
-	// create the key from the 4 attributes
-	//key := strings.ToLower(product.Gtin) + strings.ToLower(product.SerialNumber) + strings.ToLower(product.Lot) + product.ExpiryDate
-	sn := int(product.SerialNumber)
-	key := strings.ToLower(product.Gtin) + strconv.Itoa(sn) + strings.ToLower(product.Lot) + product.ExpiryDate
-	//key := strings.ToLower(product.Gtin) + fmt.Sprintf("%f", product.SerialNumber) + strings.ToLower(product.Lot) + product.ExpiryDate
-	return key
+	// serials are case sensitive in GS1 so unlike the GTIN and lot they are not lowercased
+	return stub.CreateCompositeKey(ProductObjectType, []string{strings.ToLower(product.Gtin), product.SerialNumber, strings.ToLower(product.Lot), product.ExpiryDate})
 
 } // end of getProductKey
 
@@ -362,244 +722,262 @@ func (product Product) toBytes() ([]byte, error) {
 } // end of toBytes()
 
 // ===== Example: Parameterized rich query =================================================
-// queryProductsByGtin queries for products based on a passed in gtin.
+// queryProductsByEvent queries for products based on a passed in event.
 // This is an example of a parameterized query where the query logic is baked into the chaincode,
-// and accepting a single query parameter (gtin).
+// and accepting a single query parameter (event) followed by the optional page size and bookmark.
 // Only available on state databases that support rich query (e.g. CouchDB)
 // =========================================================================================
 func (t *DataChainCode) queryProductsByEvent(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return queryProductsByField(stub, "queryProductsByEvent", "event", eventIndex, args)
+} // end of queryProductsByEvent
+
+// =========================================================================================
+// queryProductsByGtin queries for products with the passed in gtin, a valid GTIN is padded
+// to 14 digits the same way as on create
+// =========================================================================================
+func (t *DataChainCode) queryProductsByGtin(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 0 {
+		if gtin, ok := normalizeGtin(args[0]); ok {
+			args = append([]string{gtin}, args[1:]...)
+		}
+	}
+	return queryProductsByField(stub, "queryProductsByGtin", "gtin", gtinIndex, args)
+} // end of queryProductsByGtin
+
+// =========================================================================================
+// queryProductsByLot queries for products with the passed in lot
+// =========================================================================================
+func (t *DataChainCode) queryProductsByLot(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return queryProductsByField(stub, "queryProductsByLot", "lot", lotIndex, args)
+} // end of queryProductsByLot
+
+// =========================================================================================
+// queryProductsByGln queries for products currently held at the passed in gln
+// =========================================================================================
+func (t *DataChainCode) queryProductsByGln(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return queryProductsByField(stub, "queryProductsByGln", "gln", glnIndex, args)
+} // end of queryProductsByGln
 
-	fmt.Println("queryProductsByEvent: enter")
-	defer fmt.Println("queryProductsByEvent: exit")
+// =========================================================================================
+// queryProductsByStatus queries for products with the passed in status
+// =========================================================================================
+func (t *DataChainCode) queryProductsByStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return queryProductsByField(stub, "queryProductsByStatus", "status", statusIndex, args)
+} // end of queryProductsByStatus
 
-	if len(args) < 1 {
-		fmt.Println("queryProductsByGtin: Incorrect number of arguments. Expecting 1, that is an event")
-		return shim.Error("queryProductsByEvent: Incorrect number of arguments. Expecting 1, that is an event")
+// =========================================================================================
+// queryProductsByField runs the rich query for products where field equals args[0],
+// the remaining args are the optional page size and bookmark
+// =========================================================================================
+func queryProductsByField(stub shim.ChaincodeStubInterface, function string, field string, index couchIndex, args []string) pb.Response {
+
+	fmt.Println(function + ": enter")
+	defer fmt.Println(function + ": exit")
+
+	if len(args) < 1 || len(args[0]) == 0 {
+		errorString := function + ": Incorrect number of arguments. Expecting 1, that is the " + field
+		fmt.Println(errorString)
+		return shim.Error(errorString)
 	}
 
-	event := args[0]
-	fmt.Println("queryProductsByEvent: passed in event = ", event)
+	value := args[0]
+	fmt.Println(function+": passed in "+field+" = ", value)
 
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"product-data\",\"event\":\"%s\"},\"use_index\":[\"_design/data_eventIndexDoc\",\"data_eventIndex\"]}", event)
+	queryString, err := newProductQuery().Where(eq(field, value)).UseIndex(index).Build()
+	if err != nil {
+		fmt.Println(function+":, error building query = ", err)
+		return shim.Error(err.Error())
+	}
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString, args)
+	queryResults, err := getQueryResultForQueryString(stub, queryString, args[1:])
 	if err != nil {
-		fmt.Println("queryProductsByEvent:, error getting results = ", err)
+		fmt.Println(function+":, error getting results = ", err)
 		return shim.Error(err.Error())
 	}
 	return shim.Success(queryResults)
-} // end of queryProductsByGtin
-
+} // end of queryProductsByField
 
 // =========================================================================================
-// getQueryResultForQueryString executes the passed in query string.
-// Result set is built and returned as a byte array containing the JSON results.
+// queryProductsByEventDate queries for products whose last event happened from args[0] (inclusive)
+// to args[1] (exclusive), either bound can be "" but not both. args[2] and args[3] optionally
+// narrow it to an event and a gln, "" to skip, followed by the optional page size and bookmark.
+// Results are sorted by event_dt so a day can be read back as a movement report.
 // =========================================================================================
-func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string, args []string) ([]byte, error) {
-	fmt.Println("getQueryResultForQueryString: enter")
-	defer fmt.Println("getQueryResultForQueryString: exit")
+func (t *DataChainCode) queryProductsByEventDate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	fmt.Println("getQueryResultForQueryString:  queryString:\n", queryString)
+	fmt.Println("queryProductsByEventDate: enter")
+	defer fmt.Println("queryProductsByEventDate: exit")
 
-	// process additional query parameters such as offset and maxitems
-	offset := 1
-	maxitems := MaxProductItems
+	if len(args) < 2 || (len(args[0]) == 0 && len(args[1]) == 0) {
+		errorString := "queryProductsByEventDate: Incorrect number of arguments. Expecting at least 2, from and to, one of them can be empty"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
 
-	if len(args) > 1 {
-		var errString string
-		fmt.Println("get arg1,  arg1 = ", args[1])
-		arg1 := args[1]
-		i, err := strconv.Atoi(arg1)
+	query := newProductQuery()
+	if len(args[0]) > 0 {
+		from, err := normalizeTimestamp(args[0])
 		if err != nil {
-			errString = "getQueryResultForQueryString:, error passing parameter must be an integer, offset / arg1 = " + arg1 + ", err = " + err.Error()
-			fmt.Println(errString)
-			return nil, errors.New(errString)
+			errorString := "queryProductsByEventDate: from must be an ISO 8601 timestamp or date, got " + args[0]
+			fmt.Println(errorString)
+			return shim.Error(errorString)
 		}
-		offset = i
-		if offset < 1 {
-			errString = "getQueryResultForQueryString:, offset is 1 based and must be >= 1"
-			fmt.Println(errString)
-			return nil, errors.New(errString)
-		}
-		if len(args) > 2 {
-			arg2 := args[2]
-			i, err = strconv.Atoi(arg2)
-			if err != nil {
-				errString = "getQueryResultForQueryString:, error passing parameter must be an integer, maxitems / arg2 = " + arg2 + ", err = " + err.Error()
-				fmt.Println(errString)
-				return nil, errors.New(errString)
-			}
-			maxitems = i
-			if maxitems > MaxProductItems {
-				errString := "getQueryResultForQueryString: maxitems can not exceed " + strconv.Itoa(MaxProductItems)
-				fmt.Println(errString)
-				return nil, errors.New(errString)
-			}
-			if maxitems < 1 {
-				errString = "getQueryResultForQueryString:, maxitems must be >= 1"
-				fmt.Println(errString)
-				return nil, errors.New(errString)
-			}
+		query.Where(gte("event_dt", from))
+	} else {
+		// every stored event_dt sorts after "", this lets the index be used for an open start
+		query.Where(gt("event_dt", ""))
+	}
+	if len(args[1]) > 0 {
+		to, err := normalizeTimestamp(args[1])
+		if err != nil {
+			errorString := "queryProductsByEventDate: to must be an ISO 8601 timestamp or date, got " + args[1]
+			fmt.Println(errorString)
+			return shim.Error(errorString)
 		}
-
+		query.Where(lt("event_dt", to))
+	}
+	if len(args) > 2 && len(args[2]) > 0 {
+		query.Where(eq("event", args[2]))
+	}
+	if len(args) > 3 && len(args[3]) > 0 {
+		query.Where(eq("gln", args[3]))
 	}
-	fmt.Println("getQueryResultForQueryString: offset = ", offset)
-	fmt.Println("getQueryResultForQueryString: maxitems = ", maxitems)
 
-	resultsIterator, err := stub.GetQueryResult(queryString)
+	var pageArgs []string
+	if len(args) > 4 {
+		pageArgs = args[4:]
+	}
+	queryString, err := query.SortBy("event_dt", false).UseIndex(eventDateIndex).Build()
 	if err != nil {
-		fmt.Println(err)
-		return nil, err
+		fmt.Println("queryProductsByEventDate:, error building query = ", err)
+		return shim.Error(err.Error())
 	}
-	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryRecords
-	var buffer bytes.Buffer
-	buffer.WriteString("{\"products-data\": [")
-	totalCount := 0
-	itemsSkipped := 0
-	itemsKept := 0
-	bArrayMemberAlreadyWritten := false
-	preLoopLen := offset - 1
-
-	// execute the loop up to the offset
-	for idx := 0; idx < preLoopLen && resultsIterator.HasNext(); idx++ {
-		totalCount++
-		itemsSkipped++
-		_, err := resultsIterator.Next()
-		if err != nil {
-			return nil, errors.New(err.Error())
-		}
+	queryResults, err := getQueryResultForQueryString(stub, queryString, pageArgs)
+	if err != nil {
+		fmt.Println("queryProductsByEventDate:, error getting results = ", err)
+		return shim.Error(err.Error())
 	}
+	return shim.Success(queryResults)
+} // end of queryProductsByEventDate
 
-	for idx := 0; resultsIterator.HasNext(); idx++ {
-		totalCount++
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return nil, errors.New(err.Error())
-		}
+// QueryRecord - a key and its stored JSON as returned by the query functions
+type QueryRecord struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
+}
 
-		if idx < maxitems {
-			itemsKept++
+// QueryResponse - a page of query results, pass Bookmark back in to get the next page, see getPageArgs
+type QueryResponse struct {
+	Products            []QueryRecord `json:"products-data"`
+	FetchedRecordsCount int32         `json:"fetchedRecordsCount"`
+	Bookmark            string        `json:"bookmark"`
+}
 
-			if bArrayMemberAlreadyWritten == true {
-				buffer.WriteString(",")
-			}
-			buffer.WriteString("{\"Key\":")
-			buffer.WriteString("\"")
-			buffer.WriteString(queryResponse.Key)
-			buffer.WriteString("\"")
-
-			buffer.WriteString(", \"Record\":")
-			// Record is a JSON object, so we write as-is
-			buffer.WriteString(string(queryResponse.Value))
-			buffer.WriteString("}")
-			bArrayMemberAlreadyWritten = true
-			skipString := "idx = " + strconv.Itoa(idx) + ", offset = " + strconv.Itoa(offset) + ", maxiteams = " + strconv.Itoa(maxitems) + "  -- added"
-			fmt.Println(skipString)
-			fmt.Println("Items added = ", idx)
+// =========================================================================================
+// getQueryResultForQueryString executes the passed in query string one page at a time.
+// pageArgs are the optional page size (default and max MaxProductItems) and the bookmark
+// returned with the previous page, CouchDB resumes from the bookmark instead of skipping rows.
+// Result set is built and returned as a byte array containing the JSON results.
+// =========================================================================================
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string, pageArgs []string) ([]byte, error) {
+	response, err := getQueryResponseForQueryString(stub, queryString, pageArgs)
+	if err != nil {
+		return nil, err
+	}
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("getQueryResultForQueryString: results found\n", string(responseAsBytes))
 
-		} else {
-			itemsSkipped++
-			skipString := "idx = " + strconv.Itoa(idx) + ", offset = " + strconv.Itoa(offset) + ", maxiteams = " + strconv.Itoa(maxitems) + ", items skipped = " + strconv.Itoa(itemsSkipped) + "  -- ignoring"
-			fmt.Println(skipString)
+	return responseAsBytes, nil
 
-		}
-	}
-	buffer.WriteString("], ")
+} // end of getQueryResultForQueryString
 
-	// Add the totalCount and items skipped to returned JSON
-	buffer.WriteString("\"totalCount\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(strconv.Itoa(totalCount))
-	buffer.WriteString("\"")
+// =========================================================================================
+// getQueryResponseForQueryString executes the passed in query string for a page and returns
+// the results for the caller to filter before they are returned
+// =========================================================================================
+func getQueryResponseForQueryString(stub shim.ChaincodeStubInterface, queryString string, pageArgs []string) (QueryResponse, error) {
+	fmt.Println("getQueryResponseForQueryString: enter")
+	defer fmt.Println("getQueryResponseForQueryString: exit")
 
-	buffer.WriteString(",\"offset\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(strconv.Itoa(offset))
-	buffer.WriteString("\"")
+	fmt.Println("getQueryResponseForQueryString:  queryString:\n", queryString)
 
-	buffer.WriteString(",\"maxitems\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(strconv.Itoa(maxitems))
-	buffer.WriteString("\"")
+	var response QueryResponse
+	pageSize, bookmark, err := getPageArgs(pageArgs)
+	if err != nil {
+		fmt.Println(err)
+		return response, err
+	}
+	fmt.Println("getQueryResponseForQueryString: pageSize = ", pageSize)
+	fmt.Println("getQueryResponseForQueryString: bookmark = ", displayKey(stub, bookmark))
 
-	buffer.WriteString(",\"itemsSkipped\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(strconv.Itoa(itemsSkipped))
-	buffer.WriteString("\"")
+	resultsIterator, metadata, err := stub.GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		fmt.Println(err)
+		return response, err
+	}
+	if resultsIterator == nil {
+		return response, errors.New("getQueryResponseForQueryString: rich queries are not supported by this state database")
+	}
+	defer resultsIterator.Close()
 
-	buffer.WriteString(",\"itemsKept\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(strconv.Itoa(itemsKept))
-	buffer.WriteString("\"")
+	return buildQueryResponse(resultsIterator, metadata)
 
-	buffer.WriteString("}")
+} // end of getQueryResponseForQueryString
 
-	fmt.Println("getQueryResultForQueryString: results found\n", buffer.String())
+// getPageArgs - parses the optional page size and bookmark passed to the query functions, they are passed
+// together with "" as the bookmark of the first page. A response with an empty bookmark has no more pages.
+// The offset and maxitems the query functions took before bookmarks are rejected instead of being read as a
+// page size and bookmark
+func getPageArgs(pageArgs []string) (int32, string, error) {
+	pageSize := MaxProductItems
+	bookmark := ""
+	if len(pageArgs) == 0 {
+		return int32(pageSize), bookmark, nil
+	}
+	if len(pageArgs) != 2 {
+		return 0, "", errors.New("getPageArgs: expecting the page size and bookmark, pass \"\" as the bookmark of the first page, offset and maxitems are no longer supported")
+	}
 
-	return buffer.Bytes(), nil
+	if len(pageArgs[0]) > 0 {
+		i, err := strconv.Atoi(pageArgs[0])
+		if err != nil {
+			return 0, "", errors.New("getPageArgs: error passing parameter must be an integer, pageSize = " + pageArgs[0] + ", err = " + err.Error())
+		}
+		if i < 1 || i > MaxProductItems {
+			return 0, "", errors.New("getPageArgs: pageSize must be between 1 and " + strconv.Itoa(MaxProductItems))
+		}
+		pageSize = i
+	}
+	bookmark = pageArgs[1]
+	if isDigits(bookmark) {
+		// bookmarks are never just digits, this is the maxitems of the old offset and maxitems arguments
+		return 0, "", errors.New("getPageArgs: bookmark " + bookmark + " is a number, the offset and maxitems arguments are no longer supported, pass the page size and the bookmark returned with the previous page")
+	}
+	return int32(pageSize), bookmark, nil
+}
 
-} // end of getQueryResultForQueryString
+// buildQueryResponse - reads every result from the iterator into a QueryResponse, metadata
+// is nil for queries that are not paginated
+func buildQueryResponse(resultsIterator shim.StateQueryIteratorInterface, metadata *pb.QueryResponseMetadata) (QueryResponse, error) {
+	response := QueryResponse{Products: []QueryRecord{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return response, errors.New(err.Error())
+		}
+		response.Products = append(response.Products, QueryRecord{Key: queryResponse.Key, Record: queryResponse.Value})
+	}
 
-func (t *DataChainCode) queryProductHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-
-    if len(args) < 1 {
-            return shim.Error("Incorrect number of arguments. Expecting 1")
-    }
-
-    productKey := args[0]
-    resultsIterator, err := stub.GetHistoryForKey(productKey)
-    if err != nil {
-            return shim.Error(err.Error())
-    }
-    defer resultsIterator.Close()
-
-    var buffer bytes.Buffer
-    buffer.WriteString("[")
-
-    bArrayMemberAlreadyWritten := false
-    for resultsIterator.HasNext() {
-            response, err := resultsIterator.Next()
-            if err != nil {
-                    return shim.Error(err.Error())
-            }
-            // Add a comma before array members, suppress it for the first array member
-            if bArrayMemberAlreadyWritten == true {
-                    buffer.WriteString(",")
-            }
-            buffer.WriteString("{\"TxId\":")
-            buffer.WriteString("\"")
-            buffer.WriteString(response.TxId)
-            buffer.WriteString("\"")
-
-            buffer.WriteString(", \"Value\":")
-            // if it was a delete operation on given key, then we need to set the
-            //corresponding value null. Else, we will write the response.Value
-            //as-is (as the Value itself a JSON)
-            if response.IsDelete {
-                    buffer.WriteString("null")
-            } else {
-                    buffer.WriteString(string(response.Value))
-            }
-
-            buffer.WriteString(", \"Timestamp\":")
-            buffer.WriteString("\"")
-            buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
-            buffer.WriteString("\"")
-
-            buffer.WriteString(", \"IsDelete\":")
-            buffer.WriteString("\"")
-            buffer.WriteString(strconv.FormatBool(response.IsDelete))
-            buffer.WriteString("\"")
-
-            buffer.WriteString("}")
-            bArrayMemberAlreadyWritten = true
-    }
-    buffer.WriteString("]")
-
-    fmt.Printf("- History returning:\n%s\n", buffer.String())
-    return shim.Success(buffer.Bytes())
+	response.FetchedRecordsCount = int32(len(response.Products))
+	if metadata != nil {
+		response.FetchedRecordsCount = metadata.FetchedRecordsCount
+		response.Bookmark = metadata.Bookmark
+	}
+	return response, nil
 }
 
 
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"os"
+	"strings"
 	"testing"
 	"fmt"
 
+	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,6 +22,118 @@ const (
 	
 )
 
+// the composite key mockDevJson is stored under
+var mockDevKey = testProductKey("08806555018611", "1936800", "m036191", "2026-10-10")
+
+// testProductKey - builds a product composite key from already normalized identifiers
+func testProductKey(gtin string, serial string, lot string, expiry string) string {
+	key, _ := shim.CreateCompositeKey(ProductObjectType, []string{gtin, serial, lot, expiry})
+	return key
+}
+
+// pagedQueryStub - the mock stub has no rich query engine, this one answers any query with every
+// stored product one page at a time and remembers the queries it was given
+type pagedQueryStub struct {
+	*shimtest.MockStub
+	queries []string
+}
+
+func newPagedQueryStub(t *testing.T) *pagedQueryStub {
+	return &pagedQueryStub{MockStub: newTestStub(t)}
+}
+
+// GetQueryResultWithPagination - the bookmark is the last key of the previous page
+func (stub *pagedQueryStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	stub.queries = append(stub.queries, query)
+	var page []*queryresult.KV
+	more := false
+	for elem := stub.Keys.Front(); elem != nil; elem = elem.Next() {
+		key := elem.Value.(string)
+		if key <= bookmark || !isProductRecord(stub.State[key]) {
+			continue
+		}
+		if int32(len(page)) == pageSize {
+			more = true
+			break
+		}
+		page = append(page, &queryresult.KV{Key: key, Value: stub.State[key]})
+	}
+	metadata := &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(page))}
+	if more {
+		metadata.Bookmark = page[len(page)-1].Key
+	}
+	return &sliceQueryIterator{results: page}, metadata, nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination - the bookmark is the last key of the previous page
+func (stub *pagedQueryStub) GetStateByPartialCompositeKeyWithPagination(objectType string, attributes []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	prefix, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+	var page []*queryresult.KV
+	more := false
+	for elem := stub.Keys.Front(); elem != nil; elem = elem.Next() {
+		key := elem.Value.(string)
+		if key <= bookmark || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if int32(len(page)) == pageSize {
+			more = true
+			break
+		}
+		page = append(page, &queryresult.KV{Key: key, Value: stub.State[key]})
+	}
+	metadata := &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(page))}
+	if more {
+		metadata.Bookmark = page[len(page)-1].Key
+	}
+	return &sliceQueryIterator{results: page}, metadata, nil
+}
+
+// sliceQueryIterator - iterates over a fixed set of results
+type sliceQueryIterator struct {
+	results []*queryresult.KV
+}
+
+func (iter *sliceQueryIterator) HasNext() bool {
+	return len(iter.results) > 0
+}
+
+func (iter *sliceQueryIterator) Next() (*queryresult.KV, error) {
+	if len(iter.results) == 0 {
+		return nil, errors.New("sliceQueryIterator: no more results")
+	}
+	next := iter.results[0]
+	iter.results = iter.results[1:]
+	return next, nil
+}
+
+func (iter *sliceQueryIterator) Close() error {
+	return nil
+}
+
+// createTestProducts - creates a product for each serial from mockDevJson
+func createTestProducts(t *testing.T, stub *shimtest.MockStub, serials ...string) {
+	for _, serial := range serials {
+		productJSON := strings.Replace(mockDevJson, `"serialNo":1936800`, `"serialNo":"`+serial+`"`, 1)
+		results := stub.MockInvoke("create"+serial, [][]byte{[]byte("createProduct"), []byte(productJSON)})
+		assert.Equal(t, 200, int(results.Status), "createProduct "+serial)
+	}
+}
+
+// invokeQuery - calls a query function directly so a stub wrapping the mock stub is used
+func invokeQuery(stub shim.ChaincodeStubInterface, mockStub *shimtest.MockStub, query func(shim.ChaincodeStubInterface, []string) pb.Response, args ...string) (QueryResponse, pb.Response) {
+	var response QueryResponse
+	mockStub.MockTransactionStart("queryTx")
+	results := query(stub, args)
+	mockStub.MockTransactionEnd("queryTx")
+	if results.Status == 200 {
+		json.Unmarshal(results.Payload, &response)
+	}
+	return response, results
+}
+
 // If TestMain exists then this will run all the tests,
 // there can be a setup before all tests and a clean up after all tests have run
 // NOTE: our tests will use the logger declared globally in the chaincode
@@ -50,7 +168,7 @@ func Test_Init(t *testing.T) {
 func TestCreateProducts(t *testing.T) {
 	fmt.Println("TestCreateProducts: enter")
 	
-	stub := shimtest.NewMockStub("mockStub", new(DataChainCode))
+	stub := newTestStub(t)
 
 	if stub == nil {
 		t.Fatalf("MockStub creation failed")
@@ -81,7 +199,7 @@ func TestQueryByEvent(t *testing.T) {
 	fmt.Println("TestQueryByEvent: enter")
 	defer fmt.Println("TestQueryByEvent: exit")
 
-	stub := shimtest.NewMockStub("mockStub", new(DataChainCode))
+	stub := newTestStub(t)
 
 	if stub == nil {
 		t.Fatalf("TestQueryByEvent: MockStub creation failed")
@@ -97,4 +215,212 @@ func TestQueryByEvent(t *testing.T) {
 	assert.Equal(t, 500, returnCode, "Result : Success, queryProductsByEvent")
 
 	
-} // end of TestQueryByEvent
\ No newline at end of file
+} // end of TestQueryByEvent
+func TestUpdateProduct(t *testing.T) {
+	fmt.Println("TestUpdateProduct: enter")
+	defer fmt.Println("TestUpdateProduct: exit")
+
+	stub := newTestStub(t)
+	key := mockDevKey
+
+	results := stub.MockInvoke("createTx", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 200, int(results.Status), "createProduct")
+
+	results = stub.MockInvoke("updateTx1", [][]byte{[]byte("updateProduct"), []byte(key), []byte("1"), []byte(`{"event":"quarantine","notes":{"pallet":"P1"}}`)})
+	assert.Equal(t, 200, int(results.Status), "updateProduct with current version")
+
+	product, err := getProduct(stub, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "quarantined", product.Status)
+	assert.Equal(t, "gardasil9", product.Product)
+	assert.Equal(t, 2, product.Version)
+	assert.Equal(t, "updateTx1", product.TxID)
+	assert.Equal(t, map[string]interface{}{"pallet": "P1"}, product.Data["notes"])
+
+	// stale version is rejected
+	results = stub.MockInvoke("updateTx2", [][]byte{[]byte("updateProduct"), []byte(key), []byte("1"), []byte(`{"event":"release"}`)})
+	assert.Equal(t, 500, int(results.Status), "updateProduct with stale version")
+
+	// the last txId is accepted as the expected version, null removes a field
+	results = stub.MockInvoke("updateTx3", [][]byte{[]byte("updateProduct"), []byte(key), []byte("updateTx1"), []byte(`{"notes":{"pallet":null,"case":"C7"}}`)})
+	assert.Equal(t, 200, int(results.Status), "updateProduct with txId")
+	product, _ = getProduct(stub, key)
+	assert.Equal(t, map[string]interface{}{"case": "C7"}, product.Data["notes"])
+	assert.Equal(t, 3, product.Version)
+
+	// key fields can not change
+	results = stub.MockInvoke("updateTx4", [][]byte{[]byte("updateProduct"), []byte(key), []byte("3"), []byte(`{"lot":"OTHER"}`)})
+	assert.Equal(t, 500, int(results.Status), "updateProduct changing key field")
+
+	results = stub.MockInvoke("updateTx5", [][]byte{[]byte("updateProduct"), []byte("missing"), []byte("1"), []byte(`{"status":"packed"}`)})
+	assert.Equal(t, 500, int(results.Status), "updateProduct missing product")
+} // end of TestUpdateProduct
+
+func TestCreateDuplicateAndUpsert(t *testing.T) {
+	fmt.Println("TestCreateDuplicateAndUpsert: enter")
+	defer fmt.Println("TestCreateDuplicateAndUpsert: exit")
+
+	stub := newTestStub(t)
+	key := mockDevKey
+
+	results := stub.MockInvoke("createTx1", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 200, int(results.Status), "createProduct")
+
+	results = stub.MockInvoke("createTx2", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 500, int(results.Status), "createProduct duplicate")
+	assert.Contains(t, results.Message, "already exists - 08806555018611/1936800/m036191/2026-10-10")
+	assert.NotContains(t, results.Message, "\x00", "the key is rendered without its separators")
+
+	results = stub.MockInvoke("upsertTx1", [][]byte{[]byte("upsertProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 200, int(results.Status), "upsertProduct existing")
+	product, err := getProduct(stub, key)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, product.Version)
+	assert.Equal(t, "upsertTx1", product.TxID)
+} // end of TestCreateDuplicateAndUpsert
+
+func TestReadProduct(t *testing.T) {
+	fmt.Println("TestReadProduct: enter")
+	defer fmt.Println("TestReadProduct: exit")
+
+	stub := newTestStub(t)
+
+	results := stub.MockInvoke("createTx1", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 200, int(results.Status), "createProduct")
+
+	var record ProductRecord
+	results = stub.MockInvoke("readTx1", [][]byte{[]byte("readProduct"), []byte(mockDevKey)})
+	assert.Equal(t, 200, int(results.Status), "readProduct by key")
+	assert.Nil(t, json.Unmarshal(results.Payload, &record))
+	assert.Equal(t, mockDevKey, record.Key)
+	assert.Equal(t, "createTx1", record.TxID)
+	assert.Equal(t, 1, record.Version)
+	product, err := getProductFromJSON(record.Record)
+	assert.Nil(t, err)
+	assert.Equal(t, "gardasil9", product.Product)
+
+	// identifiers are normalized the same way as on create
+	results = stub.MockInvoke("readTx2", [][]byte{[]byte("readProduct"), []byte("8806555018611"), []byte("1936800"), []byte("M036191"), []byte("10/10/2026")})
+	assert.Equal(t, 200, int(results.Status), "readProduct by identifiers")
+	assert.Nil(t, json.Unmarshal(results.Payload, &record))
+	assert.Equal(t, mockDevKey, record.Key)
+
+	results = stub.MockInvoke("readTx3", [][]byte{[]byte("readProduct"), []byte("08806555018611"), []byte("1936801"), []byte("M036191"), []byte("10/10/2026")})
+	assert.Equal(t, 500, int(results.Status), "readProduct missing")
+
+	results = stub.MockInvoke("readTx4", [][]byte{[]byte("readProduct"), []byte("08806555018611"), []byte("1936800")})
+	assert.Equal(t, 500, int(results.Status), "readProduct wrong args")
+} // end of TestReadProduct
+
+func TestQueryByEventPagination(t *testing.T) {
+	fmt.Println("TestQueryByEventPagination: enter")
+	defer fmt.Println("TestQueryByEventPagination: exit")
+
+	cc := new(DataChainCode)
+	stub := newPagedQueryStub(t)
+	createTestProducts(t, stub.MockStub, "S1", "S2", "S3")
+
+	response, results := invokeQuery(stub, stub.MockStub, cc.queryProductsByEvent, "commission", "2", "")
+	assert.Equal(t, 200, int(results.Status), "first page")
+	assert.Len(t, response.Products, 2)
+	assert.Equal(t, int32(2), response.FetchedRecordsCount)
+	assert.NotEmpty(t, response.Bookmark)
+	assert.Contains(t, stub.queries[0], `"event":{"$eq":"commission"}`)
+
+	response, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByEvent, "commission", "2", response.Bookmark)
+	assert.Equal(t, 200, int(results.Status), "second page")
+	assert.Len(t, response.Products, 1)
+	assert.Equal(t, testProductKey("08806555018611", "S3", "m036191", "2026-10-10"), response.Products[0].Key)
+	assert.Empty(t, response.Bookmark)
+
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByEvent, "commission", "1000", "")
+	assert.Equal(t, 500, int(results.Status), "page size over the max")
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByEvent, "commission", "two", "")
+	assert.Equal(t, 500, int(results.Status), "page size not a number")
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByEvent, "commission", "1", "50")
+	assert.Equal(t, 500, int(results.Status), "the old offset and maxitems")
+	assert.Contains(t, results.Message, "offset and maxitems")
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByEvent, "commission", "11")
+	assert.Equal(t, 500, int(results.Status), "the old offset on its own")
+} // end of TestQueryByEventPagination
+
+func TestQueryProductsByIdentifiers(t *testing.T) {
+	fmt.Println("TestQueryProductsByIdentifiers: enter")
+	defer fmt.Println("TestQueryProductsByIdentifiers: exit")
+
+	cc := new(DataChainCode)
+	stub := newPagedQueryStub(t)
+	createTestProducts(t, stub.MockStub, "S1", "S2")
+
+	tests := []struct {
+		query    func(shim.ChaincodeStubInterface, []string) pb.Response
+		value    string
+		selector string
+		index    couchIndex
+	}{
+		{cc.queryProductsByGtin, "8806555018611", `"gtin":{"$eq":"08806555018611"}`, gtinIndex},
+		{cc.queryProductsByLot, "M036191", `"lot":{"$eq":"M036191"}`, lotIndex},
+		{cc.queryProductsByGln, "0300060000037", `"gln":{"$eq":"0300060000037"}`, glnIndex},
+		{cc.queryProductsByStatus, "active", `"status":{"$eq":"active"}`, statusIndex},
+	}
+	for _, test := range tests {
+		stub.queries = nil
+		response, results := invokeQuery(stub, stub.MockStub, test.query, test.value, "1", "")
+		assert.Equal(t, 200, int(results.Status), test.selector)
+		assert.Len(t, response.Products, 1)
+		assert.NotEmpty(t, response.Bookmark)
+		assert.Contains(t, stub.queries[0], test.selector)
+		assert.Contains(t, stub.queries[0], `"use_index":["`+test.index.DesignDoc+`","`+test.index.Name+`"]`)
+
+		response, results = invokeQuery(stub, stub.MockStub, test.query, test.value, "1", response.Bookmark)
+		assert.Equal(t, 200, int(results.Status), test.selector+" second page")
+		assert.Len(t, response.Products, 1)
+
+		_, results = invokeQuery(stub, stub.MockStub, test.query)
+		assert.Equal(t, 500, int(results.Status), test.selector+" without a value")
+	}
+} // end of TestQueryProductsByIdentifiers
+
+func TestQueryProductsByEventDate(t *testing.T) {
+	fmt.Println("TestQueryProductsByEventDate: enter")
+	defer fmt.Println("TestQueryProductsByEventDate: exit")
+
+	cc := new(DataChainCode)
+	stub := newPagedQueryStub(t)
+
+	// event_dt is stored in UTC with milliseconds whatever offset it was sent with
+	productJSON := strings.Replace(mockDevJson, `"event_dt":"2019-10-12T04:00:00.000Z"`, `"event_dt":"2019-10-12T00:00:00-04:00"`, 1)
+	results := stub.MockInvoke("createTx1", [][]byte{[]byte("createProduct"), []byte(productJSON)})
+	assert.Equal(t, 200, int(results.Status), "createProduct")
+	product, _ := getProduct(stub, mockDevKey)
+	assert.Equal(t, "2019-10-12T04:00:00.000Z", product.EventDate)
+
+	productJSON = strings.Replace(mockDevJson, `"event_dt":"2019-10-12T04:00:00.000Z"`, `"event_dt":"12/10/2019"`, 1)
+	results = stub.MockInvoke("createTx2", [][]byte{[]byte("upsertProduct"), []byte(productJSON)})
+	assert.Equal(t, 500, int(results.Status), "upsertProduct bad event_dt")
+	assert.Contains(t, results.Message, `"field":"event_dt"`)
+
+	response, results := invokeQuery(stub, stub.MockStub, cc.queryProductsByEventDate, "2019-10-12", "2019-10-13T00:00:00+00:00", "commission", "0300060000037")
+	assert.Equal(t, 200, int(results.Status), "queryProductsByEventDate")
+	assert.Len(t, response.Products, 1)
+	var query map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(stub.queries[0]), &query))
+	assert.Equal(t, map[string]interface{}{
+		"docType":  map[string]interface{}{"$eq": "product-data"},
+		"event_dt": map[string]interface{}{"$gte": "2019-10-12T00:00:00.000Z", "$lt": "2019-10-13T00:00:00.000Z"},
+		"event":    map[string]interface{}{"$eq": "commission"},
+		"gln":      map[string]interface{}{"$eq": "0300060000037"},
+	}, query["selector"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"event_dt": "asc"}}, query["sort"])
+	assert.Equal(t, []interface{}{eventDateIndex.DesignDoc, eventDateIndex.Name}, query["use_index"])
+
+	// open start
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByEventDate, "", "2019-10-13")
+	assert.Equal(t, 200, int(results.Status), "queryProductsByEventDate open start")
+	assert.Contains(t, stub.queries[1], `"event_dt":{"$gt":"","$lt":"2019-10-13T00:00:00.000Z"}`)
+
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByEventDate, "", "")
+	assert.Equal(t, 500, int(results.Status), "queryProductsByEventDate no bounds")
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByEventDate, "yesterday", "")
+	assert.Equal(t, 500, int(results.Status), "queryProductsByEventDate bad bound")
+} // end of TestQueryProductsByEventDate
@@ -0,0 +1,807 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// EPCISCapturedEvent - chaincode event emitted by captureEPCIS, the payload is the EPCISCaptureResult
+const EPCISCapturedEvent = "EPCISCaptured"
+
+// MaxEPCISDocumentSizeAllowed - the largest EPCIS document captureEPCIS accepts
+const MaxEPCISDocumentSizeAllowed = 512 * 1024
+
+// EPCIS event types and actions handled by captureEPCIS
+const (
+	EPCISObjectEvent      = "ObjectEvent"
+	EPCISAggregationEvent = "AggregationEvent"
+	EPCISActionAdd        = "ADD"
+	EPCISActionObserve    = "OBSERVE"
+	EPCISActionDelete     = "DELETE"
+)
+
+// epcisBizStepEvents - the lifecycle event recorded for a CBV business step, other business steps are
+// recorded on the product without changing its event
+var epcisBizStepEvents = map[string]string{
+	"commissioning":   CommissionEvent,
+	"packing":         PackEvent,
+	"unpacking":       UnpackEvent,
+	"shipping":        ShipEvent,
+	"receiving":       ReceiveEvent,
+	"accepting":       ReceiveEvent,
+	"dispensing":      "dispense",
+	"decommissioning": "decommission",
+	"destroying":      "decommission",
+	"holding":         "quarantine",
+}
+
+// epcisDocument - the parts of an EPCIS 2.0 JSON-LD document read by captureEPCIS
+type epcisDocument struct {
+	Type      string `json:"type"`
+	EPCISBody struct {
+		EventList []epcisEvent `json:"eventList"`
+	} `json:"epcisBody"`
+}
+
+// epcisEvent - an ObjectEvent or AggregationEvent, ILMD holds the lot and expiry of commissioned products
+type epcisEvent struct {
+	Type            string                 `json:"type"`
+	EventID         string                 `json:"eventID"`
+	EventTime       string                 `json:"eventTime"`
+	Action          string                 `json:"action"`
+	BizStep         string                 `json:"bizStep"`
+	Disposition     string                 `json:"disposition"`
+	EPCList         []string               `json:"epcList"`
+	ParentID        string                 `json:"parentID"`
+	ChildEPCs       []string               `json:"childEPCs"`
+	ReadPoint       *epcisLocation         `json:"readPoint"`
+	BizLocation     *epcisLocation         `json:"bizLocation"`
+	DestinationList []epcisDestination     `json:"destinationList"`
+	ILMD            map[string]interface{} `json:"ilmd"`
+}
+
+type epcisLocation struct {
+	ID string `json:"id"`
+}
+
+type epcisDestination struct {
+	Type        string `json:"type"`
+	Destination string `json:"destination"`
+}
+
+// EPCISAppliedEvent - how one EPCIS event was applied, Function is the chaincode function it was mapped to
+// and Keys are the products and SSCCs it was applied to
+type EPCISAppliedEvent struct {
+	Index    int      `json:"index"`
+	EventID  string   `json:"eventId,omitempty"`
+	Type     string   `json:"type"`
+	BizStep  string   `json:"bizStep,omitempty"`
+	Function string   `json:"function"`
+	Keys     []string `json:"keys"`
+}
+
+// EPCISCaptureResult - returned by captureEPCIS and the payload of the EPCISCaptured event
+type EPCISCaptureResult struct {
+	EventCount int                 `json:"eventCount"`
+	Applied    []EPCISAppliedEvent `json:"applied"`
+	TxID       string              `json:"txId"`
+}
+
+// epc - an EPC decoded from its EPC URI or GS1 Digital Link form, a GTIN and serial for an SGTIN,
+// or the SSCC of a container. Lot is only set by Digital Links that carry one
+type epc struct {
+	Gtin         string
+	SerialNumber string
+	Lot          string
+	Sscc         string
+}
+
+// cbvName - the bare name of a CBV value in any of its forms, e.g. "urn:epcglobal:cbv:bizstep:shipping",
+// "https://ref.gs1.org/cbv/BizStep-shipping" and "shipping" are all "shipping"
+func cbvName(value string) string {
+	name := value[strings.LastIndexAny(value, ":/")+1:]
+	if idx := strings.Index(name, "-"); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return name
+}
+
+// parseEPCURIParts - splits the part of an EPC URI after the scheme into its dot separated fields,
+// the first two are digits that together are digits long
+func parseEPCURIParts(value string, scheme string, fields int, digits int) ([]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(value, scheme), ".")
+	if len(parts) != fields || !isDigits(parts[0]) || len(parts[0])+len(parts[1]) != digits {
+		return nil, false
+	}
+	if len(parts[1]) > 0 && !isDigits(parts[1]) {
+		return nil, false
+	}
+	return parts, true
+}
+
+// withCheckDigit - digits followed by their GS1 check digit
+func withCheckDigit(digits string) string {
+	return digits + strconv.Itoa(gs1CheckDigit(digits))
+}
+
+// parseDigitalLink - the AI values in the path of a GS1 Digital Link URI, e.g. https://id.gs1.org/01/{gtin}/21/{serial}
+func parseDigitalLink(value string) (map[string]string, bool) {
+	link, err := url.Parse(value)
+	if err != nil || (link.Scheme != "https" && link.Scheme != "http") {
+		return nil, false
+	}
+	segments := strings.Split(strings.Trim(link.EscapedPath(), "/"), "/")
+	ais := map[string]string{}
+	// the primary key is at the end of any path prefix the resolver uses
+	for idx := len(segments) - 2; idx >= 0; idx -= 2 {
+		if !isDigits(segments[idx]) {
+			break
+		}
+		aiValue, err := url.PathUnescape(segments[idx+1])
+		if err != nil {
+			return nil, false
+		}
+		ais[segments[idx]] = aiValue
+	}
+	return ais, len(ais) > 0
+}
+
+// ============================================================================================================================
+// Parse EPC - decodes an SGTIN or SSCC in its EPC URI (urn:epc:id:sgtin:0614141.812345.6789) or GS1 Digital Link form
+// ============================================================================================================================
+func parseEPC(value string) (epc, error) {
+	var parsed epc
+	if strings.HasPrefix(value, "urn:epc:id:sgtin:") {
+		parts, ok := parseEPCURIParts(value, "urn:epc:id:sgtin:", 3, 13)
+		if ok && len(parts[1]) > 0 {
+			serial, err := url.PathUnescape(parts[2])
+			if err == nil && len(serial) > 0 {
+				parsed.Gtin = withCheckDigit(parts[1][:1] + parts[0] + parts[1][1:])
+				parsed.SerialNumber = serial
+				return parsed, nil
+			}
+		}
+		return parsed, errors.New("parseEPC: " + value + " is not an SGTIN EPC URI")
+	}
+	if strings.HasPrefix(value, "urn:epc:id:sscc:") {
+		parts, ok := parseEPCURIParts(value, "urn:epc:id:sscc:", 2, 17)
+		if !ok || len(parts[1]) == 0 {
+			return parsed, errors.New("parseEPC: " + value + " is not an SSCC EPC URI")
+		}
+		parsed.Sscc = withCheckDigit(parts[1][:1] + parts[0] + parts[1][1:])
+		return parsed, nil
+	}
+	if ais, ok := parseDigitalLink(value); ok {
+		if sscc, ok := ais["00"]; ok && isSscc(sscc) {
+			parsed.Sscc = sscc
+			return parsed, nil
+		}
+		gtin, ok := normalizeGtin(ais["01"])
+		if ok && len(ais["21"]) > 0 {
+			parsed.Gtin = gtin
+			parsed.SerialNumber = ais["21"]
+			parsed.Lot = ais["10"]
+			return parsed, nil
+		}
+	}
+	return parsed, errors.New("parseEPC: " + value + " is not an SGTIN or SSCC, expected an EPC URI or GS1 Digital Link")
+} // end of parseEPC
+
+// parseEPCISLocation - the GLN of an SGLN EPC URI (urn:epc:id:sgln:0614141.00777.0), a GS1 Digital Link with AI 414
+// or a plain 13 digit GLN, the extension is dropped
+func parseEPCISLocation(value string) (string, error) {
+	if strings.HasPrefix(value, "urn:epc:id:sgln:") {
+		if parts, ok := parseEPCURIParts(value, "urn:epc:id:sgln:", 3, 12); ok {
+			return withCheckDigit(parts[0] + parts[1]), nil
+		}
+	} else if len(value) == 13 && isDigits(value) {
+		return value, nil
+	} else if ais, ok := parseDigitalLink(value); ok && len(ais["414"]) == 13 && isDigits(ais["414"]) {
+		return ais["414"], nil
+	}
+	return "", errors.New("parseEPCISLocation: " + value + " is not an SGLN, expected an EPC URI, GS1 Digital Link or GLN")
+}
+
+// ============================================================================================================================
+// Transaction Cache Stub - a stub that reads its own writes and holds them until flush
+// ============================================================================================================================
+// Fabric doesn't return a transaction's own writes from GetState, so applying several EPCIS events to the same product
+// through the chaincode functions needs the writes of the earlier events. Nothing reaches the ledger until every event
+// has been applied, chaincode events set by the functions are dropped for the single summary event.
+type txCacheStub struct {
+	shim.ChaincodeStubInterface
+	writes  map[string][]byte
+	deleted map[string]bool
+}
+
+func newTxCacheStub(stub shim.ChaincodeStubInterface) *txCacheStub {
+	return &txCacheStub{ChaincodeStubInterface: stub, writes: map[string][]byte{}, deleted: map[string]bool{}}
+}
+
+// GetState - the value written earlier in the transaction, otherwise the ledger value
+func (stub *txCacheStub) GetState(key string) ([]byte, error) {
+	if stub.deleted[key] {
+		return nil, nil
+	}
+	if value, ok := stub.writes[key]; ok {
+		return value, nil
+	}
+	return stub.ChaincodeStubInterface.GetState(key)
+}
+
+// PutState - keeps the value until flush
+func (stub *txCacheStub) PutState(key string, value []byte) error {
+	if len(key) == 0 {
+		return errors.New("PutState: key must not be an empty string")
+	}
+	delete(stub.deleted, key)
+	stub.writes[key] = value
+	return nil
+}
+
+// DelState - keeps the delete until flush
+func (stub *txCacheStub) DelState(key string) error {
+	delete(stub.writes, key)
+	stub.deleted[key] = true
+	return nil
+}
+
+// SetEvent - dropped, captureEPCIS emits the event, see emitProductEvent
+func (stub *txCacheStub) SetEvent(name string, payload []byte) error {
+	return nil
+}
+
+// findKeys - the keys of objectType starting with attributes, both on the ledger and written in the transaction
+func (stub *txCacheStub) findKeys(objectType string, attributes []string) ([]string, error) {
+	found := map[string]bool{}
+	resultsIterator, err := stub.ChaincodeStubInterface.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		result, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !stub.deleted[result.Key] {
+			found[result.Key] = true
+		}
+	}
+	for key := range stub.writes {
+		keyType, keyAttributes, err := stub.SplitCompositeKey(key)
+		if err != nil || keyType != objectType || len(keyAttributes) < len(attributes) {
+			continue
+		}
+		matches := true
+		for idx, attribute := range attributes {
+			matches = matches && keyAttributes[idx] == attribute
+		}
+		if matches {
+			found[key] = true
+		}
+	}
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// flush - writes the cached writes and deletes to the ledger in key order
+func (stub *txCacheStub) flush() error {
+	keys := make([]string, 0, len(stub.writes)+len(stub.deleted))
+	for key := range stub.writes {
+		keys = append(keys, key)
+	}
+	for key := range stub.deleted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var err error
+		if stub.deleted[key] {
+			err = stub.ChaincodeStubInterface.DelState(key)
+		} else {
+			err = stub.ChaincodeStubInterface.PutState(key, stub.writes[key])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+} // end of flush
+
+// ============================================================================================================================
+// Capture EPCIS - passes a GS1 EPCIS 2.0 JSON-LD document, applies its ObjectEvents and AggregationEvents in order
+// ============================================================================================================================
+// Each event is mapped onto the chaincode function for it and runs with that function's rules and access policy:
+//   - ObjectEvent ADD commissions the SGTINs with createProduct, the lot and expiry come from the ilmd lotNumber
+//     and itemExpirationDate
+//   - ObjectEvent shipping ships the SGTINs or SSCCs with shipProduct to the destinationList location,
+//     with the bizLocation as the toLocation, receiving or accepting calls acceptShipment
+//   - other ObjectEvents update the SGTINs with updateProduct, recording the lifecycle event of the bizStep
+//   - AggregationEvent ADD and DELETE pack and unpack the childEPCs with aggregate and disaggregate,
+//     OBSERVE ships or receives the parentID
+//
+// The bizStep, disposition, readPoint and eventID are recorded in the "epcis" field of created, updated, shipped and
+// received products and the eventTime is their event_dt, the bizLocation is the GLN of created and updated products.
+// The document is applied atomically, if any event fails nothing is written.
+func (t *DataChainCode) captureEPCIS(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("captureEPCIS: enter")
+	defer fmt.Println("captureEPCIS: exit")
+
+	if len(args) != 1 {
+		errorString := "captureEPCIS: Incorrect number of arguments. Expecting 1, the EPCIS document"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	if len(args[0]) > MaxEPCISDocumentSizeAllowed {
+		errorString := "captureEPCIS: EPCIS document is " + strconv.Itoa(len(args[0])) + " bytes, at most " + strconv.Itoa(MaxEPCISDocumentSizeAllowed) + " are allowed"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	var document epcisDocument
+	if err := json.Unmarshal([]byte(args[0]), &document); err != nil {
+		errorString := "captureEPCIS: Error parsing EPCIS document - " + err.Error()
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	events := document.EPCISBody.EventList
+	if document.Type != "EPCISDocument" || len(events) == 0 {
+		errorString := "captureEPCIS: expected an EPCISDocument with at least one event in epcisBody.eventList"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	epcCount := 0
+	for _, event := range events {
+		epcCount += len(event.EPCList) + len(event.ChildEPCs)
+	}
+	if epcCount > MaxContainerItems {
+		errorString := "captureEPCIS: the document lists " + strconv.Itoa(epcCount) + " EPCs, at most " + strconv.Itoa(MaxContainerItems) + " can be captured in a transaction"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	cache := newTxCacheStub(stub)
+	result := EPCISCaptureResult{EventCount: len(events), Applied: []EPCISAppliedEvent{}, TxID: stub.GetTxID()}
+	for idx, event := range events {
+		applied, err := t.applyEPCISEvent(cache, event)
+		if err != nil {
+			errorString := "captureEPCIS: event " + strconv.Itoa(idx)
+			if len(event.EventID) > 0 {
+				errorString += " (" + event.EventID + ")"
+			}
+			errorString += " - " + err.Error()
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		for _, call := range applied {
+			call.Index = idx
+			result.Applied = append(result.Applied, call)
+		}
+	}
+	if err := cache.flush(); err != nil {
+		fmt.Println("captureEPCIS: Error writing to the ledger:", err)
+		return shim.Error(err.Error())
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.SetEvent(EPCISCapturedEvent, resultAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("captureEPCIS: result = ", string(resultAsBytes))
+	return shim.Success(resultAsBytes)
+} // end of captureEPCIS
+
+// epcisCall - a chaincode function call an EPCIS event maps onto, key is looked up from the EPC
+// after the call when the call creates the product. custody holds the event_dt and epcis details of
+// shipping and receiving events, recorded after the call as the custody functions don't take them
+type epcisCall struct {
+	function string
+	key      string
+	epc      epc
+	args     []string
+	custody  map[string]interface{}
+}
+
+// ============================================================================================================================
+// Apply EPCIS Event - maps an event onto chaincode function calls and makes them on the cache stub
+// ============================================================================================================================
+func (t *DataChainCode) applyEPCISEvent(stub *txCacheStub, event epcisEvent) ([]EPCISAppliedEvent, error) {
+	var calls []epcisCall
+	var err error
+	switch event.Type {
+	case EPCISObjectEvent:
+		calls, err = getObjectEventCalls(stub, event)
+	case EPCISAggregationEvent:
+		calls, err = getAggregationEventCalls(stub, event)
+	default:
+		err = errors.New("applyEPCISEvent: unsupported event type " + strconv.Quote(event.Type) + ", expected " + EPCISObjectEvent + " or " + EPCISAggregationEvent)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	functions := map[string]func(shim.ChaincodeStubInterface, []string) pb.Response{
+		"createProduct":  t.createProduct,
+		"updateProduct":  t.updateProduct,
+		"shipProduct":    t.shipProduct,
+		"acceptShipment": t.acceptShipment,
+		"aggregate":      t.aggregate,
+		"disaggregate":   t.disaggregate,
+	}
+	applied := []EPCISAppliedEvent{}
+	for _, call := range calls {
+		if err := checkAccess(stub, call.function); err != nil {
+			return nil, err
+		}
+		if call.function == "updateProduct" {
+			// the version is read here so it includes the earlier calls
+			product, err := getProduct(stub, call.key)
+			if err != nil {
+				return nil, err
+			}
+			call.args = append([]string{call.key, strconv.Itoa(product.Version)}, call.args...)
+		}
+		results := functions[call.function](stub, call.args)
+		if results.Status != shim.OK {
+			return nil, errors.New(results.Message)
+		}
+		if len(call.key) == 0 {
+			if call.key, err = getEPCKey(stub, call.epc); err != nil {
+				return nil, err
+			}
+		}
+		if call.custody != nil {
+			if err := recordCustodyEvent(stub, call.key, call.custody); err != nil {
+				return nil, err
+			}
+		}
+		last := len(applied) - 1
+		if last >= 0 && applied[last].Function == call.function {
+			applied[last].Keys = append(applied[last].Keys, call.key)
+			continue
+		}
+		applied = append(applied, EPCISAppliedEvent{
+			EventID:  event.EventID,
+			Type:     event.Type,
+			BizStep:  cbvName(event.BizStep),
+			Function: call.function,
+			Keys:     []string{call.key},
+		})
+	}
+	return applied, nil
+} // end of applyEPCISEvent
+
+// getObjectEventCalls - the calls for an ObjectEvent, one per EPC
+func getObjectEventCalls(stub *txCacheStub, event epcisEvent) ([]epcisCall, error) {
+	if len(event.EPCList) == 0 {
+		return nil, errors.New("getObjectEventCalls: the ObjectEvent has no epcList, quantityList isn't supported")
+	}
+	bizStep := cbvName(event.BizStep)
+	lifecycleEvent := epcisBizStepEvents[bizStep]
+	fields, err := getEPCISFields(event, event.Action != EPCISActionAdd)
+	if err != nil {
+		return nil, err
+	}
+
+	calls := []epcisCall{}
+	for _, value := range event.EPCList {
+		parsed, err := parseEPC(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(parsed.Sscc) > 0 && event.Action == EPCISActionAdd {
+			return nil, errors.New("getObjectEventCalls: containers are created by an AggregationEvent, can't commission " + value)
+		}
+
+		var call epcisCall
+		switch {
+		case event.Action == EPCISActionAdd:
+			call, err = getCommissionCall(event, parsed, lifecycleEvent, fields)
+		case event.Action == EPCISActionObserve && lifecycleEvent == ShipEvent:
+			call, err = getShipCall(stub, event, parsed)
+		case event.Action == EPCISActionObserve && lifecycleEvent == ReceiveEvent:
+			call, err = getReceiveCall(stub, event, parsed)
+		case event.Action == EPCISActionObserve || event.Action == EPCISActionDelete:
+			if len(parsed.Sscc) > 0 {
+				return nil, errors.New("getObjectEventCalls: only shipping and receiving are supported for the container " + value)
+			}
+			if len(lifecycleEvent) == 0 && event.Action == EPCISActionDelete {
+				lifecycleEvent = "decommission"
+			}
+			changes := map[string]interface{}{}
+			for name, fieldValue := range fields {
+				changes[name] = fieldValue
+			}
+			if len(lifecycleEvent) > 0 {
+				changes["event"] = lifecycleEvent
+			}
+			call.function = "updateProduct"
+			call.key, err = getEPCKey(stub, parsed)
+			if err == nil {
+				var changesAsBytes []byte
+				changesAsBytes, err = json.Marshal(changes)
+				call.args = []string{string(changesAsBytes)}
+			}
+		default:
+			err = errors.New("getObjectEventCalls: unsupported action " + strconv.Quote(event.Action) + ", expected ADD, OBSERVE or DELETE")
+		}
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+} // end of getObjectEventCalls
+
+// getAggregationEventCalls - the aggregate, disaggregate or custody call for an AggregationEvent
+func getAggregationEventCalls(stub *txCacheStub, event epcisEvent) ([]epcisCall, error) {
+	parent, err := parseEPC(event.ParentID)
+	if err != nil || len(parent.Sscc) == 0 {
+		return nil, errors.New("getAggregationEventCalls: parentID " + strconv.Quote(event.ParentID) + " is not an SSCC")
+	}
+	children := []string{}
+	for _, value := range event.ChildEPCs {
+		child, err := parseEPC(value)
+		if err != nil {
+			return nil, err
+		}
+		key, err := getEPCKey(stub, child)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, key)
+	}
+	childrenAsBytes, err := json.Marshal(children)
+	if err != nil {
+		return nil, err
+	}
+
+	call := epcisCall{key: parent.Sscc}
+	lifecycleEvent := epcisBizStepEvents[cbvName(event.BizStep)]
+	switch {
+	case event.Action == EPCISActionAdd:
+		if len(children) == 0 {
+			return nil, errors.New("getAggregationEventCalls: an ADD AggregationEvent needs childEPCs")
+		}
+		call.function = "aggregate"
+		call.args = []string{parent.Sscc, string(childrenAsBytes)}
+	case event.Action == EPCISActionDelete:
+		call.function = "disaggregate"
+		call.args = []string{parent.Sscc}
+		if len(children) > 0 {
+			call.args = append(call.args, string(childrenAsBytes))
+		}
+	case event.Action == EPCISActionObserve && lifecycleEvent == ShipEvent:
+		if call, err = getShipCall(stub, event, parent); err != nil {
+			return nil, err
+		}
+	case event.Action == EPCISActionObserve && lifecycleEvent == ReceiveEvent:
+		if call, err = getReceiveCall(stub, event, parent); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("getAggregationEventCalls: unsupported AggregationEvent action " + strconv.Quote(event.Action) + " with bizStep " + strconv.Quote(event.BizStep))
+	}
+	return []epcisCall{call}, nil
+} // end of getAggregationEventCalls
+
+// getShipCall - the shipProduct call for a shipping event, the receiving GLN is the location in the
+// destinationList, or the owning party when there is no location. The bizLocation is the toLocation
+func getShipCall(stub *txCacheStub, event epcisEvent, parsed epc) (epcisCall, error) {
+	call := epcisCall{function: "shipProduct"}
+	custody, err := getCustodyFields(event)
+	if err != nil {
+		return call, err
+	}
+	call.custody = custody
+	destination := ""
+	for _, entry := range event.DestinationList {
+		switch cbvName(entry.Type) {
+		case "location":
+			destination = entry.Destination
+		case "owning_party":
+			if len(destination) == 0 {
+				destination = entry.Destination
+			}
+		}
+	}
+	if len(destination) == 0 {
+		return call, errors.New("getShipCall: a shipping event needs a location or owning_party in its destinationList")
+	}
+	toGln, err := parseEPCISLocation(destination)
+	if err != nil {
+		return call, err
+	}
+	if call.key, err = getEPCKey(stub, parsed); err != nil {
+		return call, err
+	}
+	call.args = []string{call.key, toGln}
+	if event.BizLocation != nil && len(event.BizLocation.ID) > 0 {
+		call.args = append(call.args, event.BizLocation.ID)
+	}
+	return call, nil
+}
+
+// getReceiveCall - the acceptShipment call for a receiving or accepting event
+func getReceiveCall(stub *txCacheStub, event epcisEvent, parsed epc) (epcisCall, error) {
+	call := epcisCall{function: "acceptShipment"}
+	custody, err := getCustodyFields(event)
+	if err != nil {
+		return call, err
+	}
+	call.custody = custody
+	if call.key, err = getEPCKey(stub, parsed); err != nil {
+		return call, err
+	}
+	call.args = []string{call.key}
+	return call, nil
+}
+
+// getCustodyFields - the event_dt and epcis details of a shipping or receiving event, the GLNs come from the
+// shipment so the bizLocation isn't read as the GLN
+func getCustodyFields(event epcisEvent) (map[string]interface{}, error) {
+	withoutLocation := event
+	withoutLocation.BizLocation = nil
+	return getEPCISFields(withoutLocation, false)
+}
+
+// ============================================================================================================================
+// Record Custody Event - sets the event_dt and epcis details of a shipping or receiving event on the product, or on the
+// container and everything in it, after the custody function has written them with the transaction time
+// ============================================================================================================================
+func recordCustodyEvent(stub *txCacheStub, key string, fields map[string]interface{}) error {
+	member, err := getAggregationMember(stub, key)
+	if err != nil {
+		return err
+	}
+	members := []aggregationMember{member}
+	if member.container != nil {
+		contents, err := getContainerContents(stub, member.container)
+		if err != nil {
+			return err
+		}
+		members = append(members, contents...)
+	}
+	for _, member := range members {
+		if eventDate, ok := fields["event_dt"].(string); ok {
+			member.state.EventDate = eventDate
+		}
+		key := member.id
+		var memberAsBytes []byte
+		if member.container != nil {
+			// containers have no Data, only the event_dt is recorded on them
+			member.container.setState(member.state)
+			if key, err = getContainerKey(stub, member.id); err != nil {
+				return err
+			}
+			memberAsBytes, err = json.Marshal(member.container)
+		} else {
+			if member.state.Data == nil {
+				member.state.Data = map[string]interface{}{}
+			}
+			member.state.Data["epcis"] = fields["epcis"]
+			memberAsBytes, err = member.state.toBytes()
+		}
+		if err != nil {
+			return err
+		}
+		// the custody function already set the version and txId of the transaction
+		if err := stub.PutState(key, memberAsBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+} // end of recordCustodyEvent
+
+// getCommissionCall - the createProduct call for an SGTIN of an ADD ObjectEvent
+func getCommissionCall(event epcisEvent, parsed epc, lifecycleEvent string, fields map[string]interface{}) (epcisCall, error) {
+	call := epcisCall{function: "createProduct", epc: parsed}
+	if len(lifecycleEvent) == 0 {
+		lifecycleEvent = CommissionEvent
+	}
+	product := map[string]interface{}{
+		"gtin":     parsed.Gtin,
+		"serialNo": parsed.SerialNumber,
+		"lot":      parsed.Lot,
+		"event":    lifecycleEvent,
+	}
+	for name, value := range event.ILMD {
+		switch cbvName(name) {
+		case "lotNumber":
+			if lot, ok := value.(string); ok && len(parsed.Lot) == 0 {
+				product["lot"] = lot
+				call.epc.Lot = lot
+			}
+		case "itemExpirationDate":
+			product["expirationDate"] = value
+		}
+	}
+	for name, value := range fields {
+		product[name] = value
+	}
+	productAsBytes, err := json.Marshal(product)
+	if err != nil {
+		return call, err
+	}
+	// the key is only known once createProduct has normalized the expiry
+	call.args = []string{string(productAsBytes)}
+	return call, nil
+}
+
+// getEPCISFields - the product fields every created or updated product gets from the event. On updates, clear sets
+// the epcis details the event doesn't have to null so the merge doesn't leave those of an earlier event behind
+func getEPCISFields(event epcisEvent, clear bool) (map[string]interface{}, error) {
+	details := map[string]interface{}{}
+	if clear {
+		details = map[string]interface{}{"eventId": nil, "bizStep": nil, "disposition": nil, "readPoint": nil}
+	}
+	if len(event.EventID) > 0 {
+		details["eventId"] = event.EventID
+	}
+	if len(event.BizStep) > 0 {
+		details["bizStep"] = cbvName(event.BizStep)
+	}
+	if len(event.Disposition) > 0 {
+		details["disposition"] = cbvName(event.Disposition)
+	}
+	if event.ReadPoint != nil && len(event.ReadPoint.ID) > 0 {
+		details["readPoint"] = event.ReadPoint.ID
+		if gln, err := parseEPCISLocation(event.ReadPoint.ID); err == nil {
+			details["readPoint"] = gln
+		}
+	}
+	fields := map[string]interface{}{"epcis": details}
+	if len(event.EventTime) > 0 {
+		eventDate, err := normalizeTimestamp(event.EventTime)
+		if err != nil {
+			return nil, errors.New("getEPCISFields: eventTime " + strconv.Quote(event.EventTime) + " is not an ISO 8601 timestamp")
+		}
+		fields["event_dt"] = eventDate
+	}
+	if event.BizLocation != nil && len(event.BizLocation.ID) > 0 {
+		gln, err := parseEPCISLocation(event.BizLocation.ID)
+		if err != nil {
+			return nil, err
+		}
+		fields["gln"] = gln
+	}
+	return fields, nil
+} // end of getEPCISFields
+
+// getEPCKey - the SSCC of a container or the key of the product with the SGTIN, found by its gtin and serial
+// as the lot and expiry aren't part of an SGTIN
+func getEPCKey(stub *txCacheStub, parsed epc) (string, error) {
+	if len(parsed.Sscc) > 0 {
+		return parsed.Sscc, nil
+	}
+	attributes := []string{strings.ToLower(parsed.Gtin), parsed.SerialNumber}
+	if len(parsed.Lot) > 0 {
+		attributes = append(attributes, strings.ToLower(parsed.Lot))
+	}
+	keys, err := stub.findKeys(ProductObjectType, attributes)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", errors.New("getEPCKey: no product with gtin " + parsed.Gtin + " and serialNo " + parsed.SerialNumber + ", it has to be commissioned first")
+	}
+	if len(keys) > 1 {
+		return "", errors.New("getEPCKey: " + strconv.Itoa(len(keys)) + " products have gtin " + parsed.Gtin + " and serialNo " + parsed.SerialNumber + ", identify the lot with a GS1 Digital Link")
+	}
+	return keys[0], nil
+} // end of getEPCKey
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+// the manufacturer GLN of the EPCIS tests, the SGLN urn:epc:id:sgln:0614141.00001.0
+const testGlnEPCISManufacturer = "0614141000012"
+
+// testEPCISGtin - the GTIN of the SGTIN urn:epc:id:sgtin:0614141.812345.*
+const testEPCISGtin = "80614141123458"
+
+// newEPCISStub - the custody stub with the EPCIS manufacturer GLN registered to the manufacturer
+func newEPCISStub(t *testing.T) *shimtest.MockStub {
+	stub, _ := newCustodyStub(t)
+	registerTestGln(t, stub, testGlnEPCISManufacturer, "ManufacturerMSP")
+	setCreator(t, stub, "ManufacturerMSP", "user1")
+	takeEvents(stub)
+	return stub
+}
+
+// epcisDocumentJSON - an EPCIS 2.0 document with the events
+func epcisDocumentJSON(events ...string) []byte {
+	return []byte(`{"@context":["https://ref.gs1.org/standards/epcis/2.0.0/epcis-context.jsonld"],"type":"EPCISDocument",` +
+		`"schemaVersion":"2.0","creationDate":"2024-03-01T12:00:00Z","epcisBody":{"eventList":[` + strings.Join(events, ",") + `]}}`)
+}
+
+// commissionEventJSON - an ObjectEvent commissioning the serials of testEPCISGtin in lot
+func commissionEventJSON(lot string, serials ...string) string {
+	epcs := []string{}
+	for _, serial := range serials {
+		epcs = append(epcs, "urn:epc:id:sgtin:0614141.812345."+serial)
+	}
+	epcsAsBytes, _ := json.Marshal(epcs)
+	return `{"type":"ObjectEvent","eventID":"ni:///sha-256;commission-` + lot + `","eventTime":"2024-03-01T10:00:00.000+01:00",` +
+		`"eventTimeZoneOffset":"+01:00","epcList":` + string(epcsAsBytes) + `,"action":"ADD","bizStep":"commissioning",` +
+		`"disposition":"urn:epcglobal:cbv:disp:active","readPoint":{"id":"urn:epc:id:sgln:0614141.00001.1"},` +
+		`"bizLocation":{"id":"urn:epc:id:sgln:0614141.00001.0"},` +
+		`"ilmd":{"cbvmda:lotNumber":"` + lot + `","cbvmda:itemExpirationDate":"2099-12-31"}}`
+}
+
+// captureTestEPCIS - invokes captureEPCIS with a document of the events
+func captureTestEPCIS(stub *shimtest.MockStub, txID string, events ...string) (EPCISCaptureResult, pb.Response) {
+	var result EPCISCaptureResult
+	results := stub.MockInvoke(txID, [][]byte{[]byte("captureEPCIS"), epcisDocumentJSON(events...)})
+	json.Unmarshal(results.Payload, &result)
+	return result, results
+}
+
+func TestParseEPC(t *testing.T) {
+	fmt.Println("TestParseEPC: enter")
+	defer fmt.Println("TestParseEPC: exit")
+
+	parsed, err := parseEPC("urn:epc:id:sgtin:0614141.812345.A%2Fb1")
+	assert.Nil(t, err)
+	assert.Equal(t, epc{Gtin: testEPCISGtin, SerialNumber: "A/b1"}, parsed)
+	parsed, err = parseEPC("https://id.gs1.org/01/" + testEPCISGtin + "/10/LOT1/21/100")
+	assert.Nil(t, err)
+	assert.Equal(t, epc{Gtin: testEPCISGtin, SerialNumber: "100", Lot: "LOT1"}, parsed)
+	parsed, err = parseEPC("urn:epc:id:sscc:0614141.1000000001")
+	assert.Nil(t, err)
+	assert.Equal(t, testSsccCase1, parsed.Sscc)
+	parsed, err = parseEPC("https://example.com/resolver/00/" + testSsccCase1)
+	assert.Nil(t, err)
+	assert.Equal(t, testSsccCase1, parsed.Sscc)
+	for _, value := range []string{"urn:epc:id:sgtin:0614141.81234.100", "urn:epc:id:sgtin:0614141.812345", "urn:epc:class:lgtin:0614141.812345.LOT1",
+		"https://id.gs1.org/01/" + testEPCISGtin, "https://id.gs1.org/01/80614141123459/21/100", "100"} {
+		_, err = parseEPC(value)
+		assert.NotNil(t, err, value)
+	}
+
+	gln, err := parseEPCISLocation("urn:epc:id:sgln:0614141.00002.0")
+	assert.Nil(t, err)
+	assert.Equal(t, testGlnDistributor, gln)
+	gln, err = parseEPCISLocation("https://id.gs1.org/414/" + testGlnPharmacy + "/254/1")
+	assert.Nil(t, err)
+	assert.Equal(t, testGlnPharmacy, gln)
+	_, err = parseEPCISLocation("urn:epc:id:sgln:0614141.0002.0")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, "shipping", cbvName("urn:epcglobal:cbv:bizstep:shipping"))
+	assert.Equal(t, "in_transit", cbvName("https://ref.gs1.org/cbv/Disp-in_transit"))
+	assert.Equal(t, "lotNumber", cbvName("cbvmda:lotNumber"))
+} // end of TestParseEPC
+
+func TestCaptureEPCIS(t *testing.T) {
+	fmt.Println("TestCaptureEPCIS: enter")
+	defer fmt.Println("TestCaptureEPCIS: exit")
+
+	stub := newEPCISStub(t)
+	keys := []string{testProductKey(testEPCISGtin, "100", "lot1", "2099-12-31"), testProductKey(testEPCISGtin, "101", "lot1", "2099-12-31")}
+
+	// commission, pack and ship a case in one document, the later events see the products of the earlier ones
+	result, status := captureTestEPCIS(stub, "epcisTx1",
+		commissionEventJSON("LOT1", "100", "101"),
+		`{"type":"AggregationEvent","eventTime":"2024-03-01T11:00:00Z","parentID":"urn:epc:id:sscc:0614141.1000000001",`+
+			`"childEPCs":["urn:epc:id:sgtin:0614141.812345.100","https://id.gs1.org/01/`+testEPCISGtin+`/21/101"],"action":"ADD","bizStep":"packing"}`,
+		`{"type":"ObjectEvent","eventID":"ship-1","eventTime":"2024-03-01T12:00:00Z","epcList":["https://id.gs1.org/00/`+testSsccCase1+`"],"action":"OBSERVE",`+
+			`"bizStep":"urn:epcglobal:cbv:bizstep:shipping","disposition":"urn:epcglobal:cbv:disp:in_transit","bizLocation":{"id":"urn:epc:id:sgln:0614141.00002.1"},`+
+			`"destinationList":[{"type":"urn:epcglobal:cbv:sdt:owning_party","destination":"urn:epc:id:pgln:0614141.00002"},`+
+			`{"type":"urn:epcglobal:cbv:sdt:location","destination":"urn:epc:id:sgln:0614141.00002.0"}]}`)
+	assert.Equal(t, 200, int(status.Status), status.Message)
+	assert.Equal(t, 3, result.EventCount)
+	assert.Equal(t, []EPCISAppliedEvent{
+		{Index: 0, EventID: "ni:///sha-256;commission-LOT1", Type: EPCISObjectEvent, BizStep: "commissioning", Function: "createProduct", Keys: keys},
+		{Index: 1, Type: EPCISAggregationEvent, BizStep: "packing", Function: "aggregate", Keys: []string{testSsccCase1}},
+		{Index: 2, EventID: "ship-1", Type: EPCISObjectEvent, BizStep: "shipping", Function: "shipProduct", Keys: []string{testSsccCase1}},
+	}, result.Applied)
+	events := takeEvents(stub)
+	assert.Equal(t, 1, len(events), "one event for the document")
+	assert.Equal(t, EPCISCapturedEvent, events[0].EventName)
+
+	product, err := getProduct(stub, keys[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "LOT1", product.Lot)
+	assert.Equal(t, testGlnEPCISManufacturer, product.Gln)
+	assert.Equal(t, StatusInTransit, product.Status, "shipped with the case")
+	assert.Equal(t, testSsccCase1, product.Parent)
+	assert.Equal(t, "2024-03-01T12:00:00.000Z", product.EventDate, "the eventTime of the shipping event")
+	assert.Equal(t, "urn:epc:id:sgln:0614141.00002.1", product.ToLocation)
+	assert.Equal(t, map[string]interface{}{"eventId": "ship-1", "bizStep": "shipping", "disposition": "in_transit"}, product.Data["epcis"])
+	container := readTestContainer(t, stub, testSsccCase1)
+	assert.Equal(t, []string{keys[0], keys[1]}, container.Children)
+	assert.Equal(t, testGlnDistributor, container.Shipment.ToGln)
+	assert.Equal(t, "urn:epc:id:sgln:0614141.00002.1", container.ToLocation)
+	assert.Equal(t, "2024-03-01T12:00:00.000Z", container.EventDate)
+
+	// the distributor receives and unpacks the case and inspects a unit
+	setCreator(t, stub, "DistributorMSP", "user1")
+	result, status = captureTestEPCIS(stub, "epcisTx2",
+		`{"type":"ObjectEvent","eventTime":"2024-03-02T09:00:00Z","epcList":["urn:epc:id:sscc:0614141.1000000001"],"action":"OBSERVE","bizStep":"receiving"}`,
+		`{"type":"AggregationEvent","eventTime":"2024-03-02T10:00:00Z","parentID":"urn:epc:id:sscc:0614141.1000000001","action":"DELETE","bizStep":"unpacking"}`,
+		`{"type":"ObjectEvent","eventID":"inspect-1","eventTime":"2024-03-02T11:00:00Z","epcList":["urn:epc:id:sgtin:0614141.812345.100"],`+
+			`"action":"OBSERVE","bizStep":"inspecting","disposition":"active","bizLocation":{"id":"urn:epc:id:sgln:0614141.00002.0"}}`)
+	assert.Equal(t, 200, int(status.Status), status.Message)
+	assert.Equal(t, []string{"acceptShipment", "disaggregate", "updateProduct"},
+		[]string{result.Applied[0].Function, result.Applied[1].Function, result.Applied[2].Function})
+	product, _ = getProduct(stub, keys[1])
+	assert.Equal(t, map[string]interface{}{"bizStep": "receiving"}, product.Data["epcis"])
+	assert.Equal(t, "urn:epc:id:sgln:0614141.00002.1", product.Location, "the bizLocation of the shipping event")
+
+	product, _ = getProduct(stub, keys[0])
+	assert.Equal(t, testGlnDistributor, product.Gln)
+	assert.Equal(t, StatusActive, product.Status)
+	assert.Equal(t, UnpackEvent, product.Event, "inspecting isn't a lifecycle event")
+	assert.Equal(t, "", product.Parent)
+	assert.Equal(t, "2024-03-02T11:00:00.000Z", product.EventDate)
+	assert.Equal(t, map[string]interface{}{"eventId": "inspect-1", "bizStep": "inspecting", "disposition": "active"}, product.Data["epcis"])
+	product, _ = getProduct(stub, keys[1])
+	assert.Equal(t, testGlnDistributor, product.Gln)
+	assert.Equal(t, StatusActive, product.Status)
+} // end of TestCaptureEPCIS
+
+func TestCaptureEPCISIsAtomic(t *testing.T) {
+	fmt.Println("TestCaptureEPCISIsAtomic: enter")
+	defer fmt.Println("TestCaptureEPCISIsAtomic: exit")
+
+	stub := newEPCISStub(t)
+	key := testProductKey(testEPCISGtin, "200", "lot2", "2099-12-31")
+
+	// the second event ships a unit that was never commissioned
+	_, status := captureTestEPCIS(stub, "epcisTx1",
+		commissionEventJSON("LOT2", "200"),
+		`{"type":"ObjectEvent","eventID":"ship-1","eventTime":"2024-03-01T12:00:00Z","epcList":["urn:epc:id:sgtin:0614141.812345.999"],"action":"OBSERVE",`+
+			`"bizStep":"shipping","destinationList":[{"type":"location","destination":"`+testGlnDistributor+`"}]}`)
+	assert.Equal(t, 500, int(status.Status))
+	assert.Contains(t, status.Message, "event 1 (ship-1)")
+	assert.Contains(t, status.Message, "it has to be commissioned first")
+	productAsBytes, _ := stub.GetState(key)
+	assert.Equal(t, 0, len(productAsBytes), "nothing is written when an event fails")
+	assert.Equal(t, 0, len(takeEvents(stub)))
+
+	_, status = captureTestEPCIS(stub, "epcisTx2", commissionEventJSON("LOT2", "200"), commissionEventJSON("LOT2", "200"))
+	assert.Equal(t, 500, int(status.Status), "commissioned twice in the document")
+	assert.Contains(t, status.Message, "Product already exists")
+	_, status = captureTestEPCIS(stub, "epcisTx3", `{"type":"TransformationEvent","eventTime":"2024-03-01T12:00:00Z"}`)
+	assert.Equal(t, 500, int(status.Status), "unsupported event type")
+	_, status = captureTestEPCIS(stub, "epcisTx4")
+	assert.Equal(t, 500, int(status.Status), "no events")
+
+	// access policies of the mapped functions apply
+	setCreator(t, stub, "DistributorMSP", "user1")
+	_, status = captureTestEPCIS(stub, "epcisTx5", commissionEventJSON("LOT2", "200"))
+	assert.Equal(t, 500, int(status.Status), "the distributor doesn't hold the manufacturer GLN")
+	assert.Contains(t, status.Message, "is not registered to DistributorMSP")
+
+	setCreator(t, stub, "ManufacturerMSP", "user1")
+	_, status = captureTestEPCIS(stub, "epcisTx6", commissionEventJSON("LOT2", "200"))
+	assert.Equal(t, 200, int(status.Status), status.Message)
+	productAsBytes, _ = stub.GetState(key)
+	assert.NotEqual(t, 0, len(productAsBytes))
+} // end of TestCaptureEPCISIsAtomic
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ProductUpdatedEvent - the chaincode event for writes that don't record a known lifecycle event
+const ProductUpdatedEvent = "ProductUpdated"
+
+// productEventNames - the chaincode event emitted when a product moves to a new lifecycle event
+var productEventNames = map[string]string{
+	"commission":   "ProductCommissioned",
+	"pack":         "ProductPacked",
+	"unpack":       "ProductUnpacked",
+	ShipEvent:      "ProductShipped",
+	ReceiveEvent:   "ProductReceived",
+	RejectEvent:    "ProductShipmentRejected",
+	"dispense":     "ProductDispensed",
+	"decommission": "ProductDecommissioned",
+	RecallEvent:    "ProductRecalled",
+	"quarantine":   "ProductQuarantined",
+	"release":      "ProductReleased",
+	"return":       "ProductReturned",
+}
+
+// ProductEvent - payload of the product chaincode events
+type ProductEvent struct {
+	Key          string `json:"key"`
+	Gtin         string `json:"gtin"`
+	Lot          string `json:"lot"`
+	SerialNumber string `json:"serialNo"`
+	Event        string `json:"event"`
+	Status       string `json:"status"`
+	Gln          string `json:"gln"`
+	Version      int    `json:"version"`
+	TxID         string `json:"txId"`
+}
+
+// getProductEventName - the chaincode event name for a write, existing is nil when the product is created.
+// Events added by a custom lifecycle and writes that keep the event are ProductUpdated
+func getProductEventName(existing *Product, product Product) string {
+	if existing != nil && existing.Event == product.Event {
+		return ProductUpdatedEvent
+	}
+	if name, ok := productEventNames[product.Event]; ok {
+		return name
+	}
+	return ProductUpdatedEvent
+}
+
+// ============================================================================================================================
+// Emit Product Event - sets the chaincode event for a product write. Fabric keeps one event per transaction,
+// so a function writing several products emits a single summary event instead
+// ============================================================================================================================
+func emitProductEvent(stub shim.ChaincodeStubInterface, key string, existing *Product, product Product) error {
+	payload, err := json.Marshal(ProductEvent{
+		Key:          key,
+		Gtin:         product.Gtin,
+		Lot:          product.Lot,
+		SerialNumber: product.SerialNumber,
+		Event:        product.Event,
+		Status:       product.Status,
+		Gln:          product.Gln,
+		Version:      product.Version,
+		TxID:         product.TxID,
+	})
+	if err != nil {
+		return err
+	}
+	if err := stub.SetEvent(getProductEventName(existing, product), payload); err != nil {
+		return errors.New("emitProductEvent: Failed to set event - " + err.Error())
+	}
+	return nil
+} // end of emitProductEvent
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+// takeEvents - drains the events the mock stub has collected
+func takeEvents(stub *shimtest.MockStub) []*pb.ChaincodeEvent {
+	events := []*pb.ChaincodeEvent{}
+	for {
+		select {
+		case event := <-stub.ChaincodeEventsChannel:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// takeProductEvent - the single event of the last transaction and its payload
+func takeProductEvent(t *testing.T, stub *shimtest.MockStub) (string, ProductEvent) {
+	var payload ProductEvent
+	events := takeEvents(stub)
+	if !assert.Len(t, events, 1) {
+		return "", payload
+	}
+	assert.Nil(t, json.Unmarshal(events[0].Payload, &payload))
+	return events[0].EventName, payload
+}
+
+func TestProductEvents(t *testing.T) {
+	fmt.Println("TestProductEvents: enter")
+	defer fmt.Println("TestProductEvents: exit")
+
+	stub, key := newCustodyStub(t)
+	name, payload := takeProductEvent(t, stub)
+	assert.Equal(t, "ProductCommissioned", name)
+	assert.Equal(t, ProductEvent{Key: key, Gtin: "08806555018611", Lot: "M036191", SerialNumber: "1936800", Event: "commission", Status: StatusActive, Gln: "0300060000037", Version: 1, TxID: "createTx"}, payload)
+
+	results := stub.MockInvoke("updateTx1", [][]byte{[]byte("updateProduct"), []byte(key), []byte("1"), []byte(`{"tradename":"Gardasil"}`)})
+	assert.Equal(t, 200, int(results.Status), "updateProduct")
+	name, payload = takeProductEvent(t, stub)
+	assert.Equal(t, ProductUpdatedEvent, name)
+	assert.Equal(t, 2, payload.Version)
+
+	results = stub.MockInvoke("updateTx2", [][]byte{[]byte("updateProduct"), []byte(key), []byte("2"), []byte(`{"event":"quarantine"}`)})
+	assert.Equal(t, 200, int(results.Status), "updateProduct quarantine")
+	name, payload = takeProductEvent(t, stub)
+	assert.Equal(t, "ProductQuarantined", name)
+	assert.Equal(t, StatusQuarantined, payload.Status)
+	results = stub.MockInvoke("updateTx3", [][]byte{[]byte("updateProduct"), []byte(key), []byte("3"), []byte(`{"event":"release"}`)})
+	assert.Equal(t, 200, int(results.Status), "updateProduct release")
+	name, _ = takeProductEvent(t, stub)
+	assert.Equal(t, "ProductReleased", name)
+
+	results = stub.MockInvoke("shipTx", [][]byte{[]byte("shipProduct"), []byte(key), []byte(testGlnDistributor)})
+	assert.Equal(t, 200, int(results.Status), "shipProduct")
+	name, payload = takeProductEvent(t, stub)
+	assert.Equal(t, "ProductShipped", name)
+	assert.Equal(t, "shipTx", payload.TxID)
+
+	setCreator(t, stub, "DistributorMSP", "user1")
+	results = stub.MockInvoke("acceptTx", [][]byte{[]byte("acceptShipment"), []byte(key)})
+	assert.Equal(t, 200, int(results.Status), "acceptShipment")
+	name, payload = takeProductEvent(t, stub)
+	assert.Equal(t, "ProductReceived", name)
+	assert.Equal(t, testGlnDistributor, payload.Gln)
+
+	// failed writes don't emit
+	results = stub.MockInvoke("acceptTx2", [][]byte{[]byte("acceptShipment"), []byte(key)})
+	assert.Equal(t, 500, int(results.Status), "acceptShipment twice")
+	assert.Empty(t, takeEvents(stub))
+
+} // end of TestProductEvents
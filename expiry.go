@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// ExpiryDateFormat - expirationDate is stored as an ISO 8601 date so dates compare as strings
+const ExpiryDateFormat = "2006-01-02"
+
+// ShipEvent - the event that moves product out of a location
+const ShipEvent = "ship"
+
+// getTxTime - the transaction timestamp in UTC, every peer endorsing the transaction sees the same value
+func getTxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("getTxTime: Failed to get transaction timestamp - " + err.Error())
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC(), nil
+}
+
+// normalizeExpiryDate - parses MM/DD/YYYY, an ISO 8601 date or timestamp, or a GS1 YYMMDD date
+// and returns it in ExpiryDateFormat. now is used to pick the century of a YYMMDD date
+func normalizeExpiryDate(value string, now time.Time) (string, error) {
+	if len(value) == 6 && isDigits(value) {
+		return normalizeGS1Date(value, now)
+	}
+	for _, layout := range []string{"01/02/2006", "1/2/2006", ExpiryDateFormat, time.RFC3339Nano} {
+		if expiry, err := time.Parse(layout, value); err == nil {
+			return expiry.Format(ExpiryDateFormat), nil
+		}
+	}
+	return "", errors.New("normalizeExpiryDate: expected MM/DD/YYYY, YYYY-MM-DD or YYMMDD, got " + value)
+}
+
+// normalizeGS1Date - converts a GS1 YYMMDD date, a day of 00 means the last day of the month and
+// the century is chosen with the GS1 General Specifications sliding window relative to now
+func normalizeGS1Date(value string, now time.Time) (string, error) {
+	yy, _ := strconv.Atoi(value[0:2])
+	month, _ := strconv.Atoi(value[2:4])
+	day, _ := strconv.Atoi(value[4:6])
+
+	century := now.Year() / 100 * 100
+	diff := yy - now.Year()%100
+	if diff >= 51 {
+		century -= 100
+	} else if diff <= -50 {
+		century += 100
+	}
+	year := century + yy
+
+	if month < 1 || month > 12 {
+		return "", errors.New("normalizeGS1Date: invalid month in " + value)
+	}
+	lastDay := time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if day == 0 {
+		day = lastDay
+	}
+	if day > lastDay {
+		return "", errors.New("normalizeGS1Date: invalid day in " + value)
+	}
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).Format(ExpiryDateFormat), nil
+}
+
+// isExpired - true when the product's expiry date is before the day of now, a date that can't
+// be read is not treated as expired
+func isExpired(product Product, now time.Time) bool {
+	expiry, err := normalizeExpiryDate(product.ExpiryDate, now)
+	if err != nil {
+		return false
+	}
+	return expiry < now.Format(ExpiryDateFormat)
+}
+
+// checkExpiryPolicy - refuses to ship product that has already expired
+func checkExpiryPolicy(product Product, now time.Time) error {
+	if product.Event == ShipEvent && isExpired(product, now) {
+		return errors.New("checkExpiryPolicy: product expired on " + product.ExpiryDate + " and can not be shipped")
+	}
+	return nil
+}
+
+// =========================================================================================
+// queryProductsExpiringWithin queries for products expiring between the transaction date and
+// args[0] days after it, both inclusive, followed by the optional page size and bookmark
+// =========================================================================================
+func (t *DataChainCode) queryProductsExpiringWithin(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	fmt.Println("queryProductsExpiringWithin: enter")
+	defer fmt.Println("queryProductsExpiringWithin: exit")
+
+	if len(args) < 1 {
+		errorString := "queryProductsExpiringWithin: Incorrect number of arguments. Expecting 1, that is a number of days"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	days, err := strconv.Atoi(args[0])
+	if err != nil || days < 0 {
+		errorString := "queryProductsExpiringWithin: days must be an integer >= 0, got " + args[0]
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	from := now.Format(ExpiryDateFormat)
+	to := now.AddDate(0, 0, days).Format(ExpiryDateFormat)
+	return queryProductsByExpiryRange(stub, "queryProductsExpiringWithin", from, to, args[1:])
+} // end of queryProductsExpiringWithin
+
+// =========================================================================================
+// queryProductsByExpirationDate queries for products expiring from args[0] to args[1], both
+// inclusive, either can be "" but not both, followed by the optional page size and bookmark
+// =========================================================================================
+func (t *DataChainCode) queryProductsByExpirationDate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	fmt.Println("queryProductsByExpirationDate: enter")
+	defer fmt.Println("queryProductsByExpirationDate: exit")
+
+	if len(args) < 2 || (len(args[0]) == 0 && len(args[1]) == 0) {
+		errorString := "queryProductsByExpirationDate: Incorrect number of arguments. Expecting at least 2, from and to, one of them can be empty"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	bounds := []string{"", ""}
+	for idx := range bounds {
+		if len(args[idx]) == 0 {
+			continue
+		}
+		bounds[idx], err = normalizeExpiryDate(args[idx], now)
+		if err != nil {
+			fmt.Println(err)
+			return shim.Error("queryProductsByExpirationDate: " + err.Error())
+		}
+	}
+	return queryProductsByExpiryRange(stub, "queryProductsByExpirationDate", bounds[0], bounds[1], args[2:])
+} // end of queryProductsByExpirationDate
+
+// queryProductsByExpiryRange runs the rich query for products with from <= expirationDate <= to,
+// sorted by expirationDate, an empty bound is open
+func queryProductsByExpiryRange(stub shim.ChaincodeStubInterface, function string, from string, to string, pageArgs []string) pb.Response {
+	query := newProductQuery()
+	if len(from) > 0 {
+		query.Where(gte("expirationDate", from))
+	} else {
+		query.Where(gt("expirationDate", ""))
+	}
+	if len(to) > 0 {
+		query.Where(lte("expirationDate", to))
+	}
+	queryString, err := query.SortBy("expirationDate", false).UseIndex(expirationDateIndex).Build()
+	if err != nil {
+		fmt.Println(function+":, error building query = ", err)
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString, pageArgs)
+	if err != nil {
+		fmt.Println(function+":, error getting results = ", err)
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+} // end of queryProductsByExpiryRange
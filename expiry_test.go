@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeExpiryDate(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]string{
+		"10/10/2026":           "2026-10-10",
+		"1/2/2027":             "2027-01-02",
+		"2027-01-02":           "2027-01-02",
+		"2027-01-02T00:00:00Z": "2027-01-02",
+		"270102":               "2027-01-02",
+		"280200":               "2028-02-29", // day 00 is the last day of the month
+		"761231":               "2076-12-31", // within 50 years ahead stays in this century
+		"771231":               "1977-12-31", // 51 years ahead is the previous century
+	}
+	for input, expected := range tests {
+		expiry, err := normalizeExpiryDate(input, now)
+		assert.Nil(t, err, input)
+		assert.Equal(t, expected, expiry, input)
+	}
+
+	for _, input := range []string{"", "2027/01/02", "271301", "270230", "next year"} {
+		_, err := normalizeExpiryDate(input, now)
+		assert.NotNil(t, err, input)
+	}
+} // end of TestNormalizeExpiryDate
+
+func TestShipExpiredProductRejected(t *testing.T) {
+	fmt.Println("TestShipExpiredProductRejected: enter")
+	defer fmt.Println("TestShipExpiredProductRejected: exit")
+
+	stub := newPagedQueryStub(t)
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("01/02/2006")
+	today := time.Now().UTC().Format("01/02/2006")
+
+	expired := strings.Replace(strings.Replace(mockDevJson, `"expirationDate":"10/10/2026"`, `"expirationDate":"`+yesterday+`"`, 1), `"event":"commission"`, `"event":"ship"`, 1)
+	results := stub.MockInvoke("createTx1", [][]byte{[]byte("createProduct"), []byte(expired)})
+	assert.Equal(t, 500, int(results.Status), "ship expired product")
+	assert.Contains(t, results.Message, "can not be shipped")
+
+	// product expiring today can still ship
+	expiresToday := strings.Replace(mockDevJson, `"expirationDate":"10/10/2026"`, `"expirationDate":"`+today+`"`, 1)
+	results = stub.MockInvoke("createTx2", [][]byte{[]byte("createProduct"), []byte(expiresToday)})
+	assert.Equal(t, 200, int(results.Status), "commission product expiring today")
+	key := testProductKey("08806555018611", "1936800", "m036191", time.Now().UTC().Format("2006-01-02"))
+	registerTestGln(t, stub.MockStub, testGlnDistributor, "DistributorMSP")
+	setCreator(t, stub.MockStub, "ManufacturerMSP", "user1")
+	results = stub.MockInvoke("shipTx0", [][]byte{[]byte("shipProduct"), []byte(key), []byte(testGlnDistributor)})
+	assert.Equal(t, 200, int(results.Status), "ship product expiring today")
+
+	commissioned := strings.Replace(mockDevJson, `"expirationDate":"10/10/2026"`, `"expirationDate":"`+yesterday+`"`, 1)
+	results = stub.MockInvoke("createTx3", [][]byte{[]byte("createProduct"), []byte(commissioned)})
+	assert.Equal(t, 200, int(results.Status), "commission expired product")
+	key = testProductKey("08806555018611", "1936800", "m036191", time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02"))
+	results = stub.MockInvoke("shipTx1", [][]byte{[]byte("shipProduct"), []byte(key), []byte(testGlnDistributor)})
+	assert.Equal(t, 500, int(results.Status), "ship expired product")
+	assert.Contains(t, results.Message, "can not be shipped")
+} // end of TestShipExpiredProductRejected
+
+func TestQueryProductsExpiringWithin(t *testing.T) {
+	cc := new(DataChainCode)
+	stub := newPagedQueryStub(t)
+	createTestProducts(t, stub.MockStub, "S1")
+
+	_, results := invokeQuery(stub, stub.MockStub, cc.queryProductsExpiringWithin, "30", "10", "")
+	assert.Equal(t, 200, int(results.Status), "queryProductsExpiringWithin")
+	now, _ := getTxTime(stub)
+	var query map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(stub.queries[0]), &query))
+	assert.Equal(t, map[string]interface{}{
+		"docType":        map[string]interface{}{"$eq": "product-data"},
+		"expirationDate": map[string]interface{}{"$gte": now.Format("2006-01-02"), "$lte": now.AddDate(0, 0, 30).Format("2006-01-02")},
+	}, query["selector"])
+	assert.Equal(t, []interface{}{expirationDateIndex.DesignDoc, expirationDateIndex.Name}, query["use_index"])
+
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsExpiringWithin, "-1")
+	assert.Equal(t, 500, int(results.Status), "negative days")
+
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByExpirationDate, "10/01/2026", "261031")
+	assert.Equal(t, 200, int(results.Status), "queryProductsByExpirationDate")
+	assert.Contains(t, stub.queries[1], `"expirationDate":{"$gte":"2026-10-01","$lte":"2026-10-31"}`)
+} // end of TestQueryProductsExpiringWithin
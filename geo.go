@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// EarthRadiusKm - mean earth radius used by the haversine distance
+const EarthRadiusKm = 6371.0
+
+// KmPerDegreeLatitude - length of one degree of latitude
+const KmPerDegreeLatitude = 111.32
+
+// isValidLocation - true when latitude and longitude are within their legal ranges
+func isValidLocation(latitude float64, longitude float64) bool {
+	return latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180
+}
+
+// haversineKm - great circle distance between two points in km
+func haversineKm(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	toRadians := math.Pi / 180
+	dLat := (lat2 - lat1) * toRadians
+	dLon := (lon2 - lon1) * toRadians
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRadians)*math.Cos(lat2*toRadians)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// parseCoordinates - parses the float arguments of the geo queries
+func parseCoordinates(args []string, names []string) ([]float64, error) {
+	values := make([]float64, len(names))
+	for idx, name := range names {
+		value, err := strconv.ParseFloat(args[idx], 64)
+		if err != nil {
+			return nil, errors.New("parseCoordinates: " + name + " must be a number, got " + args[idx])
+		}
+		values[idx] = value
+	}
+	return values, nil
+}
+
+// boundingBoxConditions - selector conditions on loc_cd for a box, when minLon > maxLon the box
+// crosses the antimeridian and is split in two longitude ranges
+func boundingBoxConditions(minLat float64, minLon float64, maxLat float64, maxLon float64) []Condition {
+	conditions := []Condition{gte("loc_cd.lat", minLat), lte("loc_cd.lat", maxLat)}
+	if minLon <= maxLon {
+		return append(conditions, gte("loc_cd.lon", minLon), lte("loc_cd.lon", maxLon))
+	}
+	return append(conditions, or(
+		and(gte("loc_cd.lon", minLon), lte("loc_cd.lon", 180)),
+		and(gte("loc_cd.lon", -180), lte("loc_cd.lon", maxLon)),
+	))
+}
+
+// =========================================================================================
+// queryProductsInBoundingBox queries for products whose last event was inside the box
+// args are minLat, minLon, maxLat, maxLon followed by the optional page size and bookmark,
+// minLon greater than maxLon is a box crossing the antimeridian
+// =========================================================================================
+func (t *DataChainCode) queryProductsInBoundingBox(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	fmt.Println("queryProductsInBoundingBox: enter")
+	defer fmt.Println("queryProductsInBoundingBox: exit")
+
+	if len(args) < 4 {
+		errorString := "queryProductsInBoundingBox: Incorrect number of arguments. Expecting 4, minLat, minLon, maxLat and maxLon"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	box, err := parseCoordinates(args, []string{"minLat", "minLon", "maxLat", "maxLon"})
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	minLat, minLon, maxLat, maxLon := box[0], box[1], box[2], box[3]
+	if !isValidLocation(minLat, minLon) || !isValidLocation(maxLat, maxLon) || minLat > maxLat {
+		errorString := "queryProductsInBoundingBox: latitudes must be between -90 and 90 with minLat <= maxLat, longitudes between -180 and 180"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	queryString, err := newProductQuery().Where(boundingBoxConditions(minLat, minLon, maxLat, maxLon)...).UseIndex(locationIndex).Build()
+	if err != nil {
+		fmt.Println("queryProductsInBoundingBox:, error building query = ", err)
+		return shim.Error(err.Error())
+	}
+	queryResults, err := getQueryResultForQueryString(stub, queryString, args[4:])
+	if err != nil {
+		fmt.Println("queryProductsInBoundingBox:, error getting results = ", err)
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+} // end of queryProductsInBoundingBox
+
+// =========================================================================================
+// queryProductsWithinRadius queries for products whose last event was within km of a point
+// args are lat, lon and km followed by the optional page size and bookmark. CouchDB selects
+// the box around the circle and the corners are filtered out with the haversine distance, so
+// a page can hold fewer products than the page size while fetchedRecordsCount counts the box
+// =========================================================================================
+func (t *DataChainCode) queryProductsWithinRadius(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	fmt.Println("queryProductsWithinRadius: enter")
+	defer fmt.Println("queryProductsWithinRadius: exit")
+
+	if len(args) < 3 {
+		errorString := "queryProductsWithinRadius: Incorrect number of arguments. Expecting 3, lat, lon and km"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	point, err := parseCoordinates(args, []string{"lat", "lon", "km"})
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	lat, lon, km := point[0], point[1], point[2]
+	if !isValidLocation(lat, lon) || km <= 0 {
+		errorString := "queryProductsWithinRadius: lat must be between -90 and 90, lon between -180 and 180 and km > 0"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	// box around the circle, near the poles or for a very large radius every longitude is in range
+	dLat := km / KmPerDegreeLatitude
+	minLat, maxLat := math.Max(-90, lat-dLat), math.Min(90, lat+dLat)
+	minLon, maxLon := -180.0, 180.0
+	if minLat > -90 && maxLat < 90 {
+		dLon := km / (KmPerDegreeLatitude * math.Cos(lat*math.Pi/180))
+		if dLon < 180 {
+			minLon, maxLon = lon-dLon, lon+dLon
+			if minLon < -180 {
+				minLon += 360
+			}
+			if maxLon > 180 {
+				maxLon -= 360
+			}
+		}
+	}
+
+	queryString, err := newProductQuery().Where(boundingBoxConditions(minLat, minLon, maxLat, maxLon)...).UseIndex(locationIndex).Build()
+	if err != nil {
+		fmt.Println("queryProductsWithinRadius:, error building query = ", err)
+		return shim.Error(err.Error())
+	}
+	response, err := getQueryResponseForQueryString(stub, queryString, args[3:])
+	if err != nil {
+		fmt.Println("queryProductsWithinRadius:, error getting results = ", err)
+		return shim.Error(err.Error())
+	}
+
+	inRadius := []QueryRecord{}
+	for _, record := range response.Products {
+		var doc struct {
+			LocationInfo LocationData `json:"loc_cd"`
+		}
+		if err := json.Unmarshal(record.Record, &doc); err != nil {
+			return shim.Error(err.Error())
+		}
+		if haversineKm(lat, lon, doc.LocationInfo.Latitude, doc.LocationInfo.Longitude) <= km {
+			inRadius = append(inRadius, record)
+		}
+	}
+	response.Products = inRadius
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(responseAsBytes)
+} // end of queryProductsWithinRadius
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHaversineKm(t *testing.T) {
+	// Wilson, NC to Raleigh, NC is about 66 km
+	distance := haversineKm(35.721268, -77.915543, 35.779590, -78.638179)
+	assert.InDelta(t, 65.5, distance, 1)
+	assert.Equal(t, 0.0, haversineKm(10, 10, 10, 10))
+} // end of TestHaversineKm
+
+func TestLocationValidation(t *testing.T) {
+	stub := newPagedQueryStub(t)
+
+	productJSON := strings.Replace(mockDevJson, `"loc_cd":{"lat":35.721268,"lon":-77.915543}`, `"loc_cd":{"lat":135.7,"lon":-277.9}`, 1)
+	results := stub.MockInvoke("createTx1", [][]byte{[]byte("createProduct"), []byte(productJSON)})
+	assert.Equal(t, 500, int(results.Status), "createProduct out of range location")
+	assert.Contains(t, results.Message, `"field":"loc_cd.lat"`)
+	assert.Contains(t, results.Message, `"field":"loc_cd.lon"`)
+} // end of TestLocationValidation
+
+func TestQueryProductsInBoundingBox(t *testing.T) {
+	cc := new(DataChainCode)
+	stub := newPagedQueryStub(t)
+	createTestProducts(t, stub.MockStub, "S1")
+
+	response, results := invokeQuery(stub, stub.MockStub, cc.queryProductsInBoundingBox, "35", "-78", "36", "-77")
+	assert.Equal(t, 200, int(results.Status), "queryProductsInBoundingBox")
+	assert.Len(t, response.Products, 1)
+	assert.Contains(t, stub.queries[0], `"loc_cd.lat":{"$gte":35,"$lte":36}`)
+	assert.Contains(t, stub.queries[0], `"loc_cd.lon":{"$gte":-78,"$lte":-77}`)
+	assert.Contains(t, stub.queries[0], locationIndex.Name)
+
+	// crossing the antimeridian
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsInBoundingBox, "-20", "170", "-10", "-170")
+	assert.Equal(t, 200, int(results.Status), "queryProductsInBoundingBox antimeridian")
+	assert.Contains(t, stub.queries[1], `"$or":[{"$and":[{"loc_cd.lon":{"$gte":170}},{"loc_cd.lon":{"$lte":180}}]},{"$and":[{"loc_cd.lon":{"$gte":-180}},{"loc_cd.lon":{"$lte":-170}}]}]`)
+
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsInBoundingBox, "36", "-78", "35", "-77")
+	assert.Equal(t, 500, int(results.Status), "minLat > maxLat")
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsInBoundingBox, "35", "-78", "95", "-77")
+	assert.Equal(t, 500, int(results.Status), "latitude out of range")
+} // end of TestQueryProductsInBoundingBox
+
+func TestQueryProductsWithinRadius(t *testing.T) {
+	fmt.Println("TestQueryProductsWithinRadius: enter")
+	defer fmt.Println("TestQueryProductsWithinRadius: exit")
+
+	cc := new(DataChainCode)
+	stub := newPagedQueryStub(t)
+	createTestProducts(t, stub.MockStub, "S1")
+
+	// Raleigh is about 66 km from the product in Wilson
+	response, results := invokeQuery(stub, stub.MockStub, cc.queryProductsWithinRadius, "35.779590", "-78.638179", "70")
+	assert.Equal(t, 200, int(results.Status), "queryProductsWithinRadius 70 km")
+	assert.Len(t, response.Products, 1)
+
+	// the paged stub returns every product for any query, the haversine filter removes it
+	response, results = invokeQuery(stub, stub.MockStub, cc.queryProductsWithinRadius, "35.779590", "-78.638179", "60")
+	assert.Equal(t, 200, int(results.Status), "queryProductsWithinRadius 60 km")
+	assert.Len(t, response.Products, 0)
+	assert.Equal(t, int32(1), response.FetchedRecordsCount)
+
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsWithinRadius, "35.7", "-78.6", "0")
+	assert.Equal(t, 500, int(results.Status), "radius must be positive")
+} // end of TestQueryProductsWithinRadius
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// gs1FlagPrefix - prefix of the flags added by applyGS1Rules
+const gs1FlagPrefix = "gs1: "
+
+// gs1CheckDigit - computes the GS1 mod 10 check digit for the digits that precede it
+func gs1CheckDigit(digits string) int {
+	sum := 0
+	weight := 3
+	for idx := len(digits) - 1; idx >= 0; idx-- {
+		sum += int(digits[idx]-'0') * weight
+		weight = 4 - weight
+	}
+	return (10 - sum%10) % 10
+}
+
+// isDigits - true when value is non empty and only contains 0-9
+func isDigits(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// hasValidCheckDigit - true when the last digit of value is its GS1 check digit
+func hasValidCheckDigit(value string) bool {
+	if !isDigits(value) || len(value) < 2 {
+		return false
+	}
+	last := len(value) - 1
+	return gs1CheckDigit(value[:last]) == int(value[last]-'0')
+}
+
+// normalizeGtin - validates a GTIN-8/12/13/14 and returns it zero padded to 14 digits
+func normalizeGtin(gtin string) (string, bool) {
+	gtin = strings.TrimSpace(gtin)
+	switch len(gtin) {
+	case 8, 12, 13, 14:
+	default:
+		return gtin, false
+	}
+	if !hasValidCheckDigit(gtin) {
+		return gtin, false
+	}
+	return strings.Repeat("0", 14-len(gtin)) + gtin, true
+}
+
+// isValidGln - true for a 13 digit GLN with a valid check digit
+func isValidGln(gln string) bool {
+	return len(gln) == 13 && hasValidCheckDigit(gln)
+}
+
+// ============================================================================================================================
+// Apply GS1 Rules - checks the GTIN and GLNs on the product against the GS1 check digit rules
+// ============================================================================================================================
+// In strict mode bad identifiers are returned as a *ValidationError, in lenient mode they are
+// recorded in product.Flags and the product is accepted. checkGtin is false on updates since
+// the GTIN is part of the key and can't change. Empty GLNs are allowed.
+func applyGS1Rules(mode string, product *Product, checkGtin bool) error {
+	verr := newValidationError()
+
+	if checkGtin {
+		gtin, ok := normalizeGtin(product.Gtin)
+		if ok {
+			product.Gtin = gtin
+		} else {
+			verr.add("gtin", "GTIN-8, 12, 13 or 14 with a valid check digit", product.Gtin)
+		}
+	}
+	if len(product.Gln) > 0 && !isValidGln(product.Gln) {
+		verr.add("gln", "13 digit GLN with a valid check digit", product.Gln)
+	}
+	if len(product.ToGln) > 0 && !isValidGln(product.ToGln) {
+		verr.add("toGln", "13 digit GLN with a valid check digit", product.ToGln)
+	}
+
+	// flags always reflect the current record, clear the ones from previous checks
+	var flags []string
+	for _, flag := range product.Flags {
+		if !strings.HasPrefix(flag, gs1FlagPrefix) {
+			flags = append(flags, flag)
+		}
+	}
+	product.Flags = flags
+
+	if !verr.hasErrors() {
+		return nil
+	}
+	if mode == GS1ModeStrict {
+		return verr
+	}
+	for _, fieldErr := range verr.Fields {
+		product.Flags = append(product.Flags, gs1FlagPrefix+fieldErr.Field+" "+strconv.Quote(fieldErr.Got)+" is not a "+fieldErr.Expected)
+	}
+	return nil
+} // end of applyGS1Rules
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeGtin(t *testing.T) {
+	gtin, ok := normalizeGtin("08806555018611")
+	assert.True(t, ok)
+	assert.Equal(t, "08806555018611", gtin)
+
+	// GTIN-13, GTIN-12 and GTIN-8 are padded to 14 digits
+	gtin, ok = normalizeGtin("4006381333931")
+	assert.True(t, ok)
+	assert.Equal(t, "04006381333931", gtin)
+	gtin, ok = normalizeGtin("036000291452")
+	assert.True(t, ok)
+	assert.Equal(t, "00036000291452", gtin)
+	gtin, ok = normalizeGtin("96385074")
+	assert.True(t, ok)
+	assert.Equal(t, "00000096385074", gtin)
+
+	_, ok = normalizeGtin("08806555018612")
+	assert.False(t, ok, "bad check digit")
+	_, ok = normalizeGtin("0880655501861")
+	assert.False(t, ok, "bad check digit on 13 digits")
+	_, ok = normalizeGtin("880655501861A")
+	assert.False(t, ok, "non digit")
+	_, ok = normalizeGtin("123456789")
+	assert.False(t, ok, "bad length")
+} // end of TestNormalizeGtin
+
+func TestIsValidGln(t *testing.T) {
+	assert.True(t, isValidGln("0300060000034"))
+	assert.False(t, isValidGln("0300060000037"))
+	assert.False(t, isValidGln("030006000003"))
+} // end of TestIsValidGln
+
+func TestGS1LenientAndStrict(t *testing.T) {
+	fmt.Println("TestGS1LenientAndStrict: enter")
+	defer fmt.Println("TestGS1LenientAndStrict: exit")
+
+	// lenient is the default, the bad GLN in mockDevJson is flagged
+	stub := newTestStub(t)
+	results := stub.MockInvoke("createTx1", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 200, int(results.Status), "createProduct lenient")
+	product, err := getProduct(stub, mockDevKey)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		`gs1: gln "0300060000037" is not a 13 digit GLN with a valid check digit`,
+		`gs1: toGln "0300060000037" is not a 13 digit GLN with a valid check digit`,
+	}, product.Flags)
+
+	// fixing the GLNs clears the flags
+	registerTestGln(t, stub, "0300060000034", "ManufacturerMSP")
+	setCreator(t, stub, "ManufacturerMSP", "user1")
+	results = stub.MockInvoke("updateTx1", [][]byte{[]byte("updateProduct"), []byte(mockDevKey), []byte("1"), []byte(`{"gln":"0300060000034","toGln":"0300060000034"}`)})
+	assert.Equal(t, 200, int(results.Status), "updateProduct fixing GLNs")
+	product, _ = getProduct(stub, mockDevKey)
+	assert.Empty(t, product.Flags)
+
+	// strict mode rejects
+	stub = newTestStub(t)
+	results = stub.MockInit("initTx", [][]byte{[]byte("init"), []byte(`{"gs1Mode":"strict"}`)})
+	assert.Equal(t, 200, int(results.Status), "Init strict")
+	results = stub.MockInvoke("createTx2", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 500, int(results.Status), "createProduct strict")
+	assert.Contains(t, results.Message, `"field":"gln"`)
+
+	results = stub.MockInit("initTx2", [][]byte{[]byte("init"), []byte(`{"gs1Mode":"sometimes"}`)})
+	assert.Equal(t, 500, int(results.Status), "Init bad mode")
+} // end of TestGS1LenientAndStrict
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// HistoryTimestampFormat - history timestamps are RFC 3339 in UTC
+const HistoryTimestampFormat = time.RFC3339Nano
+
+// HistoryEntry - one committed write of a key, Value is null when the key was deleted
+type HistoryEntry struct {
+	TxID      string          `json:"txId"`
+	Timestamp string          `json:"timestamp"`
+	IsDelete  bool            `json:"isDelete"`
+	Value     json.RawMessage `json:"value"`
+	at        time.Time
+}
+
+// HistoryResponse - a page of the history of a key, pass Bookmark back in to get the next page, see getPageArgs
+type HistoryResponse struct {
+	Key                 string         `json:"key"`
+	Entries             []HistoryEntry `json:"entries"`
+	FetchedRecordsCount int32          `json:"fetchedRecordsCount"`
+	Bookmark            string         `json:"bookmark"`
+}
+
+// ============================================================================================================================
+// Get Key History - reads every committed write of key, oldest first
+// ============================================================================================================================
+// Fabric 2.x peers return the history newest first in the reverse of the commit order, so the list is reversed.
+// It isn't sorted by timestamp, the timestamps are set by the clients and skewed clocks would reorder the commits.
+func getKeyHistory(stub shim.ChaincodeStubInterface, key string) ([]HistoryEntry, error) {
+	resultsIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, errors.New("getKeyHistory: Failed to get history for " + displayKey(stub, key) + " - " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	entries := []HistoryEntry{}
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		entry := HistoryEntry{TxID: modification.TxId, IsDelete: modification.IsDelete}
+		if modification.Timestamp != nil {
+			entry.at = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC()
+		}
+		entry.Timestamp = entry.at.Format(HistoryTimestampFormat)
+		if !modification.IsDelete {
+			entry.Value = modification.Value
+			if !json.Valid(entry.Value) {
+				// not written by this chaincode, returned as a JSON string
+				if entry.Value, err = json.Marshal(string(modification.Value)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+} // end of getKeyHistory
+
+// parseHistoryTime - parses an RFC 3339 timestamp or a YYYY-MM-DD date, which is the start of that day in UTC
+func parseHistoryTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, ExpiryDateFormat} {
+		if at, err := time.Parse(layout, value); err == nil {
+			return at.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.New("parseHistoryTime: " + value + " is not an RFC 3339 timestamp or a YYYY-MM-DD date")
+}
+
+// ============================================================================================================================
+// Query Product History - returns the writes of a key oldest first, passes the key and optionally from and to,
+// "" to leave either open, followed by the optional page size and bookmark
+// ============================================================================================================================
+// Entries with from <= timestamp < to are returned. The bookmark is the txId of the last entry of the page,
+// pass the same from and to with it to get the next page.
+func (t *DataChainCode) queryProductHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("queryProductHistory: enter")
+	defer fmt.Println("queryProductHistory: exit")
+
+	response, _, err := getHistoryPage(stub, "queryProductHistory", args)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("queryProductHistory: returning", response.FetchedRecordsCount, "entries, bookmark = ", response.Bookmark)
+	return shim.Success(responseAsBytes)
+} // end of queryProductHistory
+
+// getHistoryPage - reads the page of history selected by the key, from, to, page size and bookmark args of
+// queryProductHistory, also returns the entry before the first one of the page, nil for the first write of the key
+func getHistoryPage(stub shim.ChaincodeStubInterface, function string, args []string) (HistoryResponse, *HistoryEntry, error) {
+	response := HistoryResponse{Entries: []HistoryEntry{}}
+	if len(args) < 1 || len(args) > 5 {
+		return response, nil, errors.New(function + ": Incorrect number of arguments. Expecting 1 to 5, key, from, to, page size and bookmark")
+	}
+	response.Key = args[0]
+	bounds := []time.Time{{}, {}}
+	for idx := range bounds {
+		if len(args) <= idx+1 || len(args[idx+1]) == 0 {
+			continue
+		}
+		var err error
+		if bounds[idx], err = parseHistoryTime(args[idx+1]); err != nil {
+			return response, nil, errors.New(function + ": " + err.Error())
+		}
+	}
+	from, to := bounds[0], bounds[1]
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return response, nil, errors.New(function + ": from must be before to")
+	}
+	var pageArgs []string
+	if len(args) > 3 {
+		pageArgs = args[3:]
+	}
+	pageSize, bookmark, err := getPageArgs(pageArgs)
+	if err != nil {
+		return response, nil, err
+	}
+
+	entries, err := getKeyHistory(stub, response.Key)
+	if err != nil {
+		return response, nil, err
+	}
+
+	var previous *HistoryEntry
+	started := len(bookmark) == 0
+	for idx, entry := range entries {
+		if (!from.IsZero() && entry.at.Before(from)) || (!to.IsZero() && !entry.at.Before(to)) {
+			continue
+		}
+		if !started {
+			started = entry.TxID == bookmark
+			continue
+		}
+		if int32(len(response.Entries)) == pageSize {
+			response.Bookmark = response.Entries[len(response.Entries)-1].TxID
+			break
+		}
+		if len(response.Entries) == 0 && idx > 0 {
+			previous = &entries[idx-1]
+		}
+		response.Entries = append(response.Entries, entry)
+	}
+	if !started {
+		return response, nil, errors.New(function + ": bookmark " + bookmark + " is not a transaction in the history of " + displayKey(stub, response.Key))
+	}
+	response.FetchedRecordsCount = int32(len(response.Entries))
+	return response, previous, nil
+} // end of getHistoryPage
+
+// field change kinds
+const (
+	FieldAdded    = "added"
+	FieldRemoved  = "removed"
+	FieldModified = "modified"
+)
+
+// changeIgnoredFields - bookkeeping fields that change on every write, the transaction is in ProductChanges
+var changeIgnoredFields = []string{"version", "txId"}
+
+// FieldChange - one field changed by a transaction, fields of nested objects are dotted, e.g. loc_cd.lat or
+// shipment.state. Fields the chaincode doesn't know are stored at the top level of the record so they appear under
+// their own name, e.g. temperature. OldValue is null for an added field and NewValue for a removed one
+type FieldChange struct {
+	Field    string      `json:"field"`
+	Change   string      `json:"change"`
+	OldValue interface{} `json:"oldValue"`
+	NewValue interface{} `json:"newValue"`
+}
+
+// ProductChanges - the fields changed by one write of a product
+type ProductChanges struct {
+	TxID      string        `json:"txId"`
+	Timestamp string        `json:"timestamp"`
+	IsDelete  bool          `json:"isDelete"`
+	Changes   []FieldChange `json:"changes"`
+}
+
+// ProductChangesResponse - a page of the changes of a key, pass Bookmark back in to get the next page, see getPageArgs
+type ProductChangesResponse struct {
+	Key                 string           `json:"key"`
+	Transactions        []ProductChanges `json:"transactions"`
+	FetchedRecordsCount int32            `json:"fetchedRecordsCount"`
+	Bookmark            string           `json:"bookmark"`
+}
+
+// ============================================================================================================================
+// Query Product Changes - returns the fields each write of a key added, removed or modified, oldest first,
+// passes the same key, from, to, page size and bookmark args as queryProductHistory
+// ============================================================================================================================
+// The first write of a key adds every field and a delete removes them. Objects, like data and loc_cd, are compared
+// field by field, arrays and other values as a whole.
+func (t *DataChainCode) queryProductChanges(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("queryProductChanges: enter")
+	defer fmt.Println("queryProductChanges: exit")
+
+	page, previous, err := getHistoryPage(stub, "queryProductChanges", args)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+
+	response := ProductChangesResponse{Key: page.Key, Transactions: []ProductChanges{}, FetchedRecordsCount: page.FetchedRecordsCount, Bookmark: page.Bookmark}
+	var oldValue json.RawMessage
+	if previous != nil {
+		oldValue = previous.Value
+	}
+	for _, entry := range page.Entries {
+		changes, err := diffJSONValues(oldValue, entry.Value)
+		if err != nil {
+			errorString := "queryProductChanges: Error comparing transaction " + entry.TxID + " - " + err.Error()
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		response.Transactions = append(response.Transactions, ProductChanges{TxID: entry.TxID, Timestamp: entry.Timestamp, IsDelete: entry.IsDelete, Changes: changes})
+		oldValue = entry.Value
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(responseAsBytes)
+} // end of queryProductChanges
+
+// diffJSONValues - the field changes from oldValue to newValue, either is empty or null when the key didn't exist
+func diffJSONValues(oldValue json.RawMessage, newValue json.RawMessage) ([]FieldChange, error) {
+	oldFields, err := flattenJSONValue(oldValue)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := flattenJSONValue(newValue)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range oldFields {
+		names = append(names, name)
+	}
+	for name := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []FieldChange{}
+	for _, name := range names {
+		if containsString(changeIgnoredFields, name) {
+			continue
+		}
+		oldField, inOld := oldFields[name]
+		newField, inNew := newFields[name]
+		switch {
+		case !inOld:
+			changes = append(changes, FieldChange{Field: name, Change: FieldAdded, NewValue: newField})
+		case !inNew:
+			changes = append(changes, FieldChange{Field: name, Change: FieldRemoved, OldValue: oldField})
+		case !reflect.DeepEqual(oldField, newField):
+			changes = append(changes, FieldChange{Field: name, Change: FieldModified, OldValue: oldField, NewValue: newField})
+		}
+	}
+	return changes, nil
+}
+
+// flattenJSONValue - the fields of a JSON value by dotted name, numbers are kept as written
+func flattenJSONValue(value json.RawMessage) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if len(value) == 0 {
+		return fields, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	if decoded == nil {
+		return fields, nil
+	}
+	if object, ok := decoded.(map[string]interface{}); ok {
+		flattenJSONObject("", object, fields)
+	} else {
+		fields["value"] = decoded
+	}
+	return fields, nil
+}
+
+// flattenJSONObject - adds the fields of object to fields, prefixed by prefix. Empty objects are kept as a field
+func flattenJSONObject(prefix string, object map[string]interface{}, fields map[string]interface{}) {
+	for name, value := range object {
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			flattenJSONObject(prefix+name+".", nested, fields)
+			continue
+		}
+		fields[prefix+name] = value
+	}
+}
+
+// ProductAsOf - the state of a key at a point in time and the transaction that wrote it,
+// Product is null when the key had been deleted
+type ProductAsOf struct {
+	Key       string          `json:"key"`
+	AsOf      string          `json:"asOf"`
+	TxID      string          `json:"txId"`
+	Timestamp string          `json:"timestamp"`
+	IsDelete  bool            `json:"isDelete"`
+	Product   json.RawMessage `json:"product"`
+}
+
+// ============================================================================================================================
+// Query Product As Of - returns a product as it was at a point in time, passes the key and an RFC 3339 timestamp or a
+// YYYY-MM-DD date, which is the start of that day in UTC
+// ============================================================================================================================
+// The state is the last write committed at or before the time, the response has its txId and timestamp.
+// It is an error when the key had not been written yet.
+func (t *DataChainCode) queryProductAsOf(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("queryProductAsOf: enter")
+	defer fmt.Println("queryProductAsOf: exit")
+
+	if len(args) != 2 {
+		errorString := "queryProductAsOf: Incorrect number of arguments. Expecting 2, key and timestamp"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	key := args[0]
+	asOf, err := parseHistoryTime(args[1])
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error("queryProductAsOf: " + err.Error())
+	}
+
+	entries, err := getKeyHistory(stub, key)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	var state *HistoryEntry
+	for idx := range entries {
+		if entries[idx].at.After(asOf) {
+			break
+		}
+		state = &entries[idx]
+	}
+	if state == nil {
+		errorString := "queryProductAsOf: " + displayKey(stub, key) + " had not been written as of " + asOf.Format(HistoryTimestampFormat)
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	response := ProductAsOf{
+		Key:       key,
+		AsOf:      asOf.Format(HistoryTimestampFormat),
+		TxID:      state.TxID,
+		Timestamp: state.Timestamp,
+		IsDelete:  state.IsDelete,
+		Product:   state.Value,
+	}
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(responseAsBytes)
+} // end of queryProductAsOf
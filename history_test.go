@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+// historyStub - the mock stub doesn't keep history, this one records the writes of every successful
+// invoke at the time it is given and returns them newest first like a Fabric 2.x peer
+type historyStub struct {
+	*shimtest.MockStub
+	history map[string][]*queryresult.KeyModification
+}
+
+func newHistoryStub(t *testing.T) *historyStub {
+	return &historyStub{MockStub: newTestStub(t), history: map[string][]*queryresult.KeyModification{}}
+}
+
+// invoke - MockInvoke committed at the time at, the keys it wrote are added to the history
+func (stub *historyStub) invoke(txID string, at time.Time, args ...string) pb.Response {
+	before := stub.snapshot()
+	byteArgs := [][]byte{}
+	for _, arg := range args {
+		byteArgs = append(byteArgs, []byte(arg))
+	}
+	results := stub.MockInvoke(txID, byteArgs)
+	if results.Status == shim.OK {
+		stub.record(txID, at, before)
+	}
+	return results
+}
+
+// deleteKey - deletes key in a transaction committed at the time at, the chaincode has no delete function
+func (stub *historyStub) deleteKey(txID string, at time.Time, key string) {
+	before := stub.snapshot()
+	stub.MockTransactionStart(txID)
+	stub.DelState(key)
+	stub.MockTransactionEnd(txID)
+	stub.record(txID, at, before)
+}
+
+func (stub *historyStub) snapshot() map[string][]byte {
+	state := map[string][]byte{}
+	for key, value := range stub.State {
+		state[key] = value
+	}
+	return state
+}
+
+// record - adds the keys changed since before to the history
+func (stub *historyStub) record(txID string, at time.Time, before map[string][]byte) {
+	ts := &timestamp.Timestamp{Seconds: at.Unix(), Nanos: int32(at.Nanosecond())}
+	for key, value := range stub.State {
+		if previous, ok := before[key]; !ok || string(previous) != string(value) {
+			stub.history[key] = append(stub.history[key], &queryresult.KeyModification{TxId: txID, Value: value, Timestamp: ts})
+		}
+	}
+	for key := range before {
+		if _, ok := stub.State[key]; !ok {
+			stub.history[key] = append(stub.history[key], &queryresult.KeyModification{TxId: txID, Timestamp: ts, IsDelete: true})
+		}
+	}
+}
+
+func (stub *historyStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	modifications := stub.history[key]
+	newestFirst := make([]*queryresult.KeyModification, len(modifications))
+	for idx, modification := range modifications {
+		newestFirst[len(modifications)-1-idx] = modification
+	}
+	return &sliceHistoryIterator{results: newestFirst}, nil
+}
+
+// sliceHistoryIterator - iterates over a fixed set of key modifications
+type sliceHistoryIterator struct {
+	results []*queryresult.KeyModification
+}
+
+func (iter *sliceHistoryIterator) HasNext() bool {
+	return len(iter.results) > 0
+}
+
+func (iter *sliceHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	if len(iter.results) == 0 {
+		return nil, errors.New("sliceHistoryIterator: no more results")
+	}
+	next := iter.results[0]
+	iter.results = iter.results[1:]
+	return next, nil
+}
+
+func (iter *sliceHistoryIterator) Close() error {
+	return nil
+}
+
+// invokeHistoryQuery - calls a history query function directly so the history stub is used
+func invokeHistoryQuery(stub *historyStub, query func(shim.ChaincodeStubInterface, []string) pb.Response, response interface{}, args ...string) pb.Response {
+	stub.MockTransactionStart("historyQueryTx")
+	results := query(stub, args)
+	stub.MockTransactionEnd("historyQueryTx")
+	if results.Status == shim.OK {
+		json.Unmarshal(results.Payload, response)
+	}
+	return results
+}
+
+// testHistoryTime - the commit time of the test transactions, day days after the first
+func testHistoryTime(day int) time.Time {
+	return time.Date(2024, time.March, 1+day, 12, 0, 0, 0, time.UTC)
+}
+
+// newProductHistory - creates mockDevJson and quarantines, releases and deletes it on the following days
+func newProductHistory(t *testing.T) *historyStub {
+	stub := newHistoryStub(t)
+	results := stub.invoke("createTx", testHistoryTime(0), "createProduct", mockDevJson)
+	assert.Equal(t, 200, int(results.Status), "createProduct")
+	results = stub.invoke("quarantineTx", testHistoryTime(1), "updateProduct", mockDevKey, "1", `{"event":"quarantine"}`)
+	assert.Equal(t, 200, int(results.Status), "quarantine")
+	results = stub.invoke("releaseTx", testHistoryTime(2), "updateProduct", mockDevKey, "2", `{"event":"release","data":{"note":"inspected"}}`)
+	assert.Equal(t, 200, int(results.Status), "release")
+	stub.deleteKey("deleteTx", testHistoryTime(3), mockDevKey)
+	return stub
+}
+
+func TestQueryProductHistory(t *testing.T) {
+	fmt.Println("TestQueryProductHistory: enter")
+	defer fmt.Println("TestQueryProductHistory: exit")
+
+	stub := newProductHistory(t)
+	cc := new(DataChainCode)
+
+	var response HistoryResponse
+	results := invokeHistoryQuery(stub, cc.queryProductHistory, &response, mockDevKey)
+	assert.Equal(t, 200, int(results.Status), "queryProductHistory")
+	assert.Equal(t, mockDevKey, response.Key)
+	assert.Equal(t, int32(4), response.FetchedRecordsCount)
+	assert.Equal(t, "", response.Bookmark)
+	txIDs := []string{}
+	for _, entry := range response.Entries {
+		txIDs = append(txIDs, entry.TxID)
+	}
+	assert.Equal(t, []string{"createTx", "quarantineTx", "releaseTx", "deleteTx"}, txIDs, "oldest first")
+	assert.Equal(t, "2024-03-01T12:00:00Z", response.Entries[0].Timestamp)
+	assert.False(t, response.Entries[0].IsDelete)
+	product, err := getProductFromJSON(response.Entries[1].Value)
+	assert.Nil(t, err)
+	assert.Equal(t, "quarantine", product.Event)
+	assert.True(t, response.Entries[3].IsDelete)
+	assert.Equal(t, "null", string(response.Entries[3].Value))
+
+	// from is inclusive and to exclusive
+	response = HistoryResponse{}
+	results = invokeHistoryQuery(stub, cc.queryProductHistory, &response, mockDevKey, "2024-03-02T12:00:00Z", "2024-03-04")
+	assert.Equal(t, 200, int(results.Status), "queryProductHistory from to")
+	assert.Equal(t, 2, len(response.Entries))
+	assert.Equal(t, "quarantineTx", response.Entries[0].TxID)
+	assert.Equal(t, "releaseTx", response.Entries[1].TxID)
+
+	// pages of 2 from the 2nd of March
+	response = HistoryResponse{}
+	results = invokeHistoryQuery(stub, cc.queryProductHistory, &response, mockDevKey, "2024-03-02", "", "2", "")
+	assert.Equal(t, 200, int(results.Status), "queryProductHistory page 1")
+	assert.Equal(t, 2, len(response.Entries))
+	assert.Equal(t, "releaseTx", response.Bookmark)
+	bookmark := response.Bookmark
+	response = HistoryResponse{}
+	results = invokeHistoryQuery(stub, cc.queryProductHistory, &response, mockDevKey, "2024-03-02", "", "2", bookmark)
+	assert.Equal(t, 200, int(results.Status), "queryProductHistory page 2")
+	assert.Equal(t, 1, len(response.Entries))
+	assert.Equal(t, "deleteTx", response.Entries[0].TxID)
+	assert.Equal(t, "", response.Bookmark)
+
+	results = invokeHistoryQuery(stub, cc.queryProductHistory, &response, mockDevKey, "", "", "2", "noSuchTx")
+	assert.Equal(t, 500, int(results.Status), "unknown bookmark")
+	results = invokeHistoryQuery(stub, cc.queryProductHistory, &response, mockDevKey, "2024-03-04", "2024-03-02")
+	assert.Equal(t, 500, int(results.Status), "from after to")
+	results = invokeHistoryQuery(stub, cc.queryProductHistory, &response, mockDevKey, "03/02/2024")
+	assert.Equal(t, 500, int(results.Status), "from is not RFC 3339")
+
+	response = HistoryResponse{}
+	results = invokeHistoryQuery(stub, cc.queryProductHistory, &response, "noSuchKey")
+	assert.Equal(t, 200, int(results.Status), "history of an unknown key")
+	assert.Equal(t, []HistoryEntry{}, response.Entries)
+} // end of TestQueryProductHistory
+
+func TestKeyHistoryKeepsCommitOrder(t *testing.T) {
+	fmt.Println("TestKeyHistoryKeepsCommitOrder: enter")
+	defer fmt.Println("TestKeyHistoryKeepsCommitOrder: exit")
+
+	// the client that quarantined the product has a clock a day behind
+	stub := newHistoryStub(t)
+	results := stub.invoke("createTx", testHistoryTime(1), "createProduct", mockDevJson)
+	assert.Equal(t, 200, int(results.Status), "createProduct")
+	results = stub.invoke("quarantineTx", testHistoryTime(0), "updateProduct", mockDevKey, "1", `{"event":"quarantine"}`)
+	assert.Equal(t, 200, int(results.Status), "quarantine")
+
+	entries, err := getKeyHistory(stub, mockDevKey)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "createTx", entries[0].TxID, "commit order, not timestamp order")
+	assert.Equal(t, "quarantineTx", entries[1].TxID)
+
+	var response ProductChangesResponse
+	results = invokeHistoryQuery(stub, new(DataChainCode).queryProductChanges, &response, mockDevKey)
+	assert.Equal(t, 200, int(results.Status), "queryProductChanges")
+	assert.Contains(t, response.Transactions[1].Changes, FieldChange{Field: "event", Change: FieldModified, OldValue: "commission", NewValue: "quarantine"})
+} // end of TestKeyHistoryKeepsCommitOrder
+
+func TestQueryProductChanges(t *testing.T) {
+	fmt.Println("TestQueryProductChanges: enter")
+	defer fmt.Println("TestQueryProductChanges: exit")
+
+	stub := newProductHistory(t)
+	cc := new(DataChainCode)
+
+	var response ProductChangesResponse
+	results := invokeHistoryQuery(stub, cc.queryProductChanges, &response, mockDevKey)
+	assert.Equal(t, 200, int(results.Status), "queryProductChanges")
+	assert.Equal(t, 4, len(response.Transactions))
+	created := response.Transactions[0]
+	assert.Equal(t, "createTx", created.TxID)
+	assert.Contains(t, created.Changes, FieldChange{Field: "loc_cd.lat", Change: FieldAdded, NewValue: 35.721268})
+	for _, change := range created.Changes {
+		assert.Equal(t, FieldAdded, change.Change, change.Field)
+		assert.NotEqual(t, "version", change.Field)
+	}
+	assert.Equal(t, []FieldChange{
+		{Field: "event", Change: FieldModified, OldValue: "commission", NewValue: "quarantine"},
+		{Field: "status", Change: FieldModified, OldValue: "active", NewValue: "quarantined"},
+	}, response.Transactions[1].Changes)
+	assert.Equal(t, []FieldChange{
+		{Field: "data.note", Change: FieldAdded, NewValue: "inspected"},
+		{Field: "event", Change: FieldModified, OldValue: "quarantine", NewValue: "release"},
+		{Field: "status", Change: FieldModified, OldValue: "quarantined", NewValue: "active"},
+	}, response.Transactions[2].Changes)
+	deleted := response.Transactions[3]
+	assert.True(t, deleted.IsDelete)
+	assert.Contains(t, deleted.Changes, FieldChange{Field: "data.note", Change: FieldRemoved, OldValue: "inspected"})
+
+	// the first change of a page is compared with the write before it
+	response = ProductChangesResponse{}
+	results = invokeHistoryQuery(stub, cc.queryProductChanges, &response, mockDevKey, "2024-03-03", "", "1", "")
+	assert.Equal(t, 200, int(results.Status), "queryProductChanges from")
+	assert.Equal(t, 1, len(response.Transactions))
+	assert.Equal(t, 3, len(response.Transactions[0].Changes))
+	assert.Equal(t, "releaseTx", response.Bookmark)
+} // end of TestQueryProductChanges
+
+func TestDiffJSONValues(t *testing.T) {
+	changes, err := diffJSONValues(json.RawMessage(`{"data":{"temp":"2C","seal":"ok"},"qty":10,"tags":["a"]}`), json.RawMessage(`{"data":{"temp":"8C"},"qty":10,"tags":["a","b"],"loc_cd":{}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []FieldChange{
+		{Field: "data.seal", Change: FieldRemoved, OldValue: "ok"},
+		{Field: "data.temp", Change: FieldModified, OldValue: "2C", NewValue: "8C"},
+		{Field: "loc_cd", Change: FieldAdded, NewValue: map[string]interface{}{}},
+		{Field: "tags", Change: FieldModified, OldValue: []interface{}{"a"}, NewValue: []interface{}{"a", "b"}},
+	}, changes)
+
+	_, err = diffJSONValues(nil, json.RawMessage(`{"qty":`))
+	assert.NotNil(t, err, "invalid JSON")
+}
+
+func TestQueryProductAsOf(t *testing.T) {
+	fmt.Println("TestQueryProductAsOf: enter")
+	defer fmt.Println("TestQueryProductAsOf: exit")
+
+	stub := newProductHistory(t)
+	cc := new(DataChainCode)
+
+	var response ProductAsOf
+	results := invokeHistoryQuery(stub, cc.queryProductAsOf, &response, mockDevKey, "2024-03-02T18:30:00+02:00")
+	assert.Equal(t, 200, int(results.Status), "queryProductAsOf")
+	assert.Equal(t, "2024-03-02T16:30:00Z", response.AsOf)
+	assert.Equal(t, "quarantineTx", response.TxID)
+	assert.Equal(t, "2024-03-02T12:00:00Z", response.Timestamp)
+	product, err := getProductFromJSON(response.Product)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusQuarantined, product.Status)
+	assert.Equal(t, "0300060000037", product.Gln)
+
+	// a write is part of the state at its own timestamp
+	response = ProductAsOf{}
+	results = invokeHistoryQuery(stub, cc.queryProductAsOf, &response, mockDevKey, "2024-03-03T12:00:00Z")
+	assert.Equal(t, 200, int(results.Status), "queryProductAsOf at a write")
+	assert.Equal(t, "releaseTx", response.TxID)
+
+	response = ProductAsOf{}
+	results = invokeHistoryQuery(stub, cc.queryProductAsOf, &response, mockDevKey, "2025-01-01")
+	assert.Equal(t, 200, int(results.Status), "queryProductAsOf after the delete")
+	assert.Equal(t, "deleteTx", response.TxID)
+	assert.True(t, response.IsDelete)
+	assert.Equal(t, "null", string(response.Product))
+
+	results = invokeHistoryQuery(stub, cc.queryProductAsOf, &response, mockDevKey, "2024-03-01")
+	assert.Equal(t, 500, int(results.Status), "before the product was created")
+	assert.Contains(t, results.Message, "had not been written")
+	results = invokeHistoryQuery(stub, cc.queryProductAsOf, &response, mockDevKey, "yesterday")
+	assert.Equal(t, 500, int(results.Status), "invalid timestamp")
+	results = invokeHistoryQuery(stub, cc.queryProductAsOf, &response, mockDevKey)
+	assert.Equal(t, 500, int(results.Status), "missing timestamp")
+} // end of TestQueryProductAsOf
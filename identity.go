@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// GlnObjectType - defines the GLN registration object type, also the composite key object type
+const GlnObjectType = "gln-data"
+
+// GlnNameObjectType - composite key object type of the index from registered names to GLNs
+const GlnNameObjectType = "gln-name"
+
+// GlnRegistration - the organization (MSP) a GLN belongs to
+type GlnRegistration struct {
+	DocType string `json:"docType"`
+	Gln     string `json:"gln"`
+	MSPID   string `json:"mspId"`
+	Name    string `json:"name,omitempty"`
+	TxID    string `json:"txId"`
+}
+
+// Submitter - the client that submitted a transaction
+type Submitter struct {
+	MSPID   string
+	Subject string
+}
+
+// getCallerMSP - the MSP ID of the client that submitted the transaction
+func getCallerMSP(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", errors.New("getCallerMSP: Failed to get the caller's MSP ID - " + err.Error())
+	}
+	return mspID, nil
+}
+
+// getSubmitter - the MSP ID and certificate subject of the client that submitted the transaction
+func getSubmitter(stub shim.ChaincodeStubInterface) (Submitter, error) {
+	mspID, err := getCallerMSP(stub)
+	if err != nil {
+		return Submitter{}, err
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return Submitter{}, errors.New("getSubmitter: Failed to get the caller's certificate - " + err.Error())
+	}
+	if cert == nil {
+		// idemix identities don't have a certificate
+		return Submitter{MSPID: mspID}, nil
+	}
+	return Submitter{MSPID: mspID, Subject: cert.Subject.String()}, nil
+}
+
+// ============================================================================================================================
+// Authorize Product Write - records the submitter on the product and checks the declared parties belong to the caller
+// ============================================================================================================================
+// The gln, where the product is, has to be registered to the caller's organization so only the holder can write
+// the product, both the stored and the new gln when it changes. The sender, a GLN or a registered name, is checked when it is set or changed. existing is nil when
+// the product is being created.
+func authorizeProductWrite(stub shim.ChaincodeStubInterface, existing *Product, product *Product) error {
+	submitter, err := getSubmitter(stub)
+	if err != nil {
+		return err
+	}
+	if existing != nil && len(existing.Gln) > 0 && existing.Gln != product.Gln {
+		// moving the product to another GLN, the caller has to hold it now as well
+		if err := checkPartyOwner(stub, submitter.MSPID, "gln", existing.Gln); err != nil {
+			return err
+		}
+	}
+	if len(product.Gln) > 0 {
+		if err := checkPartyOwner(stub, submitter.MSPID, "gln", product.Gln); err != nil {
+			return err
+		}
+	}
+	if len(product.Sender) > 0 && (existing == nil || product.Sender != existing.Sender) {
+		if err := checkPartyOwner(stub, submitter.MSPID, "sender", product.Sender); err != nil {
+			return err
+		}
+	}
+	product.SubmitterMSPID = submitter.MSPID
+	product.SubmitterSubject = submitter.Subject
+	return nil
+} // end of authorizeProductWrite
+
+// checkPartyOwner - party is a GLN or a name registered with registerGln, it has to belong to mspID
+func checkPartyOwner(stub shim.ChaincodeStubInterface, mspID string, field string, party string) error {
+	gln := party
+	if len(party) != 13 || !isDigits(party) {
+		key, err := stub.CreateCompositeKey(GlnNameObjectType, []string{strings.ToLower(party)})
+		if err != nil {
+			return err
+		}
+		glnAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return errors.New("checkPartyOwner: Failed to read name " + party + " - " + err.Error())
+		}
+		gln = string(glnAsBytes)
+	}
+	owner := ""
+	if len(gln) > 0 {
+		var err error
+		if owner, err = getGlnOwner(stub, gln); err != nil {
+			return err
+		}
+	}
+	if owner != mspID {
+		return errors.New("checkPartyOwner: " + field + " " + party + " is not registered to " + mspID)
+	}
+	return nil
+}
+
+// getGlnRegistration - the registration of gln, nil when the GLN isn't registered
+func getGlnRegistration(stub shim.ChaincodeStubInterface, gln string) (*GlnRegistration, error) {
+	key, err := stub.CreateCompositeKey(GlnObjectType, []string{gln})
+	if err != nil {
+		return nil, err
+	}
+	registrationAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("getGlnRegistration: Failed to read GLN " + gln + " - " + err.Error())
+	}
+	if len(registrationAsBytes) == 0 {
+		return nil, nil
+	}
+	var registration GlnRegistration
+	if err := json.Unmarshal(registrationAsBytes, &registration); err != nil {
+		return nil, errors.New("getGlnRegistration: Error with stored JSON format - " + err.Error())
+	}
+	return &registration, nil
+}
+
+// getGlnOwner - the MSP ID gln is registered to, "" when it isn't registered
+func getGlnOwner(stub shim.ChaincodeStubInterface, gln string) (string, error) {
+	registration, err := getGlnRegistration(stub, gln)
+	if err != nil || registration == nil {
+		return "", err
+	}
+	return registration.MSPID, nil
+}
+
+// ============================================================================================================================
+// Register GLN - registers a GLN to an organization, passes the GLN, the organization's MSP ID and an optional name
+// ============================================================================================================================
+// Only the adminMspIds in the config can register GLNs, so an organization can't claim a GLN that isn't its own.
+// A GLN can only be registered to one organization, registering it again to the same one changes the name.
+// Custody transfers use the registry to decide which organization can accept a shipment to a GLN, and
+// product writes use it to check the gln and sender belong to the caller. The name can be used as the sender.
+// The check digit is only enforced in strict gs1Mode, like on products.
+func (t *DataChainCode) registerGln(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("registerGln: enter")
+	defer fmt.Println("registerGln: exit")
+
+	if len(args) < 2 || len(args) > 3 {
+		errorString := "registerGln: Incorrect number of arguments. Expecting 2 or 3, the GLN, the MSP ID it belongs to and an optional name"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	if err := checkAdmin(stub, "registerGln", "register GLNs"); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	gln, mspID := args[0], args[1]
+	config, err := getConfig(stub)
+	if err != nil {
+		fmt.Println("registerGln: Error reading config:", err)
+		return shim.Error(err.Error())
+	}
+	if len(gln) != 13 || !isDigits(gln) || (config.GS1Mode == GS1ModeStrict && !isValidGln(gln)) {
+		errorString := "registerGln: " + gln + " is not a 13 digit GLN with a valid check digit"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	if len(mspID) == 0 {
+		errorString := "registerGln: the MSP ID the GLN belongs to is required"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	registration, err := getGlnRegistration(stub, gln)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if registration != nil && registration.MSPID != mspID {
+		errorString := "registerGln: GLN " + gln + " is already registered to " + registration.MSPID
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	previousName := ""
+	if registration != nil {
+		previousName = registration.Name
+	}
+	registration = &GlnRegistration{DocType: GlnObjectType, Gln: gln, MSPID: mspID, TxID: stub.GetTxID()}
+	if len(args) > 2 {
+		registration.Name = args[2]
+	}
+	if err := putGlnName(stub, gln, previousName, registration.Name); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	registrationAsBytes, err := json.Marshal(registration)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key, err := stub.CreateCompositeKey(GlnObjectType, []string{gln})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("registerGln: call putState, key = ", displayKey(stub, key))
+	if err := stub.PutState(key, registrationAsBytes); err != nil {
+		fmt.Println("registerGln: Error invoking on chaincode:", err)
+		return shim.Error(err.Error())
+	}
+	return shim.Success(registrationAsBytes)
+} // end of registerGln
+
+// putGlnName - moves the name index entry of gln from previousName to name, a name can only point to one GLN
+func putGlnName(stub shim.ChaincodeStubInterface, gln string, previousName string, name string) error {
+	if strings.ToLower(previousName) == strings.ToLower(name) {
+		return nil
+	}
+	if len(previousName) > 0 {
+		key, err := stub.CreateCompositeKey(GlnNameObjectType, []string{strings.ToLower(previousName)})
+		if err != nil {
+			return err
+		}
+		if err := stub.DelState(key); err != nil {
+			return err
+		}
+	}
+	if len(name) == 0 {
+		return nil
+	}
+	key, err := stub.CreateCompositeKey(GlnNameObjectType, []string{strings.ToLower(name)})
+	if err != nil {
+		return err
+	}
+	existingAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if len(existingAsBytes) > 0 && string(existingAsBytes) != gln {
+		return errors.New("putGlnName: name " + name + " is already used by GLN " + string(existingAsBytes))
+	}
+	return stub.PutState(key, []byte(gln))
+}
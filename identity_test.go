@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/attrmgr"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/stretchr/testify/assert"
+)
+
+// GLNs with valid check digits used by the tests
+const (
+	testGlnManufacturer = "0614141000012"
+	testGlnDistributor  = "0614141000029"
+	testGlnPharmacy     = "0861000000007"
+)
+
+// setCreator - makes the mock stub submit transactions as a client of mspID with a self signed certificate
+func setCreator(t *testing.T, stub *shimtest.MockStub, mspID string, commonName string) {
+	setCreatorWithAttributes(t, stub, mspID, commonName, nil)
+}
+
+// setCreatorWithAttributes - same as setCreator with Fabric CA attributes in the certificate
+func setCreatorWithAttributes(t *testing.T, stub *shimtest.MockStub, mspID string, commonName string, attrs map[string]string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{mspID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if attrs != nil {
+		attrsAsBytes, err := json.Marshal(attrmgr.Attributes{Attrs: attrs})
+		assert.Nil(t, err)
+		template.ExtraExtensions = []pkix.Extension{{Id: attrmgr.AttrOID, Value: attrsAsBytes}}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	creator, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+	})
+	assert.Nil(t, err)
+	stub.Creator = creator
+}
+
+// testAdminMSP - the admin organization of the test stubs, it registers the GLNs
+const testAdminMSP = "RegulatorMSP"
+
+// registerTestGln - registers gln to mspID as the admin organization, the caller sets the creator it needs next
+func registerTestGln(t *testing.T, stub *shimtest.MockStub, gln string, mspID string, name ...string) {
+	setCreator(t, stub, testAdminMSP, "admin")
+	args := [][]byte{[]byte("registerGln"), []byte(gln), []byte(mspID)}
+	for _, n := range name {
+		args = append(args, []byte(n))
+	}
+	results := stub.MockInvoke("gln"+gln, args)
+	assert.Equal(t, 200, int(results.Status), "registerGln "+gln)
+}
+
+// newTestStub - a stub submitting as ManufacturerMSP, which owns the gln and sender of mockDevJson
+func newTestStub(t *testing.T) *shimtest.MockStub {
+	stub := shimtest.NewMockStub("mockStub", new(DataChainCode))
+	results := stub.MockInit("initTx", [][]byte{[]byte("init"), []byte(`{"adminMspIds":["` + testAdminMSP + `"]}`)})
+	assert.Equal(t, 200, int(results.Status), "Init admins")
+	registerTestGln(t, stub, "0300060000037", "ManufacturerMSP", "manufacturer")
+	setCreator(t, stub, "ManufacturerMSP", "user1")
+	return stub
+}
+
+func TestRegisterGln(t *testing.T) {
+	stub := shimtest.NewMockStub("mockStub", new(DataChainCode))
+
+	// without an identity the caller can't be known
+	results := stub.MockInvoke("glnTx1", [][]byte{[]byte("registerGln"), []byte(testGlnManufacturer), []byte("ManufacturerMSP")})
+	assert.Equal(t, 500, int(results.Status), "registerGln without identity")
+
+	// until admins are configured nobody can register GLNs
+	setCreator(t, stub, "ManufacturerMSP", "user1")
+	results = stub.MockInvoke("glnTx2", [][]byte{[]byte("registerGln"), []byte(testGlnManufacturer), []byte("ManufacturerMSP")})
+	assert.Equal(t, 500, int(results.Status), "registerGln without admins")
+	results = stub.MockInit("initTx", [][]byte{[]byte("init"), []byte(`{"adminMspIds":["` + testAdminMSP + `"]}`)})
+	assert.Equal(t, 200, int(results.Status), "Init admins")
+
+	// an organization can't claim a GLN for itself
+	results = stub.MockInvoke("glnTx3", [][]byte{[]byte("registerGln"), []byte(testGlnManufacturer), []byte("ManufacturerMSP")})
+	assert.Equal(t, 500, int(results.Status), "registerGln by a non-admin")
+	assert.Contains(t, results.Message, "only the admin organizations")
+
+	setCreator(t, stub, testAdminMSP, "admin")
+	results = stub.MockInvoke("glnTx4", [][]byte{[]byte("registerGln"), []byte(testGlnManufacturer), []byte("ManufacturerMSP"), []byte("Plant 1")})
+	assert.Equal(t, 200, int(results.Status), "registerGln")
+	owner, err := getGlnOwner(stub, testGlnManufacturer)
+	assert.Nil(t, err)
+	assert.Equal(t, "ManufacturerMSP", owner)
+
+	results = stub.MockInvoke("glnTx5", [][]byte{[]byte("registerGln"), []byte(testGlnManufacturer), []byte("ManufacturerMSP"), []byte("Plant One")})
+	assert.Equal(t, 200, int(results.Status), "registerGln rename")
+
+	results = stub.MockInvoke("glnTx6", [][]byte{[]byte("registerGln"), []byte(testGlnManufacturer), []byte("DistributorMSP")})
+	assert.Equal(t, 500, int(results.Status), "registerGln owned by another organization")
+	assert.Contains(t, results.Message, "already registered to ManufacturerMSP")
+
+	results = stub.MockInvoke("glnTx7", [][]byte{[]byte("registerGln"), []byte("061414100001A"), []byte("DistributorMSP")})
+	assert.Equal(t, 500, int(results.Status), "registerGln not a GLN")
+	results = stub.MockInvoke("glnTx8", [][]byte{[]byte("registerGln"), []byte(testGlnDistributor), []byte("DistributorMSP"), []byte("plant one")})
+	assert.Equal(t, 500, int(results.Status), "registerGln with a name used by another GLN")
+	results = stub.MockInvoke("glnTx9", [][]byte{[]byte("registerGln"), []byte(testGlnDistributor)})
+	assert.Equal(t, 500, int(results.Status), "registerGln without the MSP ID")
+	results = stub.MockInit("initTx2", [][]byte{[]byte("init"), []byte(`{"gs1Mode":"strict"}`)})
+	assert.Equal(t, 200, int(results.Status), "Init strict")
+	results = stub.MockInvoke("glnTx10", [][]byte{[]byte("registerGln"), []byte("0614141000013"), []byte("DistributorMSP")})
+	assert.Equal(t, 500, int(results.Status), "registerGln bad check digit in strict mode")
+
+	owner, err = getGlnOwner(stub, testGlnDistributor)
+	assert.Nil(t, err)
+	assert.Equal(t, "", owner)
+} // end of TestRegisterGln
+
+func TestProductWriteAuthorization(t *testing.T) {
+	stub := newTestStub(t)
+
+	registerTestGln(t, stub, testGlnDistributor, "DistributorMSP", "distributor")
+	setCreator(t, stub, "DistributorMSP", "user2")
+	results := stub.MockInvoke("createTx1", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 500, int(results.Status), "createProduct at another organization's GLN")
+	assert.Contains(t, results.Message, "gln 0300060000037 is not registered to DistributorMSP")
+
+	setCreator(t, stub, "ManufacturerMSP", "user1")
+	unknownSender := strings.Replace(mockDevJson, `"sender":"manufacturer"`, `"sender":"distributor"`, 1)
+	results = stub.MockInvoke("createTx2", [][]byte{[]byte("createProduct"), []byte(unknownSender)})
+	assert.Equal(t, 500, int(results.Status), "createProduct with another organization's sender")
+	assert.Contains(t, results.Message, "sender distributor is not registered to ManufacturerMSP")
+
+	results = stub.MockInvoke("createTx3", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 200, int(results.Status), "createProduct")
+	product, _ := getProduct(stub, mockDevKey)
+	assert.Equal(t, "ManufacturerMSP", product.SubmitterMSPID)
+	assert.Equal(t, "CN=user1,O=ManufacturerMSP", product.SubmitterSubject)
+
+	// the submitter is set by the chaincode
+	results = stub.MockInvoke("updateTx1", [][]byte{[]byte("updateProduct"), []byte(mockDevKey), []byte("1"), []byte(`{"submitterMspId":"DistributorMSP"}`)})
+	assert.Equal(t, 500, int(results.Status), "updateProduct submitter")
+
+	// only the holder of the product can update it
+	setCreator(t, stub, "DistributorMSP", "user2")
+	results = stub.MockInvoke("updateTx2", [][]byte{[]byte("updateProduct"), []byte(mockDevKey), []byte("1"), []byte(`{"event":"quarantine"}`)})
+	assert.Equal(t, 500, int(results.Status), "updateProduct by another organization")
+	results = stub.MockInvoke("updateTx3", [][]byte{[]byte("updateProduct"), []byte(mockDevKey), []byte("1"), []byte(`{"gln":"` + testGlnDistributor + `"}`)})
+	assert.Equal(t, 500, int(results.Status), "updateProduct moving the product to the caller's GLN")
+
+	registerTestGln(t, stub, testGlnManufacturer, "ManufacturerMSP")
+	setCreator(t, stub, "ManufacturerMSP", "user1")
+	results = stub.MockInvoke("updateTx4", [][]byte{[]byte("updateProduct"), []byte(mockDevKey), []byte("1"), []byte(`{"event":"quarantine","sender":"` + testGlnManufacturer + `"}`)})
+	assert.Equal(t, 200, int(results.Status), "updateProduct by the holder")
+} // end of TestProductWriteAuthorization
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// compositeKeyNamespace - composite keys start with this character, simple keys never do
+const compositeKeyNamespace = "\x00"
+
+// ProductKeysMigratedEvent - chaincode event emitted by migrateProductKeys, the payload is the MigrationResult
+const ProductKeysMigratedEvent = "ProductKeysMigrated"
+
+// MigrationResult - returned by migrateProductKeys
+type MigrationResult struct {
+	Migrated  int      `json:"migrated"`
+	Conflicts []string `json:"conflicts"`
+	Remaining bool     `json:"remaining"`
+}
+
+// ============================================================================================================================
+// Migrate Product Keys - moves products stored under the old concatenated keys to composite keys
+// ============================================================================================================================
+// takes an optional argument, the max products to move in this transaction (default and max MaxProductItems),
+// call again until remaining is false. A product whose composite key is already taken is left in place
+// and reported as a conflict. History stays with the old key, the moved record starts a new history.
+// The GTIN and expiration date are normalized the same way as on create so the new key matches readProduct.
+// Only the adminMspIds in the config can migrate keys as it rewrites every organization's products.
+func (t *DataChainCode) migrateProductKeys(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("migrateProductKeys: enter")
+	defer fmt.Println("migrateProductKeys: exit")
+
+	if err := checkAdmin(stub, "migrateProductKeys", "migrate product keys"); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+
+	maxitems := MaxProductItems
+	if len(args) > 0 {
+		i, err := strconv.Atoi(args[0])
+		if err != nil || i < 1 || i > MaxProductItems {
+			errorString := "migrateProductKeys: maxitems must be an integer between 1 and " + strconv.Itoa(MaxProductItems) + ", got " + args[0]
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		maxitems = i
+	}
+
+	// an open range only returns simple keys, the old product keys and the config
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		fmt.Println("migrateProductKeys: Error getting range:", err)
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println("migrateProductKeys: Error getting transaction time:", err)
+		return shim.Error(err.Error())
+	}
+
+	result := MigrationResult{Conflicts: []string{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if strings.HasPrefix(queryResponse.Key, compositeKeyNamespace) || !isProductRecord(queryResponse.Value) {
+			continue
+		}
+		if result.Migrated >= maxitems {
+			result.Remaining = true
+			break
+		}
+
+		product, err := getProductFromJSON(queryResponse.Value)
+		if err != nil {
+			fmt.Println("migrateProductKeys: Error with stored JSON format, key = ", displayKey(stub, queryResponse.Key), err)
+			return shim.Error(err.Error())
+		}
+		if gtin, ok := normalizeGtin(product.Gtin); ok {
+			product.Gtin = gtin
+		}
+		if expiry, err := normalizeExpiryDate(product.ExpiryDate, now); err == nil {
+			product.ExpiryDate = expiry
+		}
+		productAsBytes, err := product.toBytes()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		key, err := getProductKey(stub, product)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		existingAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(existingAsBytes) > 0 {
+			fmt.Println("migrateProductKeys: composite key already exists, skipping key = ", displayKey(stub, queryResponse.Key))
+			result.Conflicts = append(result.Conflicts, queryResponse.Key)
+			continue
+		}
+
+		fmt.Println("migrateProductKeys: moving key = ", displayKey(stub, queryResponse.Key))
+		if err := stub.PutState(key, productAsBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := putLotIndex(stub, key); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.DelState(queryResponse.Key); err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Migrated++
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if result.Migrated > 0 {
+		// a summary event, see emitProductEvent
+		if err := stub.SetEvent(ProductKeysMigratedEvent, resultAsBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	fmt.Println("migrateProductKeys: result = ", string(resultAsBytes))
+	return shim.Success(resultAsBytes)
+} // end of migrateProductKeys
+
+// displayKey - a composite key as its attributes separated by "/", e.g. gtin/serial/lot/expiry for a product key,
+// the U+0000 separators of the raw key make errors and logs binary. Other keys are returned as they are
+func displayKey(stub shim.ChaincodeStubInterface, key string) string {
+	if !strings.HasPrefix(key, compositeKeyNamespace) {
+		return key
+	}
+	_, attributes, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return strconv.Quote(key)
+	}
+	return strings.Join(attributes, "/")
+}
+
+// isProductRecord - true when the stored JSON has the product docType
+func isProductRecord(value []byte) bool {
+	var doc struct {
+		DocType string `json:"docType"`
+	}
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return false
+	}
+	return doc.DocType == ProductObjectType
+}
+
+// ============================================================================================================================
+// Query Products By Partial Key - finds products by the leading identifiers of the key
+// ============================================================================================================================
+// takes the gtin then optionally the serial and lot in key order, e.g. just the gtin matches every serial of that gtin,
+// followed by the optional page size and bookmark, pass "" for the serial and lot to page through a gtin.
+// Without a page size the first MaxProductItems matches are returned.
+func (t *DataChainCode) queryProductsByPartialKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("queryProductsByPartialKey: enter")
+	defer fmt.Println("queryProductsByPartialKey: exit")
+
+	if len(args) < 1 || len(args) > 5 {
+		errorString := "queryProductsByPartialKey: Incorrect number of arguments. Expecting 1 to 5, gtin, serial, lot, page size and bookmark"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	keyArgs := args
+	var pageArgs []string
+	if len(args) > 3 {
+		keyArgs = args[:3]
+		pageArgs = args[3:]
+	}
+	attributes, err := getPartialKeyAttributes(keyArgs)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+
+	pageSize, bookmark, err := getPageArgs(pageArgs)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(ProductObjectType, attributes, pageSize, bookmark)
+	if err == nil && resultsIterator == nil {
+		err = errors.New("queryProductsByPartialKey: pagination is not supported by this state database")
+	}
+	if err != nil {
+		fmt.Println("queryProductsByPartialKey: Error getting results:", err)
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	response, err := buildQueryResponse(resultsIterator, metadata)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(responseAsBytes)
+} // end of queryProductsByPartialKey
+
+// getPartialKeyAttributes - normalizes the identifiers the same way getProductKey does,
+// an empty identifier can only be followed by empty identifiers
+func getPartialKeyAttributes(args []string) ([]string, error) {
+	attributes := []string{}
+	for idx, arg := range args {
+		if len(arg) == 0 {
+			for _, rest := range args[idx:] {
+				if len(rest) > 0 {
+					return nil, errors.New("getPartialKeyAttributes: identifiers must be given in key order, gtin, serial, lot, expirationDate")
+				}
+			}
+			break
+		}
+		if idx == 0 {
+			if gtin, ok := normalizeGtin(arg); ok {
+				arg = gtin
+			}
+		}
+		if idx == 0 || idx == 2 {
+			arg = strings.ToLower(arg)
+		}
+		attributes = append(attributes, arg)
+	}
+	if len(attributes) == 0 {
+		return nil, errors.New("getPartialKeyAttributes: gtin is required")
+	}
+	return attributes, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompositeKeysDoNotCollide(t *testing.T) {
+	stub := newTestStub(t)
+
+	// serial "12" + lot "3A" and serial "1" + lot "23A" were the same concatenated key
+	first := strings.Replace(strings.Replace(mockDevJson, `"serialNo":1936800`, `"serialNo":"12"`, 1), `"lot":"M036191"`, `"lot":"3A"`, 1)
+	second := strings.Replace(strings.Replace(mockDevJson, `"serialNo":1936800`, `"serialNo":"1"`, 1), `"lot":"M036191"`, `"lot":"23A"`, 1)
+
+	results := stub.MockInvoke("createTx1", [][]byte{[]byte("createProduct"), []byte(first)})
+	assert.Equal(t, 200, int(results.Status), "createProduct first")
+	results = stub.MockInvoke("createTx2", [][]byte{[]byte("createProduct"), []byte(second)})
+	assert.Equal(t, 200, int(results.Status), "createProduct second")
+} // end of TestCompositeKeysDoNotCollide
+
+func TestMigrateProductKeys(t *testing.T) {
+	fmt.Println("TestMigrateProductKeys: enter")
+	defer fmt.Println("TestMigrateProductKeys: exit")
+
+	stub := newTestStub(t)
+	results := stub.MockInit("initTx", [][]byte{[]byte("init"), []byte(`{"gs1Mode":"lenient","adminMspIds":["RegulatorMSP"]}`)})
+	assert.Equal(t, 200, int(results.Status), "Init")
+
+	// two records written with the old concatenated keys
+	first := strings.Replace(mockDevJson, `{`, `{"docType":"product-data",`, 1)
+	second := strings.Replace(first, `"serialNo":1936800`, `"serialNo":1936801`, 1)
+	stub.MockTransactionStart("legacyTx")
+	stub.PutState("088065550186111936800m03619110/10/2026", []byte(first))
+	stub.PutState("088065550186111936801m03619110/10/2026", []byte(second))
+	stub.MockTransactionEnd("legacyTx")
+
+	// only the admin organizations can migrate
+	results = stub.MockInvoke("migrateTx0", [][]byte{[]byte("migrateProductKeys"), []byte("1")})
+	assert.Equal(t, 500, int(results.Status), "migrateProductKeys by a non admin")
+	assert.Contains(t, results.Message, "caller is ManufacturerMSP")
+	setCreator(t, stub, "RegulatorMSP", "admin")
+
+	results = stub.MockInvoke("migrateTx1", [][]byte{[]byte("migrateProductKeys"), []byte("1")})
+	assert.Equal(t, 200, int(results.Status), "migrateProductKeys first batch")
+	var result MigrationResult
+	assert.Nil(t, json.Unmarshal(results.Payload, &result))
+	assert.Equal(t, MigrationResult{Migrated: 1, Conflicts: []string{}, Remaining: true}, result)
+	events := takeEvents(stub)
+	assert.Len(t, events, 1)
+	assert.Equal(t, ProductKeysMigratedEvent, events[0].EventName)
+	assert.Equal(t, results.Payload, events[0].Payload)
+
+	results = stub.MockInvoke("migrateTx2", [][]byte{[]byte("migrateProductKeys")})
+	assert.Equal(t, 200, int(results.Status), "migrateProductKeys second batch")
+	assert.Nil(t, json.Unmarshal(results.Payload, &result))
+	assert.Equal(t, MigrationResult{Migrated: 1, Conflicts: []string{}, Remaining: false}, result)
+
+	_, err := getProduct(stub, mockDevKey)
+	assert.Nil(t, err)
+	_, err = getProduct(stub, "088065550186111936800m03619110/10/2026")
+	assert.NotNil(t, err, "old key is removed")
+
+	// the config is not a product and stays put
+	config, err := getConfig(stub)
+	assert.Nil(t, err)
+	assert.Equal(t, GS1ModeLenient, config.GS1Mode)
+} // end of TestMigrateProductKeys
+
+func TestQueryProductsByPartialKey(t *testing.T) {
+	stub := newPagedQueryStub(t)
+	cc := new(DataChainCode)
+
+	for idx, serial := range []string{"S1", "S2", "S3"} {
+		productJSON := strings.Replace(mockDevJson, `"serialNo":1936800`, `"serialNo":"`+serial+`"`, 1)
+		results := stub.MockInvoke(fmt.Sprintf("createTx%d", idx), [][]byte{[]byte("createProduct"), []byte(productJSON)})
+		assert.Equal(t, 200, int(results.Status), "createProduct "+serial)
+	}
+	other := strings.Replace(mockDevJson, `"gtin":"08806555018611"`, `"gtin":"04006381333931"`, 1)
+	results := stub.MockInvoke("createTxOther", [][]byte{[]byte("createProduct"), []byte(other)})
+	assert.Equal(t, 200, int(results.Status), "createProduct other gtin")
+
+	response, results := invokeQuery(stub, stub.MockStub, cc.queryProductsByPartialKey, "08806555018611")
+	assert.Equal(t, 200, int(results.Status), "queryProductsByPartialKey gtin")
+	assert.Equal(t, int32(3), response.FetchedRecordsCount)
+	assert.Equal(t, "", response.Bookmark)
+	assert.Equal(t, testProductKey("08806555018611", "S1", "m036191", "2026-10-10"), response.Products[0].Key)
+	var record map[string]interface{}
+	json.Unmarshal(response.Products[0].Record, &record)
+	assert.Equal(t, "S1", record["serialNo"])
+
+	response, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByPartialKey, "08806555018611", "S2", "M036191")
+	assert.Equal(t, 200, int(results.Status), "queryProductsByPartialKey gtin serial lot")
+	assert.Equal(t, int32(1), response.FetchedRecordsCount)
+
+	// pages of 2 through the gtin
+	response, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByPartialKey, "08806555018611", "", "", "2", "")
+	assert.Equal(t, 200, int(results.Status), "queryProductsByPartialKey page 1")
+	assert.Equal(t, int32(2), response.FetchedRecordsCount)
+	assert.NotEmpty(t, response.Bookmark)
+	response, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByPartialKey, "08806555018611", "", "", "2", response.Bookmark)
+	assert.Equal(t, 200, int(results.Status), "queryProductsByPartialKey page 2")
+	assert.Equal(t, int32(1), response.FetchedRecordsCount)
+	assert.Equal(t, "", response.Bookmark)
+
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByPartialKey, "08806555018611", "", "M036191")
+	assert.Equal(t, 500, int(results.Status), "queryProductsByPartialKey out of order")
+	_, results = invokeQuery(stub, stub.MockStub, cc.queryProductsByPartialKey, "08806555018611", "", "", "2")
+	assert.Equal(t, 500, int(results.Status), "page size without a bookmark")
+} // end of TestQueryProductsByPartialKey
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// LifecycleTransition - an event allowed on a product in one of the From statuses, the product moves to To.
+// The status "" is a product that doesn't exist yet, so events from "" are the ones that create products
+type LifecycleTransition struct {
+	Event string   `json:"event"`
+	From  []string `json:"from"`
+	To    string   `json:"to"`
+}
+
+// product statuses used by the default lifecycle
+const (
+	StatusActive         = "active"
+	StatusPacked         = "packed"
+	StatusInTransit      = "in-transit"
+	StatusDispensed      = "dispensed"
+	StatusDecommissioned = "decommissioned"
+	StatusRecalled       = "recalled"
+	StatusQuarantined    = "quarantined"
+	StatusReturned       = "returned"
+)
+
+// defaultLifecycle - commission, pack, ship, receive then dispense or decommission,
+// with recall, quarantine and return branches
+func defaultLifecycle() []LifecycleTransition {
+	return []LifecycleTransition{
+		{Event: "commission", From: []string{""}, To: StatusActive},
+		{Event: "pack", From: []string{StatusActive}, To: StatusPacked},
+		{Event: "unpack", From: []string{StatusPacked}, To: StatusActive},
+		{Event: ShipEvent, From: []string{StatusActive, StatusPacked}, To: StatusInTransit},
+		{Event: ReceiveEvent, From: []string{StatusInTransit}, To: StatusActive},
+		{Event: "dispense", From: []string{StatusActive}, To: StatusDispensed},
+		{Event: "decommission", From: []string{StatusActive, StatusPacked, StatusQuarantined, StatusReturned, StatusRecalled}, To: StatusDecommissioned},
+		{Event: RecallEvent, From: []string{StatusActive, StatusPacked, StatusInTransit, StatusQuarantined, StatusReturned}, To: StatusRecalled},
+		{Event: "quarantine", From: []string{StatusActive, StatusPacked, StatusReturned}, To: StatusQuarantined},
+		{Event: "release", From: []string{StatusQuarantined, StatusReturned}, To: StatusActive},
+		{Event: "return", From: []string{StatusActive, StatusInTransit, StatusDispensed}, To: StatusReturned},
+	}
+}
+
+// validateLifecycle - every transition needs an event, from and to statuses, an event can only
+// appear once and at least one event has to create products
+func validateLifecycle(lifecycle []LifecycleTransition) error {
+	events := make(map[string]bool)
+	creates := false
+	for idx, transition := range lifecycle {
+		if len(transition.Event) == 0 || len(transition.From) == 0 || len(transition.To) == 0 {
+			return errors.New("validateLifecycle: transition " + strconv.Itoa(idx) + " needs an event, from and to")
+		}
+		if events[transition.Event] {
+			return errors.New("validateLifecycle: event " + transition.Event + " is defined more than once")
+		}
+		events[transition.Event] = true
+		for _, from := range transition.From {
+			if len(from) == 0 {
+				creates = true
+			}
+		}
+	}
+	if !creates {
+		return errors.New("validateLifecycle: at least one event must be allowed from \"\" to create products")
+	}
+	return nil
+}
+
+// findTransition - the transition for event, nil when the lifecycle doesn't have the event
+func findTransition(lifecycle []LifecycleTransition, event string) *LifecycleTransition {
+	for idx := range lifecycle {
+		if lifecycle[idx].Event == event {
+			return &lifecycle[idx]
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Apply Lifecycle - checks the event on product against the status of the stored product and sets the new status
+// ============================================================================================================================
+// existing is nil when the product is being created. The status is set by the chaincode, a status sent by the
+// client has to match the status the event leads to. When the event is unchanged there is no transition and
+// the status can't change, so other fields can be corrected without repeating the event.
+func applyLifecycle(lifecycle []LifecycleTransition, existing *Product, product *Product) error {
+	current := ""
+	if existing != nil {
+		current = existing.Status
+		if product.Event == existing.Event {
+			if len(product.Status) > 0 && product.Status != existing.Status {
+				return errors.New("applyLifecycle: status can only change through a lifecycle event, status is " + strconv.Quote(existing.Status) + " and event is still " + strconv.Quote(existing.Event))
+			}
+			product.Status = existing.Status
+			return nil
+		}
+	}
+
+	transition := findTransition(lifecycle, product.Event)
+	if transition == nil {
+		events := []string{}
+		for _, t := range lifecycle {
+			events = append(events, t.Event)
+		}
+		return errors.New("applyLifecycle: unknown event " + strconv.Quote(product.Event) + ", expected one of " + strings.Join(events, ", "))
+	}
+	allowed := false
+	for _, from := range transition.From {
+		if from == current {
+			allowed = true
+		}
+	}
+	if !allowed {
+		if existing == nil {
+			return errors.New("applyLifecycle: event " + strconv.Quote(product.Event) + " can not create a product, use one of " + strings.Join(creatingEvents(lifecycle), ", "))
+		}
+		return errors.New("applyLifecycle: event " + strconv.Quote(product.Event) + " is not allowed for a product with status " + strconv.Quote(current) + ", it is allowed from " + quoteAll(transition.From))
+	}
+	// the stored status carried over by a merge or a resent document isn't a conflicting status
+	if len(product.Status) > 0 && product.Status != current && product.Status != transition.To {
+		return errors.New("applyLifecycle: event " + strconv.Quote(product.Event) + " moves the product to status " + strconv.Quote(transition.To) + ", got status " + strconv.Quote(product.Status))
+	}
+	product.Status = transition.To
+	return nil
+} // end of applyLifecycle
+
+// creatingEvents - the events allowed from "" that create products
+func creatingEvents(lifecycle []LifecycleTransition) []string {
+	events := []string{}
+	for _, transition := range lifecycle {
+		for _, from := range transition.From {
+			if len(from) == 0 {
+				events = append(events, transition.Event)
+			}
+		}
+	}
+	return events
+}
+
+// quoteAll - the values quoted and comma separated for error messages
+func quoteAll(values []string) string {
+	quoted := make([]string, len(values))
+	for idx, value := range values {
+		quoted[idx] = strconv.Quote(value)
+	}
+	return strings.Join(quoted, ", ")
+}
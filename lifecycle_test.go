@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyLifecycle(t *testing.T) {
+	lifecycle := defaultLifecycle()
+	assert.Nil(t, validateLifecycle(lifecycle))
+
+	product := Product{Event: "commission"}
+	assert.Nil(t, applyLifecycle(lifecycle, nil, &product))
+	assert.Equal(t, StatusActive, product.Status)
+
+	// a product has to be commissioned first
+	product = Product{Event: ShipEvent}
+	err := applyLifecycle(lifecycle, nil, &product)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `event "ship" can not create a product, use one of commission`)
+
+	// decommissioned products can't come back
+	existing := Product{Event: "decommission", Status: StatusDecommissioned}
+	product = Product{Event: "commission", Status: StatusActive}
+	err = applyLifecycle(lifecycle, &existing, &product)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `event "commission" is not allowed for a product with status "decommissioned", it is allowed from ""`)
+
+	product = Product{Event: "teleport"}
+	err = applyLifecycle(lifecycle, &existing, &product)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `unknown event "teleport"`)
+
+	// the event decides the status
+	existing = Product{Event: "pack", Status: StatusPacked}
+	product = Product{Event: ShipEvent, Status: StatusDispensed}
+	assert.NotNil(t, applyLifecycle(lifecycle, &existing, &product))
+	product = Product{Event: ShipEvent, Status: StatusPacked}
+	assert.Nil(t, applyLifecycle(lifecycle, &existing, &product))
+	assert.Equal(t, StatusInTransit, product.Status)
+
+	// no new event, no status change
+	product = Product{Event: "pack", Status: StatusActive}
+	assert.NotNil(t, applyLifecycle(lifecycle, &existing, &product))
+	product = Product{Event: "pack"}
+	assert.Nil(t, applyLifecycle(lifecycle, &existing, &product))
+	assert.Equal(t, StatusPacked, product.Status)
+} // end of TestApplyLifecycle
+
+func TestLifecycleTransitions(t *testing.T) {
+	fmt.Println("TestLifecycleTransitions: enter")
+	defer fmt.Println("TestLifecycleTransitions: exit")
+
+	stub := newTestStub(t)
+	results := stub.MockInvoke("createTx", [][]byte{[]byte("createProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 200, int(results.Status), "createProduct")
+
+	version := 1
+	steps := []struct {
+		event  string
+		status string
+		ok     bool
+	}{
+		{"quarantine", StatusQuarantined, true},
+		{"dispense", "", false},
+		{"release", StatusActive, true},
+		{"dispense", StatusDispensed, true},
+		{"quarantine", "", false},
+		{"return", StatusReturned, true},
+		{"decommission", StatusDecommissioned, true},
+		{"release", "", false},
+	}
+	for _, step := range steps {
+		results = stub.MockInvoke("updateTx", [][]byte{[]byte("updateProduct"), []byte(mockDevKey), []byte(fmt.Sprint(version)), []byte(`{"event":"` + step.event + `"}`)})
+		if !step.ok {
+			assert.Equal(t, 500, int(results.Status), step.event)
+			assert.Contains(t, results.Message, "is not allowed for a product with status")
+			continue
+		}
+		assert.Equal(t, 200, int(results.Status), step.event)
+		version++
+		product, _ := getProduct(stub, mockDevKey)
+		assert.Equal(t, step.status, product.Status, step.event)
+	}
+
+	// upsert is checked against the stored product too
+	results = stub.MockInvoke("upsertTx", [][]byte{[]byte("upsertProduct"), []byte(mockDevJson)})
+	assert.Equal(t, 500, int(results.Status), "upsert commission over decommissioned product")
+} // end of TestLifecycleTransitions
+
+func TestCustomLifecycle(t *testing.T) {
+	stub := newTestStub(t)
+	results := stub.MockInit("initTx", [][]byte{[]byte("init"), []byte(`{"lifecycle":[{"event":"commission","from":[""],"to":"made"},{"event":"sell","from":["made"],"to":"sold"}]}`)})
+	assert.Equal(t, 200, int(results.Status), "Init lifecycle")
+
+	results = stub.MockInvoke("createTx", [][]byte{[]byte("createProduct"), []byte(strings.Replace(mockDevJson, `"status":"active",`, "", 1))})
+	assert.Equal(t, 200, int(results.Status), "createProduct")
+	product, _ := getProduct(stub, mockDevKey)
+	assert.Equal(t, "made", product.Status)
+
+	results = stub.MockInvoke("updateTx1", [][]byte{[]byte("updateProduct"), []byte(mockDevKey), []byte("1"), []byte(`{"event":"ship"}`)})
+	assert.Equal(t, 500, int(results.Status), "event not in custom lifecycle")
+	results = stub.MockInvoke("updateTx2", [][]byte{[]byte("updateProduct"), []byte(mockDevKey), []byte("1"), []byte(`{"event":"sell"}`)})
+	assert.Equal(t, 200, int(results.Status), "sell")
+
+	results = stub.MockInit("initTx2", [][]byte{[]byte("init"), []byte(`{"lifecycle":[{"event":"sell","from":["made"],"to":"sold"}]}`)})
+	assert.Equal(t, 500, int(results.Status), "Init lifecycle without a creating event")
+	results = stub.MockInit("initTx3", [][]byte{[]byte("init"), []byte(`{"lifecycle":[{"event":"commission","from":[""],"to":"made"},{"event":"commission","from":["made"],"to":"sold"}]}`)})
+	assert.Equal(t, 500, int(results.Status), "Init lifecycle with a duplicate event")
+} // end of TestCustomLifecycle
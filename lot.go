@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// LotObjectType - defines the lot object type, also the composite key object type
+const LotObjectType = "lot-data"
+
+// LotIndexObjectType - the composite key object type of the index of the products of a lot, the gtin and lot
+// followed by the attributes of the product key
+const LotIndexObjectType = "gtin~lot~key"
+
+// LotIndexResult - returned by indexProductLots
+type LotIndexResult struct {
+	Indexed   int  `json:"indexed"`
+	Remaining bool `json:"remaining"`
+}
+
+// LotRecord - the owner of a lot, written when its first product is commissioned
+type LotRecord struct {
+	DocType   string `json:"docType"`
+	Gtin      string `json:"gtin"`
+	Lot       string `json:"lot"`
+	OriginGln string `json:"originGln"`
+	MSPID     string `json:"mspId"`
+	TxID      string `json:"txId"`
+}
+
+// getLotKey - the lot record key, normalized the same way as the product key
+func getLotKey(stub shim.ChaincodeStubInterface, gtin string, lot string) (string, error) {
+	return stub.CreateCompositeKey(LotObjectType, []string{strings.ToLower(gtin), strings.ToLower(lot)})
+}
+
+// getLotOwner - the lot record of a lot, nil when the lot has no products. A lot commissioned before the records
+// were kept gets an unsaved record, without a txId, from the originGln of its products, the record has no originGln
+// when they don't have one or don't agree on it
+func getLotOwner(stub shim.ChaincodeStubInterface, gtin string, lot string) (*LotRecord, error) {
+	key, err := getLotKey(stub, gtin, lot)
+	if err != nil {
+		return nil, err
+	}
+	recordAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("getLotOwner: Failed to read lot - " + err.Error())
+	}
+	if len(recordAsBytes) > 0 {
+		var record LotRecord
+		if err := json.Unmarshal(recordAsBytes, &record); err != nil {
+			return nil, errors.New("getLotOwner: Error with stored JSON format - " + err.Error())
+		}
+		return &record, nil
+	}
+
+	resultsIterator, err := getLotIterator(stub, gtin, lot)
+	if err != nil {
+		return nil, errors.New("getLotOwner: Error getting products - " + err.Error())
+	}
+	defer resultsIterator.Close()
+	var record *LotRecord
+	for resultsIterator.HasNext() {
+		indexResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		productKey, err := getLotProductKey(stub, indexResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		product, err := getProduct(stub, productKey)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			record = &LotRecord{DocType: LotObjectType, Gtin: gtin, Lot: lot, OriginGln: product.OriginGln}
+		} else if record.OriginGln != product.OriginGln {
+			record.OriginGln = ""
+			break
+		}
+	}
+	return record, nil
+}
+
+// putLotRecord - writes the lot record of a lot
+func putLotRecord(stub shim.ChaincodeStubInterface, record LotRecord) error {
+	key, err := getLotKey(stub, record.Gtin, record.Lot)
+	if err != nil {
+		return err
+	}
+	recordAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	fmt.Println("putLotRecord: call putState, key = ", displayKey(stub, key))
+	return stub.PutState(key, recordAsBytes)
+}
+
+// checkLotOwner - called when product is commissioned. The first product of a lot records its originGln and the
+// caller as the lot's owner, later products can only be commissioned by the owner of that GLN so no other
+// organization can add units to the lot, and with them recall it. product.SubmitterMSPID has to be set
+func checkLotOwner(stub shim.ChaincodeStubInterface, product *Product) error {
+	record, err := getLotOwner(stub, product.Gtin, product.Lot)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return putLotRecord(stub, LotRecord{DocType: LotObjectType, Gtin: product.Gtin, Lot: product.Lot, OriginGln: product.OriginGln, MSPID: product.SubmitterMSPID, TxID: stub.GetTxID()})
+	}
+	if len(record.OriginGln) > 0 {
+		if err := checkPartyOwner(stub, product.SubmitterMSPID, "gln", record.OriginGln); err != nil {
+			return errors.New("checkLotOwner: lot " + product.Lot + " was commissioned at GLN " + record.OriginGln + ", only its owner can commission more of it, caller is " + product.SubmitterMSPID)
+		}
+	} else if len(record.MSPID) == 0 || record.MSPID != product.SubmitterMSPID {
+		return errors.New("checkLotOwner: the GLN lot " + product.Lot + " was commissioned at isn't known or its products don't agree on it, more of it can't be commissioned")
+	}
+	if len(record.TxID) == 0 {
+		// a lot from before the records were kept, its owner is decided now
+		record.MSPID = product.SubmitterMSPID
+		record.TxID = stub.GetTxID()
+		return putLotRecord(stub, *record)
+	}
+	return nil
+}
+
+// getLotIndexKey - the gtin~lot~key index entry of the product stored under key, "" for the old concatenated keys
+func getLotIndexKey(stub shim.ChaincodeStubInterface, key string) (string, error) {
+	if !strings.HasPrefix(key, compositeKeyNamespace) {
+		return "", nil
+	}
+	objectType, attributes, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return "", err
+	}
+	if objectType != ProductObjectType || len(attributes) != 4 {
+		return "", errors.New("getLotIndexKey: " + displayKey(stub, key) + " is not a product key")
+	}
+	// the product key already holds the lowercased gtin and lot
+	return stub.CreateCompositeKey(LotIndexObjectType, append([]string{attributes[0], attributes[2]}, attributes...))
+}
+
+// putLotIndex - adds the product stored under key to the index recallLot reads the products of a lot from,
+// the index is only read through its keys so the value is a placeholder
+func putLotIndex(stub shim.ChaincodeStubInterface, key string) error {
+	indexKey, err := getLotIndexKey(stub, key)
+	if err != nil || len(indexKey) == 0 {
+		return err
+	}
+	return stub.PutState(indexKey, []byte{0x00})
+}
+
+// getLotProductKey - the product key an entry of the gtin~lot~key index points to
+func getLotProductKey(stub shim.ChaincodeStubInterface, indexKey string) (string, error) {
+	_, attributes, err := stub.SplitCompositeKey(indexKey)
+	if err != nil {
+		return "", err
+	}
+	if len(attributes) < 3 {
+		return "", errors.New("getLotProductKey: index key " + displayKey(stub, indexKey) + " has no product key")
+	}
+	return stub.CreateCompositeKey(ProductObjectType, attributes[2:])
+}
+
+// getLotIterator - iterates the gtin~lot~key index entries of a lot, normalized the same way as the product key
+func getLotIterator(stub shim.ChaincodeStubInterface, gtin string, lot string) (shim.StateQueryIteratorInterface, error) {
+	if normalized, ok := normalizeGtin(gtin); ok {
+		gtin = normalized
+	}
+	return stub.GetStateByPartialCompositeKey(LotIndexObjectType, []string{strings.ToLower(gtin), strings.ToLower(lot)})
+}
+
+// ============================================================================================================================
+// Index Product Lots - adds the products written before the gtin~lot~key index was kept to it
+// ============================================================================================================================
+// takes an optional argument, the max products to index in this transaction (default and max MaxProductItems),
+// call again until remaining is false. recallLot and queryRecallHolders only see indexed products, so run this
+// once after upgrading. Only the adminMspIds in the config can index as it reads every organization's products.
+func (t *DataChainCode) indexProductLots(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("indexProductLots: enter")
+	defer fmt.Println("indexProductLots: exit")
+
+	if err := checkAdmin(stub, "indexProductLots", "index product lots"); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+
+	maxitems := MaxProductItems
+	if len(args) > 0 {
+		i, err := strconv.Atoi(args[0])
+		if err != nil || i < 1 || i > MaxProductItems {
+			errorString := "indexProductLots: maxitems must be an integer between 1 and " + strconv.Itoa(MaxProductItems) + ", got " + args[0]
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		maxitems = i
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(ProductObjectType, []string{})
+	if err != nil {
+		fmt.Println("indexProductLots: Error getting products:", err)
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	result := LotIndexResult{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		indexKey, err := getLotIndexKey(stub, queryResponse.Key)
+		if err != nil {
+			fmt.Println(err)
+			return shim.Error(err.Error())
+		}
+		indexAsBytes, err := stub.GetState(indexKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(indexAsBytes) > 0 {
+			continue
+		}
+		if result.Indexed >= maxitems {
+			result.Remaining = true
+			break
+		}
+		fmt.Println("indexProductLots: indexing key = ", displayKey(stub, queryResponse.Key))
+		if err := stub.PutState(indexKey, []byte{0x00}); err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Indexed++
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("indexProductLots: result = ", string(resultAsBytes))
+	return shim.Success(resultAsBytes)
+} // end of indexProductLots
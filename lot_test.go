@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexProductLots(t *testing.T) {
+	fmt.Println("TestIndexProductLots: enter")
+	defer fmt.Println("TestIndexProductLots: exit")
+
+	stub, key := newCustodyStub(t)
+	indexKey, err := getLotIndexKey(stub, key)
+	assert.Nil(t, err)
+	indexAsBytes, _ := stub.GetState(indexKey)
+	assert.NotEmpty(t, indexAsBytes, "created products are indexed")
+	productKey, err := getLotProductKey(stub, indexKey)
+	assert.Nil(t, err)
+	assert.Equal(t, key, productKey)
+
+	// a product of the lot written before the index was kept and one of another lot
+	product, _ := getProduct(stub, key)
+	product.SerialNumber = "1936801"
+	unindexed, _ := getProductKey(stub, product)
+	other := product
+	other.Lot = "M999999"
+	otherKey, _ := getProductKey(stub, other)
+	stub.MockTransactionStart("legacyTx")
+	productAsBytes, _ := product.toBytes()
+	stub.PutState(unindexed, productAsBytes)
+	otherAsBytes, _ := other.toBytes()
+	stub.PutState(otherKey, otherAsBytes)
+	stub.MockTransactionEnd("legacyTx")
+
+	results := stub.MockInvoke("indexTx0", [][]byte{[]byte("indexProductLots")})
+	assert.Equal(t, 500, int(results.Status), "indexProductLots by a non admin")
+	results = stub.MockInit("initTx", [][]byte{[]byte("init"), []byte(`{"adminMspIds":["RegulatorMSP"]}`)})
+	assert.Equal(t, 200, int(results.Status), "Init")
+	setCreator(t, stub, "RegulatorMSP", "admin")
+
+	results = stub.MockInvoke("indexTx1", [][]byte{[]byte("indexProductLots"), []byte("1")})
+	assert.Equal(t, 200, int(results.Status), "indexProductLots first batch")
+	var result LotIndexResult
+	assert.Nil(t, json.Unmarshal(results.Payload, &result))
+	assert.Equal(t, LotIndexResult{Indexed: 1, Remaining: true}, result)
+	results = stub.MockInvoke("indexTx2", [][]byte{[]byte("indexProductLots")})
+	assert.Equal(t, 200, int(results.Status), "indexProductLots second batch")
+	assert.Nil(t, json.Unmarshal(results.Payload, &result))
+	assert.Equal(t, LotIndexResult{Indexed: 1, Remaining: false}, result)
+
+	// the recall only reads the lot's entries
+	results = stub.MockInvoke("recallTx", [][]byte{[]byte("recallLot"), []byte("08806555018611"), []byte("m036191"), []byte("contamination"), []byte("I")})
+	assert.Equal(t, 200, int(results.Status), "recallLot")
+	var recall RecallResult
+	assert.Nil(t, json.Unmarshal(results.Payload, &recall))
+	assert.Equal(t, 2, recall.Recalled)
+	product, _ = getProduct(stub, otherKey)
+	assert.Equal(t, StatusActive, product.Status, "other lot")
+} // end of TestIndexProductLots
+
+func TestLotOwner(t *testing.T) {
+	fmt.Println("TestLotOwner: enter")
+	defer fmt.Println("TestLotOwner: exit")
+
+	stub, key := newCustodyStub(t)
+	record, err := getLotOwner(stub, "08806555018611", "m036191")
+	assert.Nil(t, err)
+	assert.Equal(t, &LotRecord{DocType: LotObjectType, Gtin: "08806555018611", Lot: "M036191", OriginGln: "0300060000037", MSPID: "ManufacturerMSP", TxID: "createTx"}, record)
+
+	// the owner commissions more of the lot
+	productJSON := strings.Replace(mockDevJson, `"expirationDate":"10/10/2026"`, `"expirationDate":"2099-12-31"`, 1)
+	productJSON = strings.Replace(productJSON, `"serialNo":1936800`, `"serialNo":"1936801"`, 1)
+	results := stub.MockInvoke("createTx2", [][]byte{[]byte("createProduct"), []byte(productJSON)})
+	assert.Equal(t, 200, int(results.Status), "commission more of the lot")
+
+	// a lot from before the records were kept is owned by the originGln its products agree on
+	lotKey, _ := getLotKey(stub, "08806555018611", "m036191")
+	stub.MockTransactionStart("legacyTx")
+	stub.DelState(lotKey)
+	stub.MockTransactionEnd("legacyTx")
+	record, err = getLotOwner(stub, "08806555018611", "m036191")
+	assert.Nil(t, err)
+	assert.Equal(t, &LotRecord{DocType: LotObjectType, Gtin: "08806555018611", Lot: "m036191", OriginGln: "0300060000037"}, record)
+
+	// and has no owner when they don't agree
+	product, _ := getProduct(stub, key)
+	product.OriginGln = testGlnDistributor
+	productAsBytes, _ := product.toBytes()
+	stub.MockTransactionStart("legacyTx2")
+	stub.PutState(key, productAsBytes)
+	stub.MockTransactionEnd("legacyTx2")
+	record, _ = getLotOwner(stub, "08806555018611", "m036191")
+	assert.Equal(t, "", record.OriginGln)
+	productJSON = strings.Replace(productJSON, `"serialNo":"1936801"`, `"serialNo":"1936802"`, 1)
+	results = stub.MockInvoke("createTx3", [][]byte{[]byte("createProduct"), []byte(productJSON)})
+	assert.Equal(t, 500, int(results.Status), "commission more of a lot without a known owner")
+	results = stub.MockInvoke("recallTx", [][]byte{[]byte("recallLot"), []byte("08806555018611"), []byte("M036191"), []byte("contamination"), []byte("I")})
+	assert.Equal(t, 500, int(results.Status), "recall a lot without a known owner")
+	assert.Contains(t, results.Message, "isn't known")
+
+	record, _ = getLotOwner(stub, "08806555018611", "NOSUCHLOT")
+	assert.Nil(t, record)
+} // end of TestLotOwner
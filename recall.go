@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// RecallObjectType - defines the recall object type, also the composite key object type
+const RecallObjectType = "recall-data"
+
+// RecallEvent - the lifecycle event recorded on recalled products
+const RecallEvent = "recall"
+
+// LotRecalledEvent - chaincode event emitted by recallLot, the payload is the RecallResult
+const LotRecalledEvent = "LotRecalled"
+
+// ShipmentCancelled - a pending shipment closed by a recall
+const ShipmentCancelled = "cancelled"
+
+// recallClasses - FDA recall classes, I being the most serious
+var recallClasses = []string{"I", "II", "III"}
+
+// RecallRecord - a lot recall, stored once for the lot and updated by each recallLot batch
+type RecallRecord struct {
+	DocType     string `json:"docType"`
+	Gtin        string `json:"gtin"`
+	Lot         string `json:"lot"`
+	Reason      string `json:"reason"`
+	RecallClass string `json:"recallClass"`
+	Recalled    int    `json:"recalled"`
+	Skipped     int    `json:"skipped"`
+	Complete    bool   `json:"complete"`
+	MSPID       string `json:"mspId"`
+	StartTxID   string `json:"startTxId"`
+	TxID        string `json:"txId"`
+}
+
+// RecallResult - returned by recallLot, Recalled and Skipped are for this batch, Record has the totals
+type RecallResult struct {
+	Recalled  int          `json:"recalled"`
+	Skipped   int          `json:"skipped"`
+	Remaining bool         `json:"remaining"`
+	Record    RecallRecord `json:"record"`
+}
+
+// RecallHolder - where recalled units of a lot are
+type RecallHolder struct {
+	Gln      string   `json:"gln"`
+	Location string   `json:"location"`
+	Units    int      `json:"units"`
+	Keys     []string `json:"keys"`
+}
+
+// getRecallKey - the recall record key, normalized the same way as the product key
+func getRecallKey(stub shim.ChaincodeStubInterface, gtin string, lot string) (string, error) {
+	return stub.CreateCompositeKey(RecallObjectType, []string{strings.ToLower(gtin), strings.ToLower(lot)})
+}
+
+// checkRecallAuthority - the caller has to be one of the adminMspIds in the config or own the originGln of the lot,
+// the GLN in its lot record. Lots whose originGln isn't known, created before it was recorded or whose products
+// don't agree on it, can only be recalled by the admin organizations
+func checkRecallAuthority(stub shim.ChaincodeStubInterface, mspID string, gtin string, lot string) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if containsString(config.AdminMSPIDs, mspID) {
+		return nil
+	}
+
+	record, err := getLotOwner(stub, gtin, lot)
+	if err != nil {
+		return err
+	}
+	if record == nil || len(record.OriginGln) == 0 {
+		return errors.New("checkRecallAuthority: the GLN lot " + lot + " was commissioned at isn't known, only the admin organizations can recall it")
+	}
+	if err := checkPartyOwner(stub, mspID, "gln", record.OriginGln); err != nil {
+		return errors.New("checkRecallAuthority: only the admin organizations or the owner of GLN " + record.OriginGln + ", where lot " + lot + " was commissioned, can recall it, caller is " + mspID)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Recall Lot - marks every product of a GTIN and lot as recalled, passes gtin, lot, reason, recall class (I, II or III)
+// and optionally the max products to recall in this transaction (default and max MaxProductItems)
+// ============================================================================================================================
+// Call again with the same arguments until remaining is false. Products already recalled are passed over, products
+// whose status doesn't allow the recall event, e.g. dispensed, are counted as skipped. A pending shipment of a
+// recalled product is cancelled and the product stays with the sender. Any holder's products are recalled,
+// so only the admin organizations and the owner of the GLN the lot was commissioned at can recall it.
+// The products are read from the gtin~lot~key index, products written before it was kept are indexed with indexProductLots.
+func (t *DataChainCode) recallLot(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("recallLot: enter")
+	defer fmt.Println("recallLot: exit")
+
+	if len(args) < 4 || len(args) > 5 {
+		errorString := "recallLot: Incorrect number of arguments. Expecting 4 or 5, gtin, lot, reason, recall class and the optional max items"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	gtin, lot, reason, recallClass := args[0], args[1], args[2], args[3]
+	if normalized, ok := normalizeGtin(gtin); ok {
+		gtin = normalized
+	}
+	if len(lot) == 0 || len(reason) == 0 {
+		errorString := "recallLot: lot and reason are required"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	if !containsString(recallClasses, recallClass) {
+		errorString := "recallLot: recall class must be one of " + strings.Join(recallClasses, ", ") + ", got " + recallClass
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	maxitems := MaxProductItems
+	if len(args) > 4 {
+		i, err := strconv.Atoi(args[4])
+		if err != nil || i < 1 || i > MaxProductItems {
+			errorString := "recallLot: maxitems must be an integer between 1 and " + strconv.Itoa(MaxProductItems) + ", got " + args[4]
+			fmt.Println(errorString)
+			return shim.Error(errorString)
+		}
+		maxitems = i
+	}
+
+	submitter, err := getSubmitter(stub)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if err := checkRecallAuthority(stub, submitter.MSPID, gtin, lot); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	record, err := getRecallRecord(stub, gtin, lot)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if record == nil {
+		record = &RecallRecord{DocType: RecallObjectType, Gtin: gtin, Lot: lot, Reason: reason, RecallClass: recallClass, MSPID: submitter.MSPID, StartTxID: stub.GetTxID()}
+	} else if record.Reason != reason || record.RecallClass != recallClass {
+		errorString := "recallLot: lot " + lot + " is already being recalled with class " + record.RecallClass + " and reason " + strconv.Quote(record.Reason)
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		fmt.Println("recallLot: Error reading config:", err)
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		fmt.Println("recallLot: Error getting transaction time:", err)
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := getLotIterator(stub, gtin, lot)
+	if err != nil {
+		fmt.Println("recallLot: Error getting products:", err)
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	result := RecallResult{}
+	for resultsIterator.HasNext() {
+		indexResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		key, err := getLotProductKey(stub, indexResponse.Key)
+		if err != nil {
+			fmt.Println(err)
+			return shim.Error(err.Error())
+		}
+		existing, err := getProduct(stub, key)
+		if err != nil {
+			fmt.Println("recallLot: Error reading product:", err)
+			return shim.Error(err.Error())
+		}
+		if existing.Event == RecallEvent || existing.Status == StatusRecalled {
+			// recalled by an earlier batch
+			continue
+		}
+
+		product := existing
+		product.Event = RecallEvent
+		if err := applyLifecycle(config.Lifecycle, &existing, &product); err != nil {
+			fmt.Println("recallLot: skipping key = ", displayKey(stub, key), err)
+			result.Skipped++
+			continue
+		}
+		if result.Recalled >= maxitems {
+			result.Remaining = true
+			break
+		}
+
+		if product.Shipment.isPending() {
+			shipment := *product.Shipment
+			shipment.State = ShipmentCancelled
+			shipment.ClosedTxID = stub.GetTxID()
+			shipment.Reason = "recall: " + reason
+			product.Shipment = &shipment
+		}
+		product.EventDate = now.Format(EventDateFormat)
+		product.SubmitterMSPID = submitter.MSPID
+		product.SubmitterSubject = submitter.Subject
+		product.Version++
+		product.TxID = stub.GetTxID()
+		productAsBytes, err := product.toBytes()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		fmt.Println("recallLot: call putState, key = ", displayKey(stub, key))
+		if err := stub.PutState(key, productAsBytes); err != nil {
+			fmt.Println("recallLot: Error invoking on chaincode:", err)
+			return shim.Error(err.Error())
+		}
+		result.Recalled++
+	}
+
+	// skipped products are seen again by every batch, only the last batch's count is kept
+	record.Recalled += result.Recalled
+	record.Skipped = result.Skipped
+	record.Complete = !result.Remaining
+	record.TxID = stub.GetTxID()
+	result.Record = *record
+	if err := putRecallRecord(stub, *record); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.SetEvent(LotRecalledEvent, resultAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("recallLot: result = ", string(resultAsBytes))
+	return shim.Success(resultAsBytes)
+} // end of recallLot
+
+// getRecallRecord - the recall record of a lot, nil when the lot hasn't been recalled
+func getRecallRecord(stub shim.ChaincodeStubInterface, gtin string, lot string) (*RecallRecord, error) {
+	key, err := getRecallKey(stub, gtin, lot)
+	if err != nil {
+		return nil, err
+	}
+	recordAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("getRecallRecord: Failed to read recall - " + err.Error())
+	}
+	if len(recordAsBytes) == 0 {
+		return nil, nil
+	}
+	var record RecallRecord
+	if err := json.Unmarshal(recordAsBytes, &record); err != nil {
+		return nil, errors.New("getRecallRecord: Error with stored JSON format - " + err.Error())
+	}
+	return &record, nil
+}
+
+// putRecallRecord - writes the recall record of a lot
+func putRecallRecord(stub shim.ChaincodeStubInterface, record RecallRecord) error {
+	key, err := getRecallKey(stub, record.Gtin, record.Lot)
+	if err != nil {
+		return err
+	}
+	recordAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	fmt.Println("putRecallRecord: call putState, key = ", displayKey(stub, key))
+	return stub.PutState(key, recordAsBytes)
+}
+
+// ============================================================================================================================
+// Query Recall Holders - lists the GLNs holding recalled units of a lot, passes the gtin and lot
+// ============================================================================================================================
+// Units are counted at the GLN of the product, a shipment cancelled by the recall leaves the unit with the sender.
+func (t *DataChainCode) queryRecallHolders(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("queryRecallHolders: enter")
+	defer fmt.Println("queryRecallHolders: exit")
+
+	if len(args) != 2 {
+		errorString := "queryRecallHolders: Incorrect number of arguments. Expecting 2, gtin and lot"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	gtin, lot := args[0], args[1]
+	if normalized, ok := normalizeGtin(gtin); ok {
+		gtin = normalized
+	}
+
+	resultsIterator, err := getLotIterator(stub, gtin, lot)
+	if err != nil {
+		fmt.Println("queryRecallHolders: Error getting products:", err)
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	holders := map[string]*RecallHolder{}
+	for resultsIterator.HasNext() {
+		indexResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		key, err := getLotProductKey(stub, indexResponse.Key)
+		if err != nil {
+			fmt.Println(err)
+			return shim.Error(err.Error())
+		}
+		product, err := getProduct(stub, key)
+		if err != nil {
+			fmt.Println("queryRecallHolders: Error reading product:", err)
+			return shim.Error(err.Error())
+		}
+		if product.Status != StatusRecalled {
+			continue
+		}
+		holder, ok := holders[product.Gln]
+		if !ok {
+			holder = &RecallHolder{Gln: product.Gln, Location: product.Location, Keys: []string{}}
+			holders[product.Gln] = holder
+		}
+		holder.Units++
+		holder.Keys = append(holder.Keys, key)
+	}
+
+	response := []RecallHolder{}
+	for _, holder := range holders {
+		response = append(response, *holder)
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].Gln < response[j].Gln })
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(responseAsBytes)
+} // end of queryRecallHolders
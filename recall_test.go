@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecallLot(t *testing.T) {
+	fmt.Println("TestRecallLot: enter")
+	defer fmt.Println("TestRecallLot: exit")
+
+	// one product in transit to the distributor, two at the manufacturer and one of another lot
+	stub, shippedKey := newCustodyStub(t)
+	results := stub.MockInvoke("shipTx", [][]byte{[]byte("shipProduct"), []byte(shippedKey), []byte(testGlnDistributor)})
+	assert.Equal(t, 200, int(results.Status), "shipProduct")
+	createTestProducts(t, stub, "S1", "S2")
+	otherLot := strings.Replace(strings.Replace(mockDevJson, `"lot":"M036191"`, `"lot":"M999999"`, 1), `"serialNo":1936800`, `"serialNo":"S3"`, 1)
+	results = stub.MockInvoke("createS3", [][]byte{[]byte("createProduct"), []byte(otherLot)})
+	assert.Equal(t, 200, int(results.Status), "createProduct other lot")
+	dispensedKey := testProductKey("08806555018611", "S2", "m036191", "2026-10-10")
+	results = stub.MockInvoke("dispenseTx", [][]byte{[]byte("updateProduct"), []byte(dispensedKey), []byte("1"), []byte(`{"event":"dispense"}`)})
+	assert.Equal(t, 200, int(results.Status), "dispense S2")
+	takeEvents(stub)
+
+	results = stub.MockInvoke("recallTx0", [][]byte{[]byte("recallLot"), []byte("08806555018611"), []byte("M036191"), []byte("contamination"), []byte("IV")})
+	assert.Equal(t, 500, int(results.Status), "recallLot bad class")
+
+	// the GTIN and lot are normalized like the product key
+	results = stub.MockInvoke("recallTx1", [][]byte{[]byte("recallLot"), []byte("8806555018611"), []byte("m036191"), []byte("contamination"), []byte("I"), []byte("1")})
+	assert.Equal(t, 200, int(results.Status), "recallLot first batch")
+	var result RecallResult
+	assert.Nil(t, json.Unmarshal(results.Payload, &result))
+	assert.Equal(t, 1, result.Recalled)
+	assert.True(t, result.Remaining)
+	assert.False(t, result.Record.Complete)
+	events := takeEvents(stub)
+	assert.Len(t, events, 1)
+	assert.Equal(t, LotRecalledEvent, events[0].EventName)
+
+	results = stub.MockInvoke("recallTx2", [][]byte{[]byte("recallLot"), []byte("08806555018611"), []byte("M036191"), []byte("other reason"), []byte("I")})
+	assert.Equal(t, 500, int(results.Status), "recallLot with another reason")
+
+	results = stub.MockInvoke("recallTx3", [][]byte{[]byte("recallLot"), []byte("08806555018611"), []byte("M036191"), []byte("contamination"), []byte("I")})
+	assert.Equal(t, 200, int(results.Status), "recallLot second batch")
+	assert.Nil(t, json.Unmarshal(results.Payload, &result))
+	assert.Equal(t, 1, result.Recalled)
+	assert.Equal(t, 1, result.Skipped, "the dispensed unit")
+	assert.False(t, result.Remaining)
+	assert.Equal(t, RecallRecord{DocType: RecallObjectType, Gtin: "08806555018611", Lot: "m036191", Reason: "contamination", RecallClass: "I", Recalled: 2, Skipped: 1, Complete: true, MSPID: "ManufacturerMSP", StartTxID: "recallTx1", TxID: "recallTx3"}, result.Record)
+
+	shipped, _ := getProduct(stub, shippedKey)
+	assert.Equal(t, StatusRecalled, shipped.Status)
+	assert.Equal(t, RecallEvent, shipped.Event)
+	assert.Equal(t, ShipmentCancelled, shipped.Shipment.State)
+	dispensed, _ := getProduct(stub, dispensedKey)
+	assert.Equal(t, StatusDispensed, dispensed.Status)
+	other, _ := getProduct(stub, testProductKey("08806555018611", "S3", "m999999", "2026-10-10"))
+	assert.Equal(t, StatusActive, other.Status)
+
+	// the cancelled shipment can't be accepted
+	setCreator(t, stub, "DistributorMSP", "user1")
+	results = stub.MockInvoke("acceptTx", [][]byte{[]byte("acceptShipment"), []byte(shippedKey)})
+	assert.Equal(t, 500, int(results.Status), "accept a recalled shipment")
+
+	results = stub.MockInvoke("holdersTx", [][]byte{[]byte("queryRecallHolders"), []byte("08806555018611"), []byte("M036191")})
+	assert.Equal(t, 200, int(results.Status), "queryRecallHolders")
+	var holders []RecallHolder
+	assert.Nil(t, json.Unmarshal(results.Payload, &holders))
+	assert.Len(t, holders, 1)
+	assert.Equal(t, "0300060000037", holders[0].Gln)
+	assert.Equal(t, 2, holders[0].Units)
+	assert.ElementsMatch(t, []string{shippedKey, testProductKey("08806555018611", "S1", "m036191", "2026-10-10")}, holders[0].Keys)
+} // end of TestRecallLot
+
+func TestRecallLotAuthority(t *testing.T) {
+	fmt.Println("TestRecallLotAuthority: enter")
+	defer fmt.Println("TestRecallLotAuthority: exit")
+
+	stub, key := newCustodyStub(t)
+	results := stub.MockInit("initTx", [][]byte{[]byte("init"), []byte(`{"adminMspIds":["RegulatorMSP"]}`)})
+	assert.Equal(t, 200, int(results.Status), "Init")
+	product, _ := getProduct(stub, key)
+	assert.Equal(t, "0300060000037", product.OriginGln)
+	recall := [][]byte{[]byte("recallLot"), []byte("08806555018611"), []byte("M036191"), []byte("contamination"), []byte("II")}
+
+	// an organization without the commissioning GLN, one that holds a GLN elsewhere in the chain and an unknown lot
+	setCreator(t, stub, "RandomMSP", "user1")
+	results = stub.MockInvoke("recallTx1", recall)
+	assert.Equal(t, 500, int(results.Status), "recallLot by another organization")
+	assert.Contains(t, results.Message, "caller is RandomMSP")
+	setCreator(t, stub, "DistributorMSP", "user1")
+	results = stub.MockInvoke("recallTx2", recall)
+	assert.Equal(t, 500, int(results.Status), "recallLot by the distributor")
+	results = stub.MockInvoke("recallTx3", [][]byte{[]byte("recallLot"), []byte("08806555018611"), []byte("NOSUCHLOT"), []byte("contamination"), []byte("II")})
+	assert.Equal(t, 500, int(results.Status), "recallLot of a lot without products")
+	// an organization commissioning a unit of the lot at its own GLN doesn't become an owner of the lot
+	registerTestGln(t, stub, testGlnEPCISManufacturer, "RandomMSP")
+	setCreator(t, stub, "RandomMSP", "user1")
+	claim := strings.Replace(mockDevJson, `"expirationDate":"10/10/2026"`, `"expirationDate":"2099-12-31"`, 1)
+	claim = strings.Replace(claim, `"serialNo":1936800`, `"serialNo":"S666"`, 1)
+	claim = strings.NewReplacer(`"gln":"0300060000037"`, `"gln":"`+testGlnEPCISManufacturer+`"`, `"sender":"manufacturer"`, `"sender":"`+testGlnEPCISManufacturer+`"`).Replace(claim)
+	results = stub.MockInvoke("claimTx", [][]byte{[]byte("createProduct"), []byte(claim)})
+	assert.Equal(t, 500, int(results.Status), "commission a unit of another organization's lot")
+	assert.Contains(t, results.Message, "was commissioned at GLN 0300060000037")
+	results = stub.MockInvoke("recallTx5", recall)
+	assert.Equal(t, 500, int(results.Status), "recallLot after trying to join the lot")
+	product, _ = getProduct(stub, key)
+	assert.Equal(t, StatusActive, product.Status, "nothing was recalled")
+	record, _ := getRecallRecord(stub, "08806555018611", "M036191")
+	assert.Nil(t, record)
+
+	// the admin organizations can recall any lot
+	setCreator(t, stub, "RegulatorMSP", "admin")
+	results = stub.MockInvoke("recallTx4", recall)
+	assert.Equal(t, 200, int(results.Status), "recallLot by an admin organization")
+	product, _ = getProduct(stub, key)
+	assert.Equal(t, StatusRecalled, product.Status)
+} // end of TestRecallLotAuthority
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Condition - one CouchDB selector condition, e.g. {"event":{"$eq":"ship"}}, values are
+// only ever encoded with encoding/json so they can't change the shape of the selector
+type Condition map[string]interface{}
+
+// couchIndex - a CouchDB index defined under META-INF/statedb/couchdb/indexes
+type couchIndex struct {
+	DesignDoc string
+	Name      string
+}
+
+// eventIndex - indexDataEvent.json
+var eventIndex = couchIndex{DesignDoc: "_design/data_eventIndexDoc", Name: "data_eventIndex"}
+
+// gtinIndex - indexDataGtin.json
+var gtinIndex = couchIndex{DesignDoc: "_design/data_gtinIndexDoc", Name: "data_gtinIndex"}
+
+// lotIndex - indexDataLot.json
+var lotIndex = couchIndex{DesignDoc: "_design/data_lotIndexDoc", Name: "data_lotIndex"}
+
+// glnIndex - indexDataGln.json
+var glnIndex = couchIndex{DesignDoc: "_design/data_glnIndexDoc", Name: "data_glnIndex"}
+
+// eventDateIndex - indexDataEventDate.json, event_dt first so it serves ranges and sorting
+var eventDateIndex = couchIndex{DesignDoc: "_design/data_eventDateIndexDoc", Name: "data_eventDateIndex"}
+
+// expirationDateIndex - indexDataExpirationDate.json
+var expirationDateIndex = couchIndex{DesignDoc: "_design/data_expirationDateIndexDoc", Name: "data_expirationDateIndex"}
+
+// locationIndex - indexDataLocation.json
+var locationIndex = couchIndex{DesignDoc: "_design/data_locationIndexDoc", Name: "data_locationIndex"}
+
+// statusIndex - indexDataStatus.json
+var statusIndex = couchIndex{DesignDoc: "_design/data_statusIndexDoc", Name: "data_statusIndex"}
+
+func eq(field string, value interface{}) Condition {
+	return Condition{field: map[string]interface{}{"$eq": value}}
+}
+
+func gt(field string, value interface{}) Condition {
+	return Condition{field: map[string]interface{}{"$gt": value}}
+}
+
+func gte(field string, value interface{}) Condition {
+	return Condition{field: map[string]interface{}{"$gte": value}}
+}
+
+func lt(field string, value interface{}) Condition {
+	return Condition{field: map[string]interface{}{"$lt": value}}
+}
+
+func lte(field string, value interface{}) Condition {
+	return Condition{field: map[string]interface{}{"$lte": value}}
+}
+
+func in(field string, values ...interface{}) Condition {
+	return Condition{field: map[string]interface{}{"$in": values}}
+}
+
+func regex(field string, pattern string) Condition {
+	return Condition{field: map[string]interface{}{"$regex": pattern}}
+}
+
+func and(conditions ...Condition) Condition {
+	return Condition{"$and": conditions}
+}
+
+func or(conditions ...Condition) Condition {
+	return Condition{"$or": conditions}
+}
+
+// QueryBuilder - builds a CouchDB query JSON string for the rich query functions
+type QueryBuilder struct {
+	conditions []Condition
+	sort       []map[string]string
+	fields     []string
+	index      *couchIndex
+}
+
+// newProductQuery - a query that only matches products
+func newProductQuery() *QueryBuilder {
+	return newQuery(ProductObjectType)
+}
+
+// newQuery - a query that only matches documents of docType
+func newQuery(docType string) *QueryBuilder {
+	return &QueryBuilder{conditions: []Condition{eq("docType", docType)}}
+}
+
+// Where - adds conditions that must all match
+func (query *QueryBuilder) Where(conditions ...Condition) *QueryBuilder {
+	query.conditions = append(query.conditions, conditions...)
+	return query
+}
+
+// SortBy - adds a sort field, CouchDB needs an index covering the sort fields
+func (query *QueryBuilder) SortBy(field string, descending bool) *QueryBuilder {
+	direction := "asc"
+	if descending {
+		direction = "desc"
+	}
+	query.sort = append(query.sort, map[string]string{field: direction})
+	return query
+}
+
+// Fields - limits the fields returned for each document
+func (query *QueryBuilder) Fields(fields ...string) *QueryBuilder {
+	query.fields = append(query.fields, fields...)
+	return query
+}
+
+// UseIndex - tells CouchDB which index to use
+func (query *QueryBuilder) UseIndex(index couchIndex) *QueryBuilder {
+	query.index = &index
+	return query
+}
+
+// Build - returns the query JSON, conditions are merged into a single selector object so CouchDB
+// can match them to an index, e.g. gte and lt on one field become {"field":{"$gte":..,"$lt":..}},
+// when they can't be merged they are combined with $and
+func (query *QueryBuilder) Build() (string, error) {
+	if len(query.conditions) == 0 {
+		return "", errors.New("QueryBuilder: a query needs at least one condition")
+	}
+
+	selector := Condition{}
+	for _, condition := range query.conditions {
+		for field, value := range condition {
+			existing, ok := selector[field]
+			if !ok {
+				selector[field] = value
+				continue
+			}
+			merged, ok := mergeOperators(existing, value)
+			if !ok {
+				return query.marshal(and(query.conditions...))
+			}
+			selector[field] = merged
+		}
+	}
+	return query.marshal(selector)
+}
+
+// mergeOperators - combines two operator objects on the same field when they don't share an operator
+func mergeOperators(first interface{}, second interface{}) (map[string]interface{}, bool) {
+	firstOps, ok := first.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	secondOps, ok := second.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	merged := make(map[string]interface{})
+	for op, value := range firstOps {
+		merged[op] = value
+	}
+	for op, value := range secondOps {
+		if _, ok := merged[op]; ok {
+			return nil, false
+		}
+		merged[op] = value
+	}
+	return merged, true
+}
+
+// marshal - encodes the query document around the selector
+func (query *QueryBuilder) marshal(selector Condition) (string, error) {
+	doc := map[string]interface{}{"selector": selector}
+	if len(query.sort) > 0 {
+		doc["sort"] = query.sort
+	}
+	if len(query.fields) > 0 {
+		doc["fields"] = query.fields
+	}
+	if query.index != nil {
+		doc["use_index"] = []string{query.index.DesignDoc, query.index.Name}
+	}
+
+	queryAsBytes, err := json.Marshal(doc)
+	if err != nil {
+		return "", errors.New("QueryBuilder: error building query - " + err.Error())
+	}
+	return string(queryAsBytes), nil
+}
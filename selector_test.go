@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryBuilderEscapesValues(t *testing.T) {
+	// a quoted value can't add fields to the selector
+	queryString, err := newProductQuery().Where(eq("event", `ship"},"docType":{"$gt":null`)).UseIndex(eventIndex).Build()
+	assert.Nil(t, err)
+
+	var query map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(queryString), &query))
+	assert.Equal(t, map[string]interface{}{
+		"docType": map[string]interface{}{"$eq": "product-data"},
+		"event":   map[string]interface{}{"$eq": `ship"},"docType":{"$gt":null`},
+	}, query["selector"])
+	assert.Equal(t, []interface{}{"_design/data_eventIndexDoc", "data_eventIndex"}, query["use_index"])
+} // end of TestQueryBuilderEscapesValues
+
+func TestQueryBuilderOperators(t *testing.T) {
+	queryString, err := newProductQuery().
+		Where(or(eq("status", "active"), in("event", "ship", "receive")), regex("lot", "^M03"), gte("event_dt", "2019-01-01"), lt("event_dt", "2020-01-01")).
+		SortBy("event_dt", true).
+		Fields("gtin", "lot").
+		Build()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"selector": {
+			"docType": {"$eq": "product-data"},
+			"$or": [{"status": {"$eq": "active"}}, {"event": {"$in": ["ship", "receive"]}}],
+			"lot": {"$regex": "^M03"},
+			"event_dt": {"$gte": "2019-01-01", "$lt": "2020-01-01"}
+		},
+		"sort": [{"event_dt": "desc"}],
+		"fields": ["gtin", "lot"]
+	}`, queryString)
+
+	// conditions that can't be merged fall back to $and
+	queryString, err = newProductQuery().Where(eq("status", "active"), eq("status", "packed")).Build()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"selector": {"$and": [
+		{"docType": {"$eq": "product-data"}},
+		{"status": {"$eq": "active"}},
+		{"status": {"$eq": "packed"}}
+	]}}`, queryString)
+} // end of TestQueryBuilderOperators
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// HopMoved - the state of a hop recorded by a write that changed the gln without a shipment,
+// e.g. records written before shipProduct or units following a container after their shipment was cancelled
+const HopMoved = "moved"
+
+// CustodyHop - one transfer of a product between GLNs, State is the shipment state or HopMoved.
+// Container is the SSCC of the container the product was in when it was shipped
+type CustodyHop struct {
+	FromGln      string `json:"fromGln"`
+	FromLocation string `json:"fromLocation"`
+	ToGln        string `json:"toGln"`
+	ToLocation   string `json:"toLocation"`
+	Sender       string `json:"sender"`
+	Receiver     string `json:"receiver"`
+	Container    string `json:"container,omitempty"`
+	State        string `json:"state"`
+	ShipTxID     string `json:"shipTxId"`
+	ShippedAt    string `json:"shippedAt"`
+	ClosedTxID   string `json:"closedTxId,omitempty"`
+	ClosedAt     string `json:"closedAt,omitempty"`
+	closedAt     time.Time
+}
+
+// ContainerSpan - a time a product or container was packed in the container Sscc, Contents is the product key or
+// SSCC that was packed. Unpacked is empty while it is still packed
+type ContainerSpan struct {
+	Sscc         string `json:"sscc"`
+	Contents     string `json:"contents"`
+	PackedTxID   string `json:"packedTxId"`
+	PackedAt     string `json:"packedAt"`
+	UnpackedTxID string `json:"unpackedTxId,omitempty"`
+	UnpackedAt   string `json:"unpackedAt,omitempty"`
+	packedAt     time.Time
+	unpackedAt   time.Time
+}
+
+// ProductTrace - the chain of custody of a product, oldest first, and the containers it was packed in
+// including the containers those were packed in
+type ProductTrace struct {
+	Key          string          `json:"key"`
+	Gtin         string          `json:"gtin"`
+	Lot          string          `json:"lot"`
+	SerialNumber string          `json:"serialNo"`
+	OriginGln    string          `json:"originGln"`
+	Gln          string          `json:"gln"`
+	Status       string          `json:"status"`
+	Hops         []CustodyHop    `json:"hops"`
+	Containers   []ContainerSpan `json:"containers"`
+}
+
+// LotTraceGln - a GLN units of a lot reached, Keys are the units that were commissioned at or received by it,
+// Holding the units there now and InTransit the units shipped to it that are not accepted yet
+type LotTraceGln struct {
+	Gln          string   `json:"gln"`
+	Keys         []string `json:"keys"`
+	Holding      int      `json:"holding"`
+	InTransit    int      `json:"inTransit"`
+	FirstArrival string   `json:"firstArrival"`
+	firstArrival time.Time
+}
+
+// LotTrace - every GLN the units of a lot reached, in the order the lot first arrived at them
+type LotTrace struct {
+	Gtin  string        `json:"gtin"`
+	Lot   string        `json:"lot"`
+	Units int           `json:"units"`
+	Glns  []LotTraceGln `json:"glns"`
+}
+
+// ============================================================================================================================
+// Trace Custody - works out the custody hops and the containers of a product from its history, oldest first
+// ============================================================================================================================
+// A hop starts with the write of shipProduct and is closed by the accept, reject or recall of the shipment,
+// a write that changes the gln without a shipment is a moved hop. Deleted states are skipped.
+func traceCustody(key string, entries []HistoryEntry) (ProductTrace, error) {
+	trace := ProductTrace{Key: key, Hops: []CustodyHop{}, Containers: []ContainerSpan{}}
+	var previous *Product
+	for _, entry := range entries {
+		if entry.IsDelete {
+			continue
+		}
+		product, err := getProductFromJSON(entry.Value)
+		if err != nil {
+			return trace, errors.New("traceCustody: Error with stored JSON format of transaction " + entry.TxID + " - " + err.Error())
+		}
+
+		shipment := product.Shipment
+		switch {
+		case shipment != nil && shipment.ShipTxID == entry.TxID:
+			trace.Hops = append(trace.Hops, CustodyHop{
+				FromGln:      shipment.FromGln,
+				FromLocation: product.Location,
+				ToGln:        shipment.ToGln,
+				ToLocation:   product.ToLocation,
+				Sender:       product.Sender,
+				Receiver:     product.Receiver,
+				Container:    product.Parent,
+				State:        shipment.State,
+				ShipTxID:     entry.TxID,
+				ShippedAt:    entry.Timestamp,
+			})
+		case shipment != nil && shipment.ClosedTxID == entry.TxID:
+			for idx := range trace.Hops {
+				hop := &trace.Hops[idx]
+				if hop.ShipTxID == shipment.ShipTxID {
+					hop.State = shipment.State
+					hop.ClosedTxID = entry.TxID
+					hop.ClosedAt = entry.Timestamp
+					hop.closedAt = entry.at
+					if shipment.State == ShipmentAccepted {
+						hop.ToLocation = product.Location
+					}
+				}
+			}
+		case previous != nil && previous.Gln != product.Gln:
+			trace.Hops = append(trace.Hops, CustodyHop{
+				FromGln:      previous.Gln,
+				FromLocation: previous.Location,
+				ToGln:        product.Gln,
+				ToLocation:   product.Location,
+				Sender:       product.Sender,
+				Receiver:     product.Receiver,
+				Container:    product.Parent,
+				State:        HopMoved,
+				ShipTxID:     entry.TxID,
+				ShippedAt:    entry.Timestamp,
+				ClosedTxID:   entry.TxID,
+				ClosedAt:     entry.Timestamp,
+				closedAt:     entry.at,
+			})
+		}
+
+		previousParent := ""
+		if previous != nil {
+			previousParent = previous.Parent
+		}
+		trace.Containers = addContainerSpan(trace.Containers, key, previousParent, product.Parent, entry)
+
+		if previous == nil {
+			trace.OriginGln = product.Gln
+		}
+		trace.Gtin = product.Gtin
+		trace.Lot = product.Lot
+		trace.SerialNumber = product.SerialNumber
+		trace.Gln = product.Gln
+		trace.Status = product.Status
+		previous = &product
+	}
+	return trace, nil
+} // end of traceCustody
+
+// addContainerSpan - closes the open span of contents when it leaves previousParent and opens one when it is packed in parent
+func addContainerSpan(spans []ContainerSpan, contents string, previousParent string, parent string, entry HistoryEntry) []ContainerSpan {
+	if previousParent == parent {
+		return spans
+	}
+	if len(previousParent) > 0 {
+		for idx := range spans {
+			if spans[idx].Sscc == previousParent && len(spans[idx].UnpackedTxID) == 0 {
+				spans[idx].UnpackedTxID = entry.TxID
+				spans[idx].UnpackedAt = entry.Timestamp
+				spans[idx].unpackedAt = entry.at
+			}
+		}
+	}
+	if len(parent) > 0 {
+		spans = append(spans, ContainerSpan{Sscc: parent, Contents: contents, PackedTxID: entry.TxID, PackedAt: entry.Timestamp, packedAt: entry.at})
+	}
+	return spans
+}
+
+// overlaps - true when the two spans were packed at the same time, an open span lasts until now
+func (span ContainerSpan) overlaps(other ContainerSpan) bool {
+	isOpen := func(s ContainerSpan) bool { return len(s.UnpackedTxID) == 0 }
+	return (isOpen(other) || span.packedAt.Before(other.unpackedAt)) && (isOpen(span) || other.packedAt.Before(span.unpackedAt))
+}
+
+// getOuterContainerSpans - the spans of the containers the containers in spans were packed in while they held the product
+func getOuterContainerSpans(stub shim.ChaincodeStubInterface, spans []ContainerSpan) ([]ContainerSpan, error) {
+	result := append([]ContainerSpan{}, spans...)
+	for idx := 0; idx < len(result); idx++ {
+		if len(result) > MaxContainerItems {
+			return nil, errors.New("getOuterContainerSpans: more than " + strconv.Itoa(MaxContainerItems) + " container spans")
+		}
+		inner := result[idx]
+		containerKey, err := getContainerKey(stub, inner.Sscc)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := getKeyHistory(stub, containerKey)
+		if err != nil {
+			return nil, err
+		}
+		outer := []ContainerSpan{}
+		previousParent := ""
+		for _, entry := range entries {
+			parent := ""
+			if !entry.IsDelete {
+				var container Container
+				if err := json.Unmarshal(entry.Value, &container); err != nil {
+					return nil, errors.New("getOuterContainerSpans: Error with stored JSON format of container " + inner.Sscc + " - " + err.Error())
+				}
+				parent = container.Parent
+			}
+			outer = addContainerSpan(outer, inner.Sscc, previousParent, parent, entry)
+			previousParent = parent
+		}
+		for _, span := range outer {
+			if span.overlaps(inner) {
+				result = append(result, span)
+			}
+		}
+	}
+	return result, nil
+}
+
+// ============================================================================================================================
+// Trace Product - returns the chain of custody of a product, every sender to receiver hop with the GLNs, locations and
+// dates from its history, and the containers it was packed in, passes the key
+// ============================================================================================================================
+func (t *DataChainCode) traceProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("traceProduct: enter")
+	defer fmt.Println("traceProduct: exit")
+
+	if len(args) != 1 {
+		errorString := "traceProduct: Incorrect number of arguments. Expecting 1, the key"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	key := args[0]
+	entries, err := getKeyHistory(stub, key)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if len(entries) == 0 {
+		errorString := "traceProduct: product " + key + " has no history"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	trace, err := traceCustody(key, entries)
+	if err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+	if trace.Containers, err = getOuterContainerSpans(stub, trace.Containers); err != nil {
+		fmt.Println(err)
+		return shim.Error(err.Error())
+	}
+
+	traceAsBytes, err := json.Marshal(trace)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(traceAsBytes)
+} // end of traceProduct
+
+// ============================================================================================================================
+// Trace Lot - returns every GLN units of a lot reached, where they were commissioned and every GLN downstream,
+// passes the gtin and lot
+// ============================================================================================================================
+// The units are read from the state and traced through their history like traceProduct. A GLN is reached when a
+// shipment to it is accepted, rejected shipments don't count and pending ones are counted as in transit.
+func (t *DataChainCode) traceLot(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("traceLot: enter")
+	defer fmt.Println("traceLot: exit")
+
+	if len(args) != 2 {
+		errorString := "traceLot: Incorrect number of arguments. Expecting 2, gtin and lot"
+		fmt.Println(errorString)
+		return shim.Error(errorString)
+	}
+	gtin, lot := args[0], args[1]
+	if normalized, ok := normalizeGtin(gtin); ok {
+		gtin = normalized
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(ProductObjectType, []string{strings.ToLower(gtin)})
+	if err != nil {
+		fmt.Println("traceLot: Error getting products:", err)
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	response := LotTrace{Gtin: gtin, Lot: lot, Glns: []LotTraceGln{}}
+	glns := map[string]*LotTraceGln{}
+	reached := func(gln string, key string, at time.Time) *LotTraceGln {
+		traceGln, ok := glns[gln]
+		if !ok {
+			traceGln = &LotTraceGln{Gln: gln, Keys: []string{}, firstArrival: at}
+			glns[gln] = traceGln
+		}
+		if !containsString(traceGln.Keys, key) {
+			traceGln.Keys = append(traceGln.Keys, key)
+		}
+		// zero when a pending shipment to the GLN was seen first
+		if traceGln.firstArrival.IsZero() || at.Before(traceGln.firstArrival) {
+			traceGln.firstArrival = at
+		}
+		return traceGln
+	}
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		product, err := getProductFromJSON(queryResponse.Value)
+		if err != nil {
+			fmt.Println("traceLot: Error with stored JSON format, key = ", displayKey(stub, queryResponse.Key), err)
+			return shim.Error(err.Error())
+		}
+		if strings.ToLower(product.Lot) != strings.ToLower(lot) {
+			continue
+		}
+		entries, err := getKeyHistory(stub, queryResponse.Key)
+		if err != nil {
+			fmt.Println(err)
+			return shim.Error(err.Error())
+		}
+		trace, err := traceCustody(queryResponse.Key, entries)
+		if err != nil {
+			fmt.Println(err)
+			return shim.Error(err.Error())
+		}
+		response.Units++
+
+		if len(entries) > 0 {
+			reached(trace.OriginGln, queryResponse.Key, entries[0].at)
+		}
+		for _, hop := range trace.Hops {
+			switch hop.State {
+			case ShipmentAccepted, HopMoved:
+				reached(hop.ToGln, queryResponse.Key, hop.closedAt)
+			}
+		}
+		if product.Shipment.isPending() {
+			if traceGln, ok := glns[product.Shipment.ToGln]; ok {
+				traceGln.InTransit++
+			} else {
+				glns[product.Shipment.ToGln] = &LotTraceGln{Gln: product.Shipment.ToGln, Keys: []string{}, InTransit: 1}
+			}
+		}
+		if traceGln, ok := glns[product.Gln]; ok {
+			traceGln.Holding++
+		}
+	}
+
+	for _, traceGln := range glns {
+		if !traceGln.firstArrival.IsZero() {
+			traceGln.FirstArrival = traceGln.firstArrival.Format(HistoryTimestampFormat)
+		}
+		response.Glns = append(response.Glns, *traceGln)
+	}
+	// GLNs only reached by pending shipments go last
+	sort.Slice(response.Glns, func(i, j int) bool {
+		a, b := response.Glns[i], response.Glns[j]
+		if a.firstArrival.IsZero() != b.firstArrival.IsZero() {
+			return b.firstArrival.IsZero()
+		}
+		if !a.firstArrival.Equal(b.firstArrival) {
+			return a.firstArrival.Before(b.firstArrival)
+		}
+		return a.Gln < b.Gln
+	})
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(responseAsBytes)
+} // end of traceLot
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTraceHistory - two units of a lot packed in a case on a pallet and shipped to the distributor,
+// the distributor breaks the pallet down and sends one unit on to the pharmacy. Returns the unit keys
+func newTraceHistory(t *testing.T) (*historyStub, []string) {
+	stub := newHistoryStub(t)
+	at := func(day int, hour int) time.Time {
+		return testHistoryTime(day).Add(time.Duration(hour) * time.Hour)
+	}
+	invoke := func(txID string, when time.Time, args ...string) {
+		results := stub.invoke(txID, when, args...)
+		assert.Equal(t, 200, int(results.Status), txID+" "+results.Message)
+	}
+
+	registerTestGln(t, stub.MockStub, testGlnDistributor, "DistributorMSP")
+	registerTestGln(t, stub.MockStub, testGlnPharmacy, "PharmacyMSP")
+	setCreator(t, stub.MockStub, "ManufacturerMSP", "user1")
+	keys := []string{}
+	for _, serial := range []string{"1936800", "1936801"} {
+		productJSON := strings.Replace(mockDevJson, `"expirationDate":"10/10/2026"`, `"expirationDate":"2099-12-31"`, 1)
+		productJSON = strings.Replace(productJSON, `"serialNo":1936800`, `"serialNo":"`+serial+`"`, 1)
+		invoke("create"+serial, at(0, 1), "createProduct", productJSON)
+		keys = append(keys, testProductKey("08806555018611", serial, "m036191", "2099-12-31"))
+	}
+	invoke("packCaseTx", at(1, 0), "aggregate", testSsccCase1, string(childrenJSON(keys...)))
+	invoke("packPalletTx", at(1, 1), "aggregate", testSsccPallet, string(childrenJSON(testSsccCase1)))
+	invoke("shipPalletTx", at(2, 0), "shipProduct", testSsccPallet, testGlnDistributor, "Raleigh, NC", "distributor")
+
+	setCreator(t, stub.MockStub, "DistributorMSP", "user1")
+	invoke("acceptPalletTx", at(3, 0), "acceptShipment", testSsccPallet)
+	invoke("unpackPalletTx", at(4, 0), "disaggregate", testSsccPallet)
+	invoke("unpackCaseTx", at(4, 1), "disaggregate", testSsccCase1, string(childrenJSON(keys[0])))
+	invoke("shipUnitTx", at(5, 0), "shipProduct", keys[0], testGlnPharmacy, "Durham, NC", "pharmacy")
+
+	setCreator(t, stub.MockStub, "PharmacyMSP", "user1")
+	invoke("acceptUnitTx", at(6, 0), "acceptShipment", keys[0])
+	return stub, keys
+}
+
+func TestTraceProduct(t *testing.T) {
+	fmt.Println("TestTraceProduct: enter")
+	defer fmt.Println("TestTraceProduct: exit")
+
+	stub, keys := newTraceHistory(t)
+	cc := new(DataChainCode)
+
+	var trace ProductTrace
+	results := invokeHistoryQuery(stub, cc.traceProduct, &trace, keys[0])
+	assert.Equal(t, 200, int(results.Status), "traceProduct")
+	assert.Equal(t, "0300060000037", trace.OriginGln)
+	assert.Equal(t, testGlnPharmacy, trace.Gln)
+	assert.Equal(t, StatusActive, trace.Status)
+	assert.Equal(t, []CustodyHop{
+		{
+			FromGln: "0300060000037", FromLocation: "Wilson, NC", ToGln: testGlnDistributor, ToLocation: "Raleigh, NC",
+			Sender: "manufacturer", Receiver: "distributor", Container: testSsccCase1, State: ShipmentAccepted,
+			ShipTxID: "shipPalletTx", ShippedAt: "2024-03-03T12:00:00Z", ClosedTxID: "acceptPalletTx", ClosedAt: "2024-03-04T12:00:00Z",
+		},
+		{
+			FromGln: testGlnDistributor, FromLocation: "Raleigh, NC", ToGln: testGlnPharmacy, ToLocation: "Durham, NC",
+			Sender: "manufacturer", Receiver: "pharmacy", State: ShipmentAccepted,
+			ShipTxID: "shipUnitTx", ShippedAt: "2024-03-06T12:00:00Z", ClosedTxID: "acceptUnitTx", ClosedAt: "2024-03-07T12:00:00Z",
+		},
+	}, trace.Hops)
+	assert.Equal(t, []ContainerSpan{
+		{Sscc: testSsccCase1, Contents: keys[0], PackedTxID: "packCaseTx", PackedAt: "2024-03-02T12:00:00Z", UnpackedTxID: "unpackCaseTx", UnpackedAt: "2024-03-05T13:00:00Z"},
+		{Sscc: testSsccPallet, Contents: testSsccCase1, PackedTxID: "packPalletTx", PackedAt: "2024-03-02T13:00:00Z", UnpackedTxID: "unpackPalletTx", UnpackedAt: "2024-03-05T12:00:00Z"},
+	}, trace.Containers)
+
+	trace = ProductTrace{}
+	results = invokeHistoryQuery(stub, cc.traceProduct, &trace, keys[1])
+	assert.Equal(t, 200, int(results.Status), "traceProduct of the unit left in the case")
+	assert.Equal(t, testGlnDistributor, trace.Gln)
+	assert.Equal(t, 1, len(trace.Hops))
+	assert.Equal(t, 2, len(trace.Containers))
+	assert.Equal(t, "", trace.Containers[0].UnpackedTxID, "still in the case")
+
+	results = invokeHistoryQuery(stub, cc.traceProduct, &trace, "noSuchKey")
+	assert.Equal(t, 500, int(results.Status), "traceProduct of an unknown key")
+} // end of TestTraceProduct
+
+func TestTraceLot(t *testing.T) {
+	fmt.Println("TestTraceLot: enter")
+	defer fmt.Println("TestTraceLot: exit")
+
+	stub, keys := newTraceHistory(t)
+	cc := new(DataChainCode)
+	// a unit of the lot on its way from the distributor to the pharmacy and one of another lot
+	setCreator(t, stub.MockStub, "DistributorMSP", "user1")
+	results := stub.invoke("unpackCaseTx2", testHistoryTime(7), "disaggregate", testSsccCase1)
+	assert.Equal(t, 200, int(results.Status), "empty the case")
+	results = stub.invoke("shipUnitTx2", testHistoryTime(7), "shipProduct", keys[1], testGlnPharmacy)
+	assert.Equal(t, 200, int(results.Status), "ship the second unit")
+	setCreator(t, stub.MockStub, "ManufacturerMSP", "user1")
+	otherLot := strings.Replace(mockDevJson, `"lot":"M036191"`, `"lot":"M999999"`, 1)
+	results = stub.invoke("createOtherLot", testHistoryTime(7), "createProduct", otherLot)
+	assert.Equal(t, 200, int(results.Status), "create another lot")
+	// a unit traced before the others, its pending shipment is the first it sees of the pharmacy
+	firstUnit := strings.Replace(mockDevJson, `"expirationDate":"10/10/2026"`, `"expirationDate":"2099-12-31"`, 1)
+	firstUnit = strings.Replace(firstUnit, `"serialNo":1936800`, `"serialNo":"1936799"`, 1)
+	results = stub.invoke("createFirstUnit", testHistoryTime(7), "createProduct", firstUnit)
+	assert.Equal(t, 200, int(results.Status), "create the first unit")
+	firstKey := testProductKey("08806555018611", "1936799", "m036191", "2099-12-31")
+	results = stub.invoke("shipFirstUnit", testHistoryTime(7), "shipProduct", firstKey, testGlnPharmacy)
+	assert.Equal(t, 200, int(results.Status), "ship the first unit")
+
+	var trace LotTrace
+	results = invokeHistoryQuery(stub, cc.traceLot, &trace, "8806555018611", "m036191")
+	assert.Equal(t, 200, int(results.Status), "traceLot")
+	assert.Equal(t, "08806555018611", trace.Gtin)
+	assert.Equal(t, 3, trace.Units)
+	assert.Equal(t, []LotTraceGln{
+		{Gln: "0300060000037", Keys: []string{firstKey, keys[0], keys[1]}, Holding: 1, FirstArrival: "2024-03-01T13:00:00Z"},
+		{Gln: testGlnDistributor, Keys: []string{keys[0], keys[1]}, Holding: 1, FirstArrival: "2024-03-04T12:00:00Z"},
+		{Gln: testGlnPharmacy, Keys: []string{keys[0]}, Holding: 1, InTransit: 2, FirstArrival: "2024-03-07T12:00:00Z"},
+	}, trace.Glns)
+
+	trace = LotTrace{}
+	results = invokeHistoryQuery(stub, cc.traceLot, &trace, "08806555018611", "NOSUCHLOT")
+	assert.Equal(t, 200, int(results.Status), "traceLot of an unknown lot")
+	assert.Equal(t, 0, trace.Units)
+	assert.Equal(t, []LotTraceGln{}, trace.Glns)
+} // end of TestTraceLot
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxSerialLength - the longest serial number allowed by GS1 AI 21
+const MaxSerialLength = 20
+
+// gs1CharacterSet82 - characters allowed in GS1 alphanumeric element strings such as serial numbers
+const gs1CharacterSet82 = "!\"%&'()*+,-./0123456789:;<=>?ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz"
+
+// FieldError - a single field that failed validation
+type FieldError struct {
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Got      string `json:"got"`
+}
+
+// ValidationError - collects every field level problem found in a product JSON,
+// Error() returns the problems as a JSON body so clients can act on each field
+type ValidationError struct {
+	Message string       `json:"error"`
+	Fields  []FieldError `json:"fields"`
+}
+
+func newValidationError() *ValidationError {
+	return &ValidationError{Message: "validation failed", Fields: []FieldError{}}
+}
+
+func (verr *ValidationError) add(field string, expected string, got string) {
+	verr.Fields = append(verr.Fields, FieldError{Field: field, Expected: expected, Got: got})
+}
+
+func (verr *ValidationError) hasErrors() bool {
+	return len(verr.Fields) > 0
+}
+
+// has - true when a problem with field was already added
+func (verr *ValidationError) has(field string) bool {
+	for _, fieldError := range verr.Fields {
+		if fieldError.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (verr *ValidationError) Error() string {
+	bytes, err := json.Marshal(verr)
+	if err != nil {
+		return verr.Message
+	}
+	return string(bytes)
+}
+
+// ============================================================================================================================
+// Validate Product Input - checks JSON submitted by a client before it is written to the ledger
+// ============================================================================================================================
+// Enforces MaxProductJSONSizeAllowed, the type of every known field and that the fields making up the key are present,
+// the expiration date is normalized here as it is part of the key, now is the transaction time
+func validateProductInput(incoming []byte, now time.Time) (Product, error) {
+	fmt.Println("validateProductInput: enter")
+	defer fmt.Println("validateProductInput: exit")
+
+	var product Product
+	if err := validateInputSize(incoming); err != nil {
+		return product, err
+	}
+
+	// type errors are reported with the missing and invalid fields, only a document that isn't a JSON object stops here
+	verr := newValidationError()
+	product, err := getProductFromJSON(incoming)
+	if err != nil {
+		typeErrors, ok := err.(*ValidationError)
+		if !ok || typeErrors.has("document") {
+			return product, err
+		}
+		verr = typeErrors
+	}
+
+	if len(product.Gtin) == 0 && !verr.has("gtin") {
+		verr.add("gtin", "string", "missing")
+	}
+	if len(product.SerialNumber) == 0 {
+		if !verr.has("serialNo") {
+			verr.add("serialNo", "string", "missing")
+		}
+	} else if !isValidSerial(product.SerialNumber) {
+		verr.add("serialNo", "GS1 serial of at most "+strconv.Itoa(MaxSerialLength)+" characters from the GS1 AI 21 character set", product.SerialNumber)
+	}
+	if len(product.Lot) == 0 && !verr.has("lot") {
+		verr.add("lot", "string", "missing")
+	}
+	if len(product.ExpiryDate) == 0 {
+		if !verr.has("expirationDate") {
+			verr.add("expirationDate", "string", "missing")
+		}
+	} else if expiry, err := normalizeExpiryDate(product.ExpiryDate, now); err != nil {
+		verr.add("expirationDate", "MM/DD/YYYY, YYYY-MM-DD or GS1 YYMMDD date", product.ExpiryDate)
+	} else {
+		product.ExpiryDate = expiry
+	}
+	validateProductFields(&product, verr)
+	if verr.hasErrors() {
+		return product, verr
+	}
+	return product, nil
+
+} // end of validateProductInput
+
+// ============================================================================================================================
+// Validate Product Fields - checks and normalizes the values of fields that can change on create and update
+// ============================================================================================================================
+func validateProductFields(product *Product, verr *ValidationError) {
+	if len(product.EventDate) > 0 {
+		eventDate, err := normalizeTimestamp(product.EventDate)
+		if err != nil {
+			verr.add("event_dt", "ISO 8601 timestamp", product.EventDate)
+		} else {
+			product.EventDate = eventDate
+		}
+	}
+	// each coordinate is checked with the other at 0 so the error names the field that is out of range
+	if !isValidLocation(product.LocationInfo.Latitude, 0) {
+		verr.add("loc_cd.lat", "latitude between -90 and 90", strconv.FormatFloat(product.LocationInfo.Latitude, 'f', -1, 64))
+	}
+	if !isValidLocation(0, product.LocationInfo.Longitude) {
+		verr.add("loc_cd.lon", "longitude between -180 and 180", strconv.FormatFloat(product.LocationInfo.Longitude, 'f', -1, 64))
+	}
+} // end of validateProductFields
+
+// EventDateFormat - event_dt is stored in UTC with milliseconds so timestamps compare as strings
+const EventDateFormat = "2006-01-02T15:04:05.000Z"
+
+// normalizeTimestamp - parses an RFC 3339 timestamp, or a date which is taken as midnight UTC,
+// and returns it in EventDateFormat
+func normalizeTimestamp(value string) (string, error) {
+	timestamp, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		var dateErr error
+		timestamp, dateErr = time.Parse("2006-01-02", value)
+		if dateErr != nil {
+			return "", err
+		}
+	}
+	return timestamp.UTC().Format(EventDateFormat), nil
+}
+
+// validateInputSize - rejects client JSON larger than MaxProductJSONSizeAllowed
+func validateInputSize(incoming []byte) error {
+	if len(incoming) > MaxProductJSONSizeAllowed {
+		verr := newValidationError()
+		verr.add("document", "at most "+strconv.Itoa(MaxProductJSONSizeAllowed)+" bytes", strconv.Itoa(len(incoming))+" bytes")
+		return verr
+	}
+	return nil
+}
+
+// jsonTypeOf - names the JSON type of a value produced by json.Unmarshal
+func jsonTypeOf(val interface{}) string {
+	switch val.(type) {
+	case nil:
+		return "null or missing"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+// takeString - removes field from data and returns it as a string, a wrong type is recorded in verr
+func takeString(data map[string]interface{}, field string, verr *ValidationError) string {
+	val, ok := data[field]
+	if !ok {
+		return ""
+	}
+	delete(data, field)
+	str, ok := val.(string)
+	if !ok {
+		verr.add(field, "string", jsonTypeOf(val))
+	}
+	return str
+}
+
+// takeNumber - removes field from data and returns it as a float64, a wrong type is recorded in verr
+func takeNumber(data map[string]interface{}, field string, verr *ValidationError) float64 {
+	val, ok := data[field]
+	if !ok {
+		return 0
+	}
+	delete(data, field)
+	num, ok := val.(float64)
+	if !ok {
+		verr.add(field, "number", jsonTypeOf(val))
+	}
+	return num
+}
+
+// takeSerial - removes field from data and returns the serial as a string, records written before
+// serials were strings hold a JSON number which is converted to its integer digits
+func takeSerial(data map[string]interface{}, field string, verr *ValidationError) string {
+	val, ok := data[field]
+	if !ok {
+		return ""
+	}
+	delete(data, field)
+	serial, ok := serialToString(val)
+	if !ok {
+		verr.add(field, "string", jsonTypeOf(val))
+	}
+	return serial
+}
+
+// serialToString - converts a string or numeric JSON serial to a string
+func serialToString(val interface{}) (string, bool) {
+	switch serial := val.(type) {
+	case string:
+		return serial, true
+	case float64:
+		return strconv.FormatFloat(serial, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// isValidSerial - GS1 AI 21 serials are 1 to 20 characters from GS1 character set 82
+func isValidSerial(serial string) bool {
+	if len(serial) == 0 || len(serial) > MaxSerialLength {
+		return false
+	}
+	for _, c := range serial {
+		if !strings.ContainsRune(gs1CharacterSet82, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// takeStringList - removes field from data and returns it as a []string, wrong types are recorded in verr
+func takeStringList(data map[string]interface{}, field string, verr *ValidationError) []string {
+	val, ok := data[field]
+	if !ok {
+		return nil
+	}
+	delete(data, field)
+	items, ok := val.([]interface{})
+	if !ok {
+		verr.add(field, "array of strings", jsonTypeOf(val))
+		return nil
+	}
+	list := make([]string, 0, len(items))
+	for idx, item := range items {
+		str, ok := item.(string)
+		if !ok {
+			verr.add(field+"["+strconv.Itoa(idx)+"]", "string", jsonTypeOf(item))
+			continue
+		}
+		list = append(list, str)
+	}
+	return list
+}
+
+// takeLocation - removes field from data and returns it as LocationData, wrong types are recorded in verr
+func takeLocation(data map[string]interface{}, field string, verr *ValidationError) LocationData {
+	var location LocationData
+	val, ok := data[field]
+	if !ok {
+		return location
+	}
+	delete(data, field)
+	temp, ok := val.(map[string]interface{})
+	if !ok {
+		verr.add(field, "object", jsonTypeOf(val))
+		return location
+	}
+	if lat, ok := temp["lat"].(float64); ok {
+		location.Latitude = lat
+	} else {
+		verr.add(field+".lat", "number", jsonTypeOf(temp["lat"]))
+	}
+	if lon, ok := temp["lon"].(float64); ok {
+		location.Longitude = lon
+	} else {
+		verr.add(field+".lon", "number", jsonTypeOf(temp["lon"]))
+	}
+	return location
+}
+
+// takeShipment - removes field from data and returns it as a *Shipment, wrong types are recorded in verr
+func takeShipment(data map[string]interface{}, field string, verr *ValidationError) *Shipment {
+	val, ok := data[field]
+	if !ok || val == nil {
+		delete(data, field)
+		return nil
+	}
+	delete(data, field)
+	if _, ok := val.(map[string]interface{}); !ok {
+		verr.add(field, "object", jsonTypeOf(val))
+		return nil
+	}
+	var shipment Shipment
+	valAsBytes, _ := json.Marshal(val)
+	if err := json.Unmarshal(valAsBytes, &shipment); err != nil {
+		verr.add(field, "shipment object", err.Error())
+		return nil
+	}
+	return &shipment
+}
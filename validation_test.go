@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateProductInputTypes(t *testing.T) {
+	fmt.Println("TestValidateProductInputTypes: enter")
+	defer fmt.Println("TestValidateProductInputTypes: exit")
+
+	badJSON := `{"gtin":8806555018611,"lot":"M036191","serialNo":true,"expirationDate":"10/10/2026","loc_cd":{"lat":"35.7","lon":-77.9},"event":true}`
+	_, err := validateProductInput([]byte(badJSON), time.Now())
+	assert.NotNil(t, err)
+
+	verr, ok := err.(*ValidationError)
+	assert.True(t, ok, "expected a *ValidationError")
+
+	var body ValidationError
+	assert.Nil(t, json.Unmarshal([]byte(verr.Error()), &body))
+	assert.Equal(t, "validation failed", body.Message)
+	assert.ElementsMatch(t, []FieldError{
+		{Field: "gtin", Expected: "string", Got: "number"},
+		{Field: "serialNo", Expected: "string", Got: "boolean"},
+		{Field: "loc_cd.lat", Expected: "number", Got: "string"},
+		{Field: "event", Expected: "string", Got: "boolean"},
+	}, body.Fields)
+
+	// type errors and missing fields come back together
+	_, err = validateProductInput([]byte(`{"gtin":8806555018611,"serialNo":"1936800","event":true}`), time.Now())
+	assert.ElementsMatch(t, []FieldError{
+		{Field: "gtin", Expected: "string", Got: "number"},
+		{Field: "event", Expected: "string", Got: "boolean"},
+		{Field: "lot", Expected: "string", Got: "missing"},
+		{Field: "expirationDate", Expected: "string", Got: "missing"},
+	}, err.(*ValidationError).Fields)
+} // end of TestValidateProductInputTypes
+
+func TestValidateProductInputRequiredAndSize(t *testing.T) {
+	_, err := validateProductInput([]byte(`{"serialNo":1}`), time.Now())
+	assert.NotNil(t, err)
+	assert.Len(t, err.(*ValidationError).Fields, 3)
+
+	big := `{"gtin":"08806555018611","lot":"M036191","expirationDate":"10/10/2026","notes":"` + strings.Repeat("x", MaxProductJSONSizeAllowed) + `"}`
+	_, err = validateProductInput([]byte(big), time.Now())
+	assert.NotNil(t, err)
+	assert.Equal(t, "document", err.(*ValidationError).Fields[0].Field)
+
+	_, err = validateProductInput([]byte(`[1,2]`), time.Now())
+	assert.NotNil(t, err)
+} // end of TestValidateProductInputRequiredAndSize
+
+func TestCreateProductInvalidJSON(t *testing.T) {
+	stub := newTestStub(t)
+
+	results := stub.MockInvoke("TestCreateProductInvalidJSON", [][]byte{[]byte("createProduct"), []byte(`{"gtin":"08806555018611","lot":"M036191","expirationDate":"10/10/2026","loc_cd":"35.7,-77.9"}`)})
+	assert.Equal(t, 500, int(results.Status), "createProduct with wrong typed loc_cd")
+	assert.Contains(t, results.Message, `"field":"loc_cd"`)
+} // end of TestCreateProductInvalidJSON
+
+func TestAlphanumericSerial(t *testing.T) {
+	fmt.Println("TestAlphanumericSerial: enter")
+	defer fmt.Println("TestAlphanumericSerial: exit")
+
+	stub := newTestStub(t)
+
+	productJSON := strings.Replace(mockDevJson, `"serialNo":1936800`, `"serialNo":"A1b2-C3/D4.e5_F6%G7H8"`, 1)
+	results := stub.MockInvoke("createTx1", [][]byte{[]byte("createProduct"), []byte(productJSON)})
+	assert.Equal(t, 500, int(results.Status), "serial longer than 20 characters")
+
+	productJSON = strings.Replace(mockDevJson, `"serialNo":1936800`, `"serialNo":"A1b2-C3/D4.e5_F6%G7"`, 1)
+	results = stub.MockInvoke("createTx2", [][]byte{[]byte("createProduct"), []byte(productJSON)})
+	assert.Equal(t, 200, int(results.Status), "alphanumeric serial")
+	product, err := getProduct(stub, testProductKey("08806555018611", "A1b2-C3/D4.e5_F6%G7", "m036191", "2026-10-10"))
+	assert.Nil(t, err)
+	assert.Equal(t, "A1b2-C3/D4.e5_F6%G7", product.SerialNumber)
+
+	productJSON = strings.Replace(mockDevJson, `"serialNo":1936800`, `"serialNo":"12 34"`, 1)
+	results = stub.MockInvoke("createTx3", [][]byte{[]byte("createProduct"), []byte(productJSON)})
+	assert.Equal(t, 500, int(results.Status), "serial with a space")
+} // end of TestAlphanumericSerial
+
+func TestNumericSerialBackwardCompatible(t *testing.T) {
+	stub := newTestStub(t)
+
+	// a record written before serials were strings
+	key := "088065550186111936800m03619110/10/2026"
+	stub.MockTransactionStart("legacyTx")
+	assert.Nil(t, stub.PutState(key, []byte(mockDevJson)))
+	stub.MockTransactionEnd("legacyTx")
+
+	product, err := getProduct(stub, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "1936800", product.SerialNumber)
+
+	// the numeric serial still matches when sent in an update
+	results := stub.MockInvoke("updateTx1", [][]byte{[]byte("updateProduct"), []byte(key), []byte("0"), []byte(`{"serialNo":1936800,"event":"quarantine"}`)})
+	assert.Equal(t, 200, int(results.Status), "updateProduct legacy record")
+	product, _ = getProduct(stub, key)
+	assert.Equal(t, "1936800", product.SerialNumber)
+	assert.Equal(t, StatusQuarantined, product.Status)
+} // end of TestNumericSerialBackwardCompatible